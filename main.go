@@ -3,16 +3,22 @@ package main
 //go:generate ./resources/package.sh
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"os/signal"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/session"
 	sparta "github.com/mweagle/Sparta"
+	spartaAWS "github.com/mweagle/Sparta/aws"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
 	spartaDecorators "github.com/mweagle/Sparta/decorator"
 	"github.com/mweagle/SpartaGeekwire/service"
 	gocf "github.com/mweagle/go-cloudformation"
 	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
 )
 
 /*
@@ -44,39 +50,254 @@ func serviceResourceDecorator(connections *service.Connections,
 					AllowedMethods: gocf.StringList(
 						gocf.String(http.MethodGet),
 						gocf.String(http.MethodPut),
+						gocf.String(http.MethodPost),
 					),
-					MaxAge: gocf.Integer(3000),
+					// Multipart upload clients need the ETag of each part
+					ExposedHeaders: gocf.StringList(gocf.String("ETag")),
+					MaxAge:         gocf.Integer(3000),
 					AllowedHeaders: gocf.StringList(
 						gocf.String("Authorization"),
 						gocf.String("Access-Control-Request-Method"),
 						gocf.String("Access-Control-Request-Headers"),
 						gocf.String("Content-Type"),
 						gocf.String("Origin"),
+						// Declared upload checksums are signed headers
+						gocf.String("Content-MD5"),
+						gocf.String("X-Amz-Content-Sha256"),
 					),
 				},
 			},
 		}
+		// Clean up abandoned multipart uploads
+		s3Bucket.LifecycleConfiguration = &gocf.S3BucketLifecycleConfiguration{
+			Rules: &gocf.S3BucketRuleList{
+				gocf.S3BucketRule{
+					ID:     gocf.String("AbortIncompleteMultipartUploads"),
+					Status: gocf.String("Enabled"),
+					AbortIncompleteMultipartUpload: &gocf.S3BucketAbortIncompleteMultipartUpload{
+						DaysAfterInitiation: gocf.Integer(1),
+					},
+				},
+				// Idempotency records outlive the configured window by
+				// at most a day
+				gocf.S3BucketRule{
+					ID:               gocf.String("ExpireIdempotencyKeys"),
+					Status:           gocf.String("Enabled"),
+					Prefix:           gocf.String(connections.S3KeyspaceIdempotencyKeys + "/"),
+					ExpirationInDays: gocf.Integer(1),
+				},
+			},
+		}
 		s3Resource := cfTemplate.AddResource(connections.S3UploadBucketResourceName,
 			s3Bucket)
 		s3Resource.DeletionPolicy = "Retain"
-		// Add the CORS policy
+
+		// And the dead letter queue for the S3 triggered functions. Keep
+		// messages for the maximum retention period so they can be replayed.
+		cfTemplate.AddResource(connections.DeadLetterQueueResourceName,
+			&gocf.SQSQueue{
+				MessageRetentionPeriod: gocf.Integer(1209600),
+			})
+
+		// And the rate limit counters, which DynamoDB expires once their
+		// window has passed
+		cfTemplate.AddResource(connections.RateLimitTableResourceName,
+			&gocf.DynamoDBTable{
+				AttributeDefinitions: &gocf.DynamoDBTableAttributeDefinitionList{
+					gocf.DynamoDBTableAttributeDefinition{
+						AttributeName: gocf.String("counter"),
+						AttributeType: gocf.String("S"),
+					},
+				},
+				KeySchema: &gocf.DynamoDBTableKeySchemaList{
+					gocf.DynamoDBTableKeySchema{
+						AttributeName: gocf.String("counter"),
+						KeyType:       gocf.String("HASH"),
+					},
+				},
+				ProvisionedThroughput: &gocf.DynamoDBTableProvisionedThroughput{
+					ReadCapacityUnits:  gocf.Integer(1),
+					WriteCapacityUnits: gocf.Integer(5),
+				},
+				TimeToLiveSpecification: &gocf.DynamoDBTableTimeToLiveSpecification{
+					AttributeName: gocf.String("expires_at"),
+					Enabled:       gocf.Bool(true),
+				},
+			})
 		return nil
 	}
 }
 
-func workflowHooks(connections *service.Connections,
+func workflowHooks(config *service.Config,
 	lambdaFunctions []*sparta.LambdaAWSInfo,
 	websiteURL *gocf.StringExpr) *sparta.WorkflowHooks {
 	// Setup the DashboardDecorator lambda hook
 	workflowHooks := &sparta.WorkflowHooks{
 		ServiceDecorators: []sparta.ServiceDecoratorHookHandler{
 			spartaDecorators.DashboardDecorator(lambdaFunctions, 60),
-			serviceResourceDecorator(connections, websiteURL),
+			serviceResourceDecorator(&config.Connections, websiteURL),
+			service.TriggerGraphDecorator(config),
 		},
 	}
 	return workflowHooks
 }
 
+/*
+================================================================================
+╔═╗╔═╗╔╦╗╔╦╗╔═╗╔╗╔╔╦╗╔═╗
+║  ║ ║║║║║║║╠═╣║║║ ║║╚═╗
+╚═╝╚═╝╩ ╩╩ ╩╩ ╩╝╚╝═╩╝╚═╝
+================================================================================
+*/
+func localCommand(config *service.Config) *cobra.Command {
+	var rootDir string
+	var pollInterval time.Duration
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "local",
+		Short: "Run the S3 triggered pipeline against a local directory",
+		Long: `Treats the root directory as the S3 bucket. Files copied into the
+uploads keyspace are processed by the same handlers the lambda functions
+use, with stand-in ML services, until the consolidated report is written.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger := sparta.OptionsGlobal.Logger
+			if logger == nil {
+				logger = logrus.StandardLogger()
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			signals := make(chan os.Signal, 1)
+			signal.Notify(signals, os.Interrupt)
+			go func() {
+				<-signals
+				cancel()
+			}()
+			config.Pipeline.Force = config.Pipeline.Force || force
+			pipeline := service.NewLocalPipeline(config, rootDir, pollInterval)
+			return pipeline.Run(ctx, logger)
+		},
+	}
+	cmd.Flags().StringVarP(&rootDir, "root", "r", "./local-bucket",
+		"Directory to use as the S3 bucket root")
+	cmd.Flags().DurationVarP(&pollInterval, "interval", "i", time.Second,
+		"Interval at which to check for new objects")
+	cmd.Flags().BoolVarP(&force, "force", "f", false,
+		"Reprocess objects whose artifacts are already current")
+	return cmd
+}
+
+// replayTime parses either an RFC3339 timestamp or a duration that's
+// subtracted from the current time
+func replayTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	duration, durationErr := time.ParseDuration(value)
+	if durationErr == nil {
+		return time.Now().Add(-duration), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func replayCommand(config *service.Config, stackName string) *cobra.Command {
+	var options service.ReplayOptions
+	var since string
+	var until string
+	var local bool
+	var rootDir string
+	var deadLetterDir string
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "replay",
+		Short: "Redeliver the S3 events the pipeline failed to process",
+		Long: `Reads the dead lettered S3 events and delivers each one to the stage
+whose trigger keyspace matches the object key. Events are read from the
+stack's dead letter queue, or from --dir. By default the provisioned
+functions are invoked; --local runs the handlers in process and --root
+replays into the local pipeline's bucket. Replayed events are removed
+from the source unless --keep is set.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			logger := sparta.OptionsGlobal.Logger
+			if logger == nil {
+				logger = logrus.StandardLogger()
+			}
+			var timeErr error
+			options.Since, timeErr = replayTime(since)
+			if timeErr != nil {
+				return timeErr
+			}
+			options.Until, timeErr = replayTime(until)
+			if timeErr != nil {
+				return timeErr
+			}
+			config.Pipeline.Force = config.Pipeline.Force || force
+			ctx := context.Background()
+			awsSession := spartaAWS.NewSession(logger)
+			if deadLetterDir == "" && rootDir != "" {
+				deadLetterDir = service.LocalDeadLetterDirectory(rootDir)
+			}
+			var source service.DeadLetterSource
+			if deadLetterDir != "" {
+				source = service.NewDirectoryDeadLetterSource(deadLetterDir)
+			} else {
+				stackSource, stackSourceErr := service.NewStackDeadLetterSource(ctx,
+					config,
+					awsSession,
+					stackName)
+				if stackSourceErr != nil {
+					return stackSourceErr
+				}
+				source = stackSource
+			}
+			var replayer *service.Replayer
+			switch {
+			case rootDir != "":
+				replayer = service.NewLocalPipeline(config, rootDir, time.Second).
+					Replayer(source, options)
+			case local:
+				replayer = service.NewReplayer(config, nil, source, options)
+			default:
+				replayer = service.NewRemoteReplayer(config,
+					awsSession,
+					stackName,
+					source,
+					options)
+			}
+			summary, replayErr := replayer.Run(ctx, logger)
+			logger.WithFields(logrus.Fields{
+				"Replayed": summary.Replayed,
+				"Skipped":  summary.Skipped,
+				"Failed":   summary.Failed,
+			}).Info("Replay complete")
+			if replayErr == nil && summary.Failed != 0 {
+				replayErr = fmt.Errorf("Failed to replay %d dead letters", summary.Failed)
+			}
+			return replayErr
+		},
+	}
+	cmd.Flags().StringSliceVarP(&options.Stages, "stage", "s", nil,
+		"Only replay events for the named stages")
+	cmd.Flags().StringVar(&since, "since", "",
+		"Only replay events after this RFC3339 time or duration ago")
+	cmd.Flags().StringVar(&until, "until", "",
+		"Only replay events before this RFC3339 time or duration ago")
+	cmd.Flags().BoolVarP(&local, "local", "l", false,
+		"Run the stage handlers in process rather than invoking the functions")
+	cmd.Flags().StringVarP(&rootDir, "root", "r", "",
+		"Replay into the local pipeline rooted at this directory")
+	cmd.Flags().StringVarP(&deadLetterDir, "dir", "d", "",
+		"Read dead letters from this directory rather than the queue")
+	cmd.Flags().BoolVar(&options.DryRun, "dry-run", false,
+		"Log the matching events without replaying them")
+	cmd.Flags().BoolVar(&options.Keep, "keep", false,
+		"Keep replayed events in the source")
+	cmd.Flags().BoolVarP(&force, "force", "f", false,
+		"Reprocess objects whose artifacts are already current")
+	return cmd
+}
+
 /*
 ================================================================================
 ╔═╗╔═╗╔═╗╦  ╦╔═╗╔═╗╔╦╗╦╔═╗╔╗╔
@@ -87,13 +308,12 @@ func workflowHooks(connections *service.Connections,
 
 func main() {
 
-	connections := &service.Connections{
-		S3UploadBucketResourceName:     "S3UploadBucket",
-		S3KeyspaceUploads:              "uploads",
-		S3KeyspaceRekognitionArtifacts: "rekognition-artifacts",
-		S3KeyspacePollyArtifacts:       "polly-artifacts",
-		S3KeyspaceComprehendArtifacts:  "comprehend-artifacts",
-		S3KeyspaceConsolidatedStatus:   "consolidated",
+	// Load the configuration from the optional GEEKWIRE_CONFIG file and
+	// the environment
+	config, configErr := service.LoadConfig("")
+	if configErr != nil {
+		fmt.Fprintln(os.Stderr, configErr.Error())
+		os.Exit(1)
 	}
 
 	// Provision an S3 site
@@ -107,22 +327,29 @@ func main() {
 	// Enable CORS s.t. the S3 site can access the resources
 	apiGateway.CORSOptions = &sparta.CORSOptions{
 		Headers: map[string]interface{}{
-			"Access-Control-Allow-Headers": "Content-Type,X-Amz-Date,Authorization,X-Api-Key",
+			"Access-Control-Allow-Headers": "Content-Type,X-Amz-Date,Authorization,X-Api-Key,Idempotency-Key",
 			"Access-Control-Allow-Methods": "*",
+			// Rate limited clients read the 429's Retry-After
+			"Access-Control-Expose-Headers": "Retry-After",
 			"Access-Control-Allow-Origin": gocf.GetAtt(s3Site.CloudFormationS3ResourceName(),
 				"WebsiteURL"),
 		},
 	}
 
-	// Define the stack
-	lambdaFunctions := service.New(connections, apiGateway)
+	// Define the stack. The AWS clients are created at runtime from the
+	// Lambda execution environment.
+	lambdaFunctions := service.New(config, apiGateway, nil)
 	stackName := spartaCF.UserScopedStackName("SpartaGeekwire")
+
+	// Add the offline commands
+	sparta.CommandLineOptions.Root.AddCommand(localCommand(config))
+	sparta.CommandLineOptions.Root.AddCommand(replayCommand(config, stackName))
 	sparta.MainEx(stackName,
 		fmt.Sprintf("GeekWire service combines S3 with multiple AWS Services"),
 		lambdaFunctions,
 		apiGateway,
 		s3Site,
-		workflowHooks(connections,
+		workflowHooks(config,
 			lambdaFunctions,
 			gocf.GetAtt(s3Site.CloudFormationS3ResourceName(), "WebsiteURL")),
 		false)
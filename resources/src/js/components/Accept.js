@@ -18,6 +18,14 @@ export default class AcceptTarget extends Component {
   // available.
   onDrop(files) {
     console.log(JSON.stringify(files, '' ,' '));
+    // Multiple files are submitted as a batch
+    if (files.length > 1 && this.props.submitBatchHandler) {
+      this.props.submitBatchHandler(files);
+      this.setState({
+        preview_data: files[0].preview
+      });
+      return;
+    }
     var headFile = files.pop();
     if (headFile && this.props.submitFileHandler) {
       this.props.submitFileHandler(headFile);
@@ -40,7 +48,7 @@ export default class AcceptTarget extends Component {
         <Dropzone
           accept="image/jpeg, image/png"
           onDrop={this.onDrop.bind(this)}>
-          <p>Please submit one of the following image types:</p>
+          <p>Please submit one or more of the following image types:</p>
             <ul>
               <li>JPEG</li>
               <li>PNG</li>
@@ -6,17 +6,38 @@ import Heading from 'grommet/components/Heading';
 export default class LabelsCloud extends Component {
 
   render() {
-    if (!this.props.consolidatedResponse ||
-        !this.props.consolidatedResponse.rekognition ||
-        !this.props.consolidatedResponse.rekognition.Labels) {
+    if (!this.props.consolidatedResponse) {
+      return null;
+    }
+    var data = null;
+    if (this.props.consolidatedResponse.batch_id) {
+      // Batch labels are sized by the number of images they're in
+      data = this.props.consolidatedResponse.labels.map(eachObj => {
+        return {
+          count: eachObj.count,
+          value: eachObj.name
+        };
+      });
+    } else if (this.props.consolidatedResponse.labels) {
+      // Normalized labels don't repeat their parents
+      data = this.props.consolidatedResponse.labels.map(eachObj => {
+        return {
+          count: Math.round(eachObj.confidence),
+          value: eachObj.name
+        };
+      });
+    } else if (this.props.consolidatedResponse.rekognition &&
+        this.props.consolidatedResponse.rekognition.Labels) {
+      data = this.props.consolidatedResponse.rekognition.Labels.map(eachObj => {
+        return {
+          count: Math.round(eachObj.Confidence),
+          value: eachObj.Name
+        };
+      });
+    }
+    if (!data) {
       return null;
     }
-    var data = this.props.consolidatedResponse.rekognition.Labels.map(eachObj => {
-      return {
-        count: Math.round(eachObj.Confidence),
-        value: eachObj.Name
-      };
-    });
     var colorOptions = {
       hue: "red",
       luminosity: "dark",
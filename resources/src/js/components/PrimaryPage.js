@@ -21,6 +21,7 @@ export default class PrimaryPage extends Component {
       id_name: null
     };
     this.submitFile = this.submitFile.bind(this);
+    this.submitBatch = this.submitBatch.bind(this);
     this.submitComment = this.submitComment.bind(this);
     this.onPoll = this.onPoll.bind(this);
   }
@@ -45,6 +46,12 @@ export default class PrimaryPage extends Component {
     return baseURL + "/" + subpath;
   }
 
+  // Sends the signed in user's token when the API requires one
+  apiHeaders() {
+    var token = window.localStorage && window.localStorage.getItem("geekwire_token");
+    return token ? {Authorization: "Bearer " + token} : {};
+  }
+
   purgeState() {
     this.setState({
       feedback: null,
@@ -98,9 +105,17 @@ export default class PrimaryPage extends Component {
     if (!s3PresignedURL) {
       return;
     }
-    const reader = new FileReader();
-    reader.onload = () => {
-      axios.get(s3PresignedURL)
+    // Request a POST policy that limits the upload to the accepted
+    // image types and sizes
+    axios.get(s3PresignedURL, {
+      headers: this.apiHeaders(),
+      params: {
+        mode: "post",
+        content_type: selectedFile.type,
+        filename: selectedFile.name,
+        size: selectedFile.size
+      }
+    })
       .then((response) => {
         // Great, get the last element which is the unique ID used
         // for all entities...
@@ -112,21 +127,16 @@ export default class PrimaryPage extends Component {
         // Start polling for the response
         self.onPoll(presignedResponse.results_url);
 
-        return axios.request(
-          {
-            url: presignedResponse.put_object_url,
-            method: "PUT",
-            data: reader.result,
-            headers: { 'content-type': "application/octet-stream" },
-            responseType: 'json'
-          });
+        // The file must be the last form field
+        var formData = new FormData();
+        Object.keys(presignedResponse.post_fields).forEach((eachName) => {
+          formData.append(eachName, presignedResponse.post_fields[eachName]);
+        });
+        formData.append("file", selectedFile);
+        return axios.post(presignedResponse.post_url, formData);
       }).then((response) => {
         console.log('Response', response);
       });
-    };
-    reader.onabort = () => console.log('file reading was aborted');
-    reader.onerror = () => console.log('file reading has failed');
-    reader.readAsArrayBuffer(selectedFile);
     // URL to the preview
     // Load the image
     // https://scotch.io/tutorials/use-the-html5-file-api-to-work-with-files-locally-in-the-browser
@@ -134,6 +144,46 @@ export default class PrimaryPage extends Component {
     this.setState({preview_data: selectedFile.preview});
   }
 
+  submitBatch(selectedFiles) {
+    this.purgeState();
+    var self = this;
+    var batchURL = this.apigatewayURL("batch");
+    if (!batchURL) {
+      return;
+    }
+    var uploads = selectedFiles.map((eachFile) => {
+      return {
+        mode: "post",
+        content_type: eachFile.type,
+        filename: eachFile.name,
+        size: eachFile.size
+      };
+    });
+    axios.post(batchURL, {uploads: uploads}, {headers: this.apiHeaders()})
+      .then((response) => {
+        var batchResponse = response.data;
+
+        self.setState({
+          results_url: batchResponse.results_url
+        });
+        // Poll for the combined report
+        self.onPoll(batchResponse.results_url);
+
+        // The uploads are returned in the order they were requested
+        return Promise.all(batchResponse.uploads.map((eachUpload, index) => {
+          var formData = new FormData();
+          Object.keys(eachUpload.post_fields).forEach((eachName) => {
+            formData.append(eachName, eachUpload.post_fields[eachName]);
+          });
+          formData.append("file", selectedFiles[index]);
+          return axios.post(eachUpload.post_url, formData);
+        }));
+      }).then((responses) => {
+        console.log('Responses', responses);
+      });
+    this.setState({preview_data: selectedFiles[0].preview});
+  }
+
   submitComment(feedbackBody) {
     var self = this;
     this.setState({
@@ -143,7 +193,7 @@ export default class PrimaryPage extends Component {
     if (!commentURL) {
       return;
     }
-    axios.post(commentURL, feedbackBody)
+    axios.post(commentURL, feedbackBody, {headers: this.apiHeaders()})
       .then(function (response) {
         self.setState({
           feedback: response.data
@@ -163,7 +213,8 @@ export default class PrimaryPage extends Component {
         <Box direction="row">
           <Accept
             manifest={this.state.manifest}
-            submitFileHandler={this.submitFile}/>
+            submitFileHandler={this.submitFile}
+            submitBatchHandler={this.submitBatch}/>
           <LabelsCloud
             consolidatedResponse={this.state.consolidated_response} />
           <Results
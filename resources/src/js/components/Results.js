@@ -37,16 +37,99 @@ export default class ResultsView extends Component {
     if (!this.props.consolidatedResponse) {
       return null;
     }
+    var failure = this.props.consolidatedResponse.failure;
+    if (failure) {
+      return (
+        <Card
+          contentPad="large"
+          heading={
+            <Heading strong={false}>
+              Processing Failed
+            </Heading>
+          }
+          label={failure.stage + ": " + failure.error_class}
+          description={failure.message}
+          size="large" />);
+    }
+    var rejection = this.props.consolidatedResponse.rejection;
+    if (rejection) {
+      return (
+        <Card
+          contentPad="large"
+          heading={
+            <Heading strong={false}>
+              Image Rejected
+            </Heading>
+          }
+          description={rejection.reason}
+          size="large" />);
+    }
+    var upload = this.props.consolidatedResponse.upload;
+    var heading = "Results";
+    if (this.props.consolidatedResponse.batch_id) {
+      heading = "Results for " + (this.props.consolidatedResponse.title ||
+        this.props.consolidatedResponse.members.length + " images");
+    } else if (upload && (upload.title || upload.filename)) {
+      heading = "Results for " + (upload.title || upload.filename);
+    }
+    // Thumbnails are made by the service from the normalized image, so
+    // they're upright even when the local preview isn't
+    var thumbnails = [];
+    if (this.props.consolidatedResponse.batch_id) {
+      thumbnails = this.props.consolidatedResponse.members
+        .filter((eachMember) => eachMember.thumbnail_url)
+        .map((eachMember) => eachMember.thumbnail_url);
+    } else if (this.props.consolidatedResponse.annotated_url) {
+      // The annotated image outlines where each label was detected
+      thumbnails = [this.props.consolidatedResponse.annotated_url];
+    } else if (this.props.consolidatedResponse.thumbnail_url) {
+      thumbnails = [this.props.consolidatedResponse.thumbnail_url];
+    }
+    // The optional Rekognition analyses are only in the report when
+    // they're enabled
+    var findings = [];
+    var report = this.props.consolidatedResponse;
+    if (report.text && report.text.TextDetections) {
+      var lines = report.text.TextDetections
+        .filter((eachDetection) => eachDetection.Type === "LINE")
+        .map((eachDetection) => eachDetection.DetectedText);
+      if (lines.length !== 0) {
+        findings.push({label: "Text", value: lines.join(" / ")});
+      }
+    }
+    if (report.celebrities && report.celebrities.CelebrityFaces &&
+        report.celebrities.CelebrityFaces.length !== 0) {
+      findings.push({
+        label: "Celebrities",
+        value: report.celebrities.CelebrityFaces.map((eachFace) => eachFace.Name).join(", ")
+      });
+    }
+    if (report.faces && report.faces.FaceDetails) {
+      findings.push({label: "Faces", value: String(report.faces.FaceDetails.length)});
+    }
+    if (report.moderation && report.moderation.ModerationLabels &&
+        report.moderation.ModerationLabels.length !== 0) {
+      findings.push({
+        label: "Moderation",
+        value: report.moderation.ModerationLabels.map((eachLabel) => eachLabel.Name).join(", ")
+      });
+    }
     return (
       <Card
         contentPad="large"
         heading={
           <Heading strong={false}>
-            Results
+            {heading}
           </Heading>
         }
         size="large">
         <Form compact={false}>
+          {thumbnails.map((eachURL) =>
+            <img key={eachURL} src={eachURL} />)}
+          {findings.map((eachFinding) =>
+            <FormField key={eachFinding.label} label={eachFinding.label}>
+              <span>{eachFinding.value}</span>
+            </FormField>)}
           <FormField label='Polly Audio'>
             <audio
               controls src={"data:audio/mp3;base64," + this.props.consolidatedResponse.polly} />
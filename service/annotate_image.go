@@ -0,0 +1,318 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strings"
+	"unicode/utf8"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	glyphWidth  = 5
+	glyphHeight = 7
+)
+
+// glyphs are the 5x7 bitmaps captions are drawn with. Each byte is a
+// column, with the top row in the least significant bit. Captions are
+// uppercased, so there are no lowercase glyphs.
+var glyphs = map[rune][glyphWidth]byte{
+	' ':  {0x00, 0x00, 0x00, 0x00, 0x00},
+	'!':  {0x00, 0x00, 0x5F, 0x00, 0x00},
+	'%':  {0x23, 0x13, 0x08, 0x64, 0x62},
+	'&':  {0x36, 0x49, 0x55, 0x22, 0x50},
+	'\'': {0x00, 0x05, 0x03, 0x00, 0x00},
+	'(':  {0x00, 0x1C, 0x22, 0x41, 0x00},
+	')':  {0x00, 0x41, 0x22, 0x1C, 0x00},
+	',':  {0x00, 0x50, 0x30, 0x00, 0x00},
+	'-':  {0x08, 0x08, 0x08, 0x08, 0x08},
+	'.':  {0x00, 0x60, 0x60, 0x00, 0x00},
+	'/':  {0x20, 0x10, 0x08, 0x04, 0x02},
+	'0':  {0x3E, 0x51, 0x49, 0x45, 0x3E},
+	'1':  {0x00, 0x42, 0x7F, 0x40, 0x00},
+	'2':  {0x42, 0x61, 0x51, 0x49, 0x46},
+	'3':  {0x21, 0x41, 0x45, 0x4B, 0x31},
+	'4':  {0x18, 0x14, 0x12, 0x7F, 0x10},
+	'5':  {0x27, 0x45, 0x45, 0x45, 0x39},
+	'6':  {0x3C, 0x4A, 0x49, 0x49, 0x30},
+	'7':  {0x01, 0x71, 0x09, 0x05, 0x03},
+	'8':  {0x36, 0x49, 0x49, 0x49, 0x36},
+	'9':  {0x06, 0x49, 0x49, 0x29, 0x1E},
+	':':  {0x00, 0x36, 0x36, 0x00, 0x00},
+	'?':  {0x02, 0x01, 0x51, 0x09, 0x06},
+	'A':  {0x7E, 0x11, 0x11, 0x11, 0x7E},
+	'B':  {0x7F, 0x49, 0x49, 0x49, 0x36},
+	'C':  {0x3E, 0x41, 0x41, 0x41, 0x22},
+	'D':  {0x7F, 0x41, 0x41, 0x22, 0x1C},
+	'E':  {0x7F, 0x49, 0x49, 0x49, 0x41},
+	'F':  {0x7F, 0x09, 0x09, 0x09, 0x01},
+	'G':  {0x3E, 0x41, 0x49, 0x49, 0x7A},
+	'H':  {0x7F, 0x08, 0x08, 0x08, 0x7F},
+	'I':  {0x00, 0x41, 0x7F, 0x41, 0x00},
+	'J':  {0x20, 0x40, 0x41, 0x3F, 0x01},
+	'K':  {0x7F, 0x08, 0x14, 0x22, 0x41},
+	'L':  {0x7F, 0x40, 0x40, 0x40, 0x40},
+	'M':  {0x7F, 0x02, 0x0C, 0x02, 0x7F},
+	'N':  {0x7F, 0x04, 0x08, 0x10, 0x7F},
+	'O':  {0x3E, 0x41, 0x41, 0x41, 0x3E},
+	'P':  {0x7F, 0x09, 0x09, 0x09, 0x06},
+	'Q':  {0x3E, 0x41, 0x51, 0x21, 0x5E},
+	'R':  {0x7F, 0x09, 0x19, 0x29, 0x46},
+	'S':  {0x46, 0x49, 0x49, 0x49, 0x31},
+	'T':  {0x01, 0x01, 0x7F, 0x01, 0x01},
+	'U':  {0x3F, 0x40, 0x40, 0x40, 0x3F},
+	'V':  {0x1F, 0x20, 0x40, 0x20, 0x1F},
+	'W':  {0x3F, 0x40, 0x38, 0x40, 0x3F},
+	'X':  {0x63, 0x14, 0x08, 0x14, 0x63},
+	'Y':  {0x07, 0x08, 0x70, 0x08, 0x07},
+	'Z':  {0x61, 0x51, 0x49, 0x45, 0x43},
+}
+
+// annotationColors are assigned to the labels in turn, so that the
+// instances of a label share a color
+var annotationColors = []color.RGBA{
+	{R: 0xE6, G: 0x19, B: 0x4B, A: 0xFF},
+	{R: 0x3C, G: 0xB4, B: 0x4B, A: 0xFF},
+	{R: 0x43, G: 0x63, B: 0xD8, A: 0xFF},
+	{R: 0xF5, G: 0x82, B: 0x31, A: 0xFF},
+	{R: 0x91, G: 0x1E, B: 0xB4, A: 0xFF},
+	{R: 0x00, G: 0x80, B: 0x80, A: 0xFF},
+}
+
+// annotation is a detected instance's bounding box and caption
+type annotation struct {
+	caption string
+	bounds  image.Rectangle
+	color   color.RGBA
+}
+
+// annotations returns the instances of the detected labels, scaled to
+// the image. Captions use the label's name after renaming.
+func annotations(output *rekognition.DetectLabelsOutput,
+	taxonomy *labelTaxonomy,
+	width int,
+	height int) []*annotation {
+	imageBounds := image.Rect(0, 0, width, height)
+	found := make([]*annotation, 0)
+	located := 0
+	for _, eachLabel := range output.Labels {
+		if len(eachLabel.Instances) == 0 {
+			continue
+		}
+		labelColor := annotationColors[located%len(annotationColors)]
+		located++
+		name := taxonomy.canonicalName(aws.StringValue(eachLabel.Name))
+		for _, eachInstance := range eachLabel.Instances {
+			box := eachInstance.BoundingBox
+			if box == nil {
+				continue
+			}
+			// Bounding boxes are ratios of the image's dimensions
+			left := int(aws.Float64Value(box.Left) * float64(width))
+			top := int(aws.Float64Value(box.Top) * float64(height))
+			bounds := image.Rect(left,
+				top,
+				left+int(aws.Float64Value(box.Width)*float64(width)),
+				top+int(aws.Float64Value(box.Height)*float64(height))).Intersect(imageBounds)
+			if bounds.Empty() {
+				continue
+			}
+			confidence := aws.Float64Value(eachInstance.Confidence)
+			if eachInstance.Confidence == nil {
+				confidence = aws.Float64Value(eachLabel.Confidence)
+			}
+			found = append(found, &annotation{
+				caption: fmt.Sprintf("%s %.0f%%", name, confidence),
+				bounds:  bounds,
+				color:   labelColor,
+			})
+		}
+	}
+	return found
+}
+
+func fillRect(dst *image.RGBA, rect image.Rectangle, fill color.RGBA) {
+	draw.Draw(dst, rect, image.NewUniform(fill), image.Point{}, draw.Src)
+}
+
+// drawOutline draws the rectangle's border inside its bounds
+func drawOutline(dst *image.RGBA, rect image.Rectangle, thickness int, fill color.RGBA) {
+	fillRect(dst, image.Rect(rect.Min.X, rect.Min.Y, rect.Max.X, rect.Min.Y+thickness), fill)
+	fillRect(dst, image.Rect(rect.Min.X, rect.Max.Y-thickness, rect.Max.X, rect.Max.Y), fill)
+	fillRect(dst, image.Rect(rect.Min.X, rect.Min.Y, rect.Min.X+thickness, rect.Max.Y), fill)
+	fillRect(dst, image.Rect(rect.Max.X-thickness, rect.Min.Y, rect.Max.X, rect.Max.Y), fill)
+}
+
+// textWidth returns the width of the text when it's drawn at the scale
+func textWidth(text string, scale int) int {
+	count := utf8.RuneCountInString(text)
+	if count == 0 {
+		return 0
+	}
+	return (count*(glyphWidth+1) - 1) * scale
+}
+
+// drawText draws the text with its top left corner at origin. Each glyph
+// pixel is drawn as a scale x scale square and characters without a glyph
+// are drawn as '?'.
+func drawText(dst *image.RGBA, origin image.Point, text string, scale int, fill color.RGBA) {
+	x := origin.X
+	for _, eachRune := range strings.ToUpper(text) {
+		glyph, exists := glyphs[eachRune]
+		if !exists {
+			glyph = glyphs['?']
+		}
+		for column := 0; column < glyphWidth; column++ {
+			for row := 0; row < glyphHeight; row++ {
+				if glyph[column]&(1<<uint(row)) == 0 {
+					continue
+				}
+				fillRect(dst, image.Rect(x+column*scale,
+					origin.Y+row*scale,
+					x+(column+1)*scale,
+					origin.Y+(row+1)*scale), fill)
+			}
+		}
+		x += (glyphWidth + 1) * scale
+	}
+}
+
+// annotateImage returns a JPEG of the image, downsized to maxDimension,
+// with each detected instance outlined and captioned
+func annotateImage(data []byte,
+	output *rekognition.DetectLabelsOutput,
+	taxonomy *labelTaxonomy,
+	maxDimension int,
+	quality int) ([]byte, int, error) {
+	decoded, _, decodeErr := image.Decode(bytes.NewReader(data))
+	if decodeErr != nil {
+		return nil, 0, errors.Wrapf(decodeErr, "Failed to decode normalized image")
+	}
+	source := flatten(decoded)
+	width, height := fitDimensions(source.Bounds().Dx(), source.Bounds().Dy(), maxDimension)
+	annotated := downsample(source, width, height)
+
+	// Size the outlines and captions to the image so that they're legible
+	// at any resolution
+	longestSide := maxInt(width, height)
+	thickness := maxInt(2, longestSide/300)
+	scale := maxInt(1, longestSide/500)
+	padding := scale
+	found := annotations(output, taxonomy, width, height)
+	for _, eachAnnotation := range found {
+		drawOutline(annotated, eachAnnotation.bounds, thickness, eachAnnotation.color)
+	}
+	// Captions are drawn last so that other outlines don't cover them
+	for _, eachAnnotation := range found {
+		captionWidth := textWidth(eachAnnotation.caption, scale) + 2*padding
+		captionHeight := glyphHeight*scale + 2*padding
+		// Captions sit above the box, or inside it if there's no room
+		top := eachAnnotation.bounds.Min.Y - captionHeight
+		if top < 0 {
+			top = eachAnnotation.bounds.Min.Y
+		}
+		left := eachAnnotation.bounds.Min.X
+		if left+captionWidth > width {
+			left = maxInt(0, width-captionWidth)
+		}
+		fillRect(annotated,
+			image.Rect(left, top, left+captionWidth, top+captionHeight),
+			eachAnnotation.color)
+		drawText(annotated,
+			image.Pt(left+padding, top+padding),
+			eachAnnotation.caption,
+			scale,
+			color.RGBA{R: 0xFF, G: 0xFF, B: 0xFF, A: 0xFF})
+	}
+	imageData, imageDataErr := encodeJPEG(annotated, quality)
+	if imageDataErr != nil {
+		return nil, 0, imageDataErr
+	}
+	return imageData, len(found), nil
+}
+
+func (gws *ServicefulService) annotatedKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceAnnotated, uploadID)
+}
+
+// annotatedURL returns the public URL of the upload's annotated image
+func (gws *ServicefulService) annotatedURL(bucketName string, uploadID string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s",
+		bucketName,
+		gws.annotatedKey(uploadID))
+}
+
+// annotateUpload draws the detected label instances onto a public copy
+// of the normalized image, which Rekognition's bounding boxes refer to.
+// The event is the narration the report is generated from, and an
+// annotated image drawn from the same narration is reused.
+func (gws *ServicefulService) annotateUpload(ctx context.Context,
+	event awsLamdaEvents.S3EventRecord,
+	uploadID string) error {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	bucketName := event.S3.Bucket.Name
+	keyPath := gws.annotatedKey(uploadID)
+	if gws.isFresh(ctx, event, keyPath) {
+		return nil
+	}
+	labelsKey := fmt.Sprintf("%s/%s",
+		gws.rekognitionKeyspace(rekognitionAnalysisLabels),
+		uploadID)
+	labelsData, labelsDataErr := gws.getObject(ctx, bucketName, labelsKey)
+	if labelsDataErr != nil {
+		return labelsDataErr
+	}
+	labels := rekognition.DetectLabelsOutput{}
+	unmarshalErr := json.Unmarshal(labelsData, &labels)
+	if unmarshalErr != nil {
+		return errors.Wrapf(unmarshalErr, "Failed to parse %s", labelsKey)
+	}
+	imageData, imageDataErr := gws.getObject(ctx,
+		bucketName,
+		fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceNormalized, uploadID))
+	if imageDataErr != nil {
+		return imageDataErr
+	}
+	// The annotated image is written even if nothing was located, so
+	// that the report can always refer to it
+	annotatedData, instanceCount, annotatedDataErr := annotateImage(imageData,
+		&labels,
+		newLabelTaxonomy(gws.config.Labels.Synonyms),
+		gws.config.Annotation.MaxDimensionPixels,
+		gws.config.Normalization.JPEGQuality)
+	if annotatedDataErr != nil {
+		return annotatedDataErr
+	}
+	putErr := gws.clients(ctx).Blobs.Put(ctx,
+		bucketName,
+		keyPath,
+		annotatedData,
+		&PutOptions{
+			ContentType: "image/jpeg",
+			Tags: map[string]string{
+				tagNameAccess: tagAccessPublic,
+			},
+			Metadata: sourceMetadata(event),
+		})
+	if putErr != nil {
+		return errors.Wrapf(putErr, "Failed to put annotated image")
+	}
+	logger.WithFields(logrus.Fields{
+		"Key":       keyPath,
+		"Size":      len(annotatedData),
+		"Instances": instanceCount,
+	}).Info("Put Item")
+	return nil
+}
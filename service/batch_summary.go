@@ -0,0 +1,273 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// batchStatusPartial means some, but not all, members failed
+	batchStatusPartial = "partial"
+	// maxNarratedLabels is the number of common labels the batch
+	// narration mentions
+	maxNarratedLabels = 3
+)
+
+// batchMember is the outcome of one upload in a batch
+type batchMember struct {
+	UploadID     string          `json:"upload_id"`
+	Status       string          `json:"status"`
+	Upload       *UploadMetadata `json:"upload,omitempty"`
+	ResultsURL   string          `json:"results_url"`
+	ThumbnailURL string          `json:"thumbnail_url,omitempty"`
+	Labels       []string        `json:"labels,omitempty"`
+	Failure      *stageFailure   `json:"failure,omitempty"`
+}
+
+// batchLabel is a label detected in at least one member
+type batchLabel struct {
+	Name string `json:"name"`
+	// Count is the number of members the label was detected in
+	Count int `json:"count"`
+	// Confidence is the highest confidence across the members
+	Confidence float64 `json:"confidence"`
+}
+
+// batchSummaryInfo is the combined report of a batch
+type batchSummaryInfo struct {
+	BatchID   string         `json:"batch_id"`
+	Title     string         `json:"title,omitempty"`
+	Status    string         `json:"status"`
+	Completed time.Time      `json:"completed"`
+	Members   []*batchMember `json:"members"`
+	Labels    []*batchLabel  `json:"labels"`
+	Narration string         `json:"narration"`
+	Polly     []byte         `json:"polly,omitempty"`
+}
+
+// batchSubject returns the phrase the narration uses for the member
+func batchSubject(index int, metadata *UploadMetadata) string {
+	if metadata != nil && metadata.Title != "" {
+		return metadata.Title
+	}
+	return fmt.Sprintf("Image %d", index+1)
+}
+
+// joinWords returns the words as an English list
+func joinWords(words []string) string {
+	if len(words) < 2 {
+		return strings.Join(words, "")
+	}
+	return strings.Join(words[:len(words)-1], ", ") + " and " + words[len(words)-1]
+}
+
+// newBatchSummary combines the members' consolidated reports, which are
+// in manifest order
+func (gws *ServicefulService) newBatchSummary(bucketName string,
+	manifest *BatchManifest,
+	summaries []*summaryInfo) *batchSummaryInfo {
+	batchSummary := &batchSummaryInfo{
+		BatchID:   manifest.BatchID,
+		Title:     manifest.Title,
+		Completed: time.Now().UTC(),
+		Members:   make([]*batchMember, 0, len(summaries)),
+		Labels:    make([]*batchLabel, 0),
+	}
+	labels := make(map[string]*batchLabel)
+	narration := make([]string, 0)
+	failedCount := 0
+	for i, eachSummary := range summaries {
+		member := &batchMember{
+			UploadID:     manifest.UploadIDs[i],
+			Status:       eachSummary.Status,
+			Upload:       eachSummary.Upload,
+			ResultsURL:   gws.resultsURL(bucketName, manifest.UploadIDs[i]),
+			ThumbnailURL: eachSummary.ThumbnailURL,
+			Failure:      eachSummary.Failure,
+		}
+		if eachSummary.Status != summaryStatusComplete {
+			failedCount++
+		}
+		if eachSummary.Rekognition != nil {
+			for _, eachLabel := range gws.rankLabels(eachSummary.Rekognition) {
+				name := eachLabel.Name
+				confidence := eachLabel.Confidence
+				member.Labels = append(member.Labels, name)
+				label, exists := labels[name]
+				if !exists {
+					label = &batchLabel{Name: name}
+					labels[name] = label
+					batchSummary.Labels = append(batchSummary.Labels, label)
+				}
+				label.Count++
+				if confidence > label.Confidence {
+					label.Confidence = confidence
+				}
+			}
+			// The normalized labels are ranked by descending confidence
+			if len(member.Labels) != 0 {
+				narration = append(narration, fmt.Sprintf("%s includes %s.",
+					batchSubject(i, eachSummary.Upload),
+					member.Labels[0]))
+			}
+		}
+		batchSummary.Members = append(batchSummary.Members, member)
+	}
+	sort.SliceStable(batchSummary.Labels, func(i, j int) bool {
+		if batchSummary.Labels[i].Count != batchSummary.Labels[j].Count {
+			return batchSummary.Labels[i].Count > batchSummary.Labels[j].Count
+		}
+		return batchSummary.Labels[i].Confidence > batchSummary.Labels[j].Confidence
+	})
+
+	switch failedCount {
+	case 0:
+		batchSummary.Status = summaryStatusComplete
+	case len(summaries):
+		batchSummary.Status = summaryStatusFailed
+	default:
+		batchSummary.Status = batchStatusPartial
+	}
+
+	intro := fmt.Sprintf("I looked at %d images.", len(summaries))
+	if failedCount != 0 {
+		intro = fmt.Sprintf("%s %d of them couldn't be processed.", intro, failedCount)
+	}
+	narration = append([]string{intro}, narration...)
+	commonLabels := make([]string, 0, maxNarratedLabels)
+	for _, eachLabel := range batchSummary.Labels {
+		if eachLabel.Count < 2 || len(commonLabels) == maxNarratedLabels {
+			break
+		}
+		commonLabels = append(commonLabels, eachLabel.Name)
+	}
+	if len(commonLabels) != 0 {
+		narration = append(narration, fmt.Sprintf("Across the batch, the most common labels were %s.",
+			joinWords(commonLabels)))
+	}
+	batchSummary.Narration = strings.Join(narration, " ")
+	return batchSummary
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Listen for consolidated reports and, once every member of the upload's
+batch has one, write the batch's combined report
+*/
+func (gws *ServicefulService) onConsolidatedAggregateBatch(ctx context.Context, s3Event awsLamdaEvents.S3Event) error {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	clients := gws.clients(ctx)
+
+	handler := func(ctx context.Context, event awsLamdaEvents.S3EventRecord) (interface{}, error) {
+		bucketName := event.S3.Bucket.Name
+		uploadID := gws.baseKeyname(event.S3.Object.Key)
+		uploadMetadata, uploadMetadataErr := gws.getUploadMetadata(ctx, bucketName, uploadID)
+		if uploadMetadataErr != nil {
+			return nil, uploadMetadataErr
+		}
+		if uploadMetadata == nil || uploadMetadata.BatchID == "" {
+			return nil, nil
+		}
+		manifest, manifestErr := gws.getBatchManifest(ctx, bucketName, uploadMetadata.BatchID)
+		if manifestErr != nil {
+			return nil, manifestErr
+		}
+		summaries := make([]*summaryInfo, 0, len(manifest.UploadIDs))
+		for _, eachUploadID := range manifest.UploadIDs {
+			summaryData, summaryDataErr := gws.getObject(ctx,
+				bucketName,
+				fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceConsolidatedStatus, eachUploadID))
+			if IsBlobNotFound(summaryDataErr) {
+				// The last member to finish writes the report
+				logger.WithFields(logrus.Fields{
+					"BatchID":  manifest.BatchID,
+					"UploadID": eachUploadID,
+				}).Info("Waiting for batch member")
+				return nil, nil
+			} else if summaryDataErr != nil {
+				return nil, summaryDataErr
+			}
+			summary := &summaryInfo{}
+			unmarshalErr := json.Unmarshal(summaryData, summary)
+			if unmarshalErr != nil {
+				return nil, errors.Wrapf(unmarshalErr, "Failed to parse consolidated report: %s", eachUploadID)
+			}
+			summaries = append(summaries, summary)
+		}
+		batchSummary := gws.newBatchSummary(bucketName, manifest, summaries)
+		audioData, audioDataErr := synthesizeSpeech(ctx,
+			clients.Polly,
+			pollyVoiceID(clients),
+			batchSummary.Narration,
+			"text")
+		if audioDataErr != nil {
+			return nil, audioDataErr
+		}
+		batchSummary.Polly = audioData
+
+		outputKey := fmt.Sprintf("%s/%s",
+			gws.connections.S3KeyspaceBatchConsolidated,
+			manifest.BatchID)
+		putOptions := &PutOptions{
+			Tags: map[string]string{
+				tagNameAccess: tagAccessPublic,
+			},
+		}
+		putErr := gws.putJSONObject(ctx, bucketName, outputKey, batchSummary, putOptions)
+		if putErr != nil {
+			return nil, putErr
+		}
+		logger.WithFields(logrus.Fields{
+			"BatchID": manifest.BatchID,
+			"Status":  batchSummary.Status,
+		}).Info("Batch report written")
+		return nil, nil
+	}
+	handleResult, handleErr := gws.handleS3Records(ctx, s3Event, handler)
+	logger.WithField("Results", handleResult).Info("S3 event results")
+	return handleErr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Create
+func (gws *ServicefulService) newOnConsolidatedAggregateBatch(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("BatchAggregator",
+		gws.onConsolidatedAggregateBatch,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.Options = &sparta.LambdaFunctionOptions{
+		Description: "Combine the consolidated reports of a batch",
+		MemorySize:  256,
+		Timeout:     30,
+		TracingConfig: &gocf.LambdaFunctionTracingConfig{
+			Mode: gocf.String("Active"),
+		},
+	}
+	// IAM Role privileges
+	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges("polly:SynthesizeSpeech")
+
+	// Dependency
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+
+	// Event Triggers
+	gws.subscribeS3Prefix(lambdaFn,
+		"BatchAggregator",
+		gws.connections.S3KeyspaceConsolidatedStatus,
+		gws.onConsolidatedAggregateBatch,
+		gws.connections.S3KeyspaceBatchConsolidated)
+
+	return lambdaFn
+}
@@ -0,0 +1,249 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	sparta "github.com/mweagle/Sparta"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
+	spartaEvents "github.com/mweagle/Sparta/aws/events"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// BatchUpload describes one member of a batch. The fields are the same
+// as the /presigned query parameters.
+type BatchUpload struct {
+	Mode        string `json:"mode,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Filename    string `json:"filename,omitempty"`
+	Size        int64  `json:"size,omitempty"`
+	Title       string `json:"title,omitempty"`
+	SHA256      string `json:"sha256,omitempty"`
+	MD5         string `json:"md5,omitempty"`
+	ExpiresIn   int    `json:"expires_in,omitempty"`
+}
+
+// params returns the member as /presigned query parameters
+func (upload *BatchUpload) params() map[string]string {
+	params := map[string]string{
+		"mode":         upload.Mode,
+		"content_type": upload.ContentType,
+		"filename":     upload.Filename,
+		"title":        upload.Title,
+		"sha256":       upload.SHA256,
+		"md5":          upload.MD5,
+	}
+	if upload.Size != 0 {
+		params["size"] = strconv.FormatInt(upload.Size, 10)
+	}
+	if upload.ExpiresIn != 0 {
+		params["expires_in"] = strconv.Itoa(upload.ExpiresIn)
+	}
+	return params
+}
+
+// BatchBody is the typed body of a batch request
+type BatchBody struct {
+	Title   string        `json:"title,omitempty"`
+	Uploads []BatchUpload `json:"uploads"`
+}
+
+// BatchRequest is the typed input to batchUploadLambda
+type BatchRequest struct {
+	spartaEvents.APIGatewayEnvelope
+	Body BatchBody `json:"body"`
+}
+
+// BatchManifest lists the uploads that belong to a batch
+type BatchManifest struct {
+	BatchID   string    `json:"batch_id"`
+	Title     string    `json:"title,omitempty"`
+	UploadIDs []string  `json:"upload_ids"`
+	Created   time.Time `json:"created"`
+	// Subject is the authenticated user that requested the batch
+	Subject string `json:"subject,omitempty"`
+}
+
+type batchResponse struct {
+	BatchID string `json:"batch_id"`
+	// ResultsURL is the combined report, which is written once every
+	// member has been processed
+	ResultsURL string               `json:"results_url"`
+	Uploads    []*presignedResponse `json:"uploads"`
+}
+
+func (gws *ServicefulService) batchManifestKey(batchID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceBatches, batchID)
+}
+
+// batchResultsURL returns the public URL of the batch's combined report
+func (gws *ServicefulService) batchResultsURL(bucketName string, batchID string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s/%s",
+		bucketName,
+		gws.connections.S3KeyspaceBatchConsolidated,
+		batchID)
+}
+
+// getBatchManifest returns the manifest of the batch
+func (gws *ServicefulService) getBatchManifest(ctx context.Context,
+	bucket string,
+	batchID string) (*BatchManifest, error) {
+	manifestData, manifestDataErr := gws.getObject(ctx, bucket, gws.batchManifestKey(batchID))
+	if manifestDataErr != nil {
+		return nil, manifestDataErr
+	}
+	manifest := &BatchManifest{}
+	unmarshalErr := json.Unmarshal(manifestData, manifest)
+	if unmarshalErr != nil {
+		return nil, errors.Wrapf(unmarshalErr, "Failed to parse batch manifest")
+	}
+	return manifest, nil
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Create presigned uploads for a batch of images. Each member accepts the
+same options as /presigned. The combined report is written to the batch's
+results_url once every member has a consolidated report. Each member
+counts against the client's /presigned quota.
+*/
+func (gws *ServicefulService) batchUploadLambda(ctx context.Context,
+	apigRequest BatchRequest) (interface{}, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	uploads := apigRequest.Body.Uploads
+	if len(uploads) == 0 || len(uploads) > gws.config.Uploads.MaxBatchSize {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("uploads must include 1-%d uploads", gws.config.Uploads.MaxBatchSize))
+	}
+	if utf8.RuneCountInString(apigRequest.Body.Title) > maxUploadTitleLength {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("title must be at most %d characters", maxUploadTitleLength))
+	}
+	exceeded := gws.checkRateLimit(ctx,
+		"presigned",
+		gws.config.RateLimits.PresignedPerMinute,
+		gws.config.RateLimits.PresignedPerDay,
+		&apigRequest.Context,
+		len(uploads))
+	if exceeded != nil {
+		return rateLimitedResponse(exceeded), nil
+	}
+	subject, subjectErr := gws.requestSubject(ctx, apigRequest.Headers)
+	if subjectErr != nil {
+		return nil, subjectErr
+	}
+	batchID, batchIDErr := gws.uploadIDs.NewID()
+	if batchIDErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			batchIDErr)
+	}
+	// Validate every member before anything is presigned
+	manifest := &BatchManifest{
+		BatchID:   batchID,
+		Title:     apigRequest.Body.Title,
+		UploadIDs: make([]string, 0, len(uploads)),
+		Created:   time.Now().UTC(),
+		Subject:   subject,
+	}
+	requests := make([]*uploadRequest, 0, len(uploads))
+	for i, eachUpload := range uploads {
+		uploadID, uploadIDErr := gws.uploadIDs.NewID()
+		if uploadIDErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+				uploadIDErr)
+		}
+		request, requestErr := gws.newUploadRequest(uploadID, eachUpload.params())
+		if requestErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("uploads[%d]: %s", i, requestErr))
+		}
+		if request.metadata == nil {
+			request.metadata = &UploadMetadata{
+				UploadID: uploadID,
+				Created:  manifest.Created,
+			}
+		}
+		request.metadata.BatchID = batchID
+		request.attribute(subject)
+		requests = append(requests, request)
+		manifest.UploadIDs = append(manifest.UploadIDs, uploadID)
+	}
+
+	bucketName, bucketNameErr := gws.bucketName()
+	if bucketNameErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			bucketNameErr)
+	}
+	// The manifest must exist before any member can complete
+	putErr := gws.putJSONObject(ctx,
+		bucketName,
+		gws.batchManifestKey(batchID),
+		manifest,
+		&PutOptions{Metadata: subjectMetadata(subject)})
+	if putErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			putErr)
+	}
+	response := &batchResponse{
+		BatchID:    batchID,
+		ResultsURL: gws.batchResultsURL(bucketName, batchID),
+		Uploads:    make([]*presignedResponse, 0, len(requests)),
+	}
+	for _, eachRequest := range requests {
+		uploadResponse, uploadResponseErr := gws.presignUpload(ctx, bucketName, eachRequest)
+		if uploadResponseErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+				uploadResponseErr)
+		}
+		response.Uploads = append(response.Uploads, uploadResponse)
+	}
+	logger.WithFields(logrus.Fields{
+		"BatchID": batchID,
+		"Subject": subject,
+		"Uploads": len(response.Uploads),
+	}).Info("Batch created")
+	return response, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newBatchUploadLambda defines a Lambda function that returns presigned
+// uploads for a batch of images
+func (gws *ServicefulService) newBatchUploadLambda(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("BatchUploadProvider",
+		gws.batchUploadLambda,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.RoleDefinition.Privileges = append(gws.bucketGetPutPrivileges(),
+		gws.rateLimitPrivilege())
+	lambdaFn.Options.TracingConfig = &gocf.LambdaFunctionTracingConfig{
+		Mode: gocf.String("Active"),
+	}
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName,
+		gws.connections.RateLimitTableResourceName}
+	if api != nil {
+		apiGatewayResource, _ := api.NewResource("/batch", lambdaFn)
+		apiMethod, apiMethodErr := gws.newAPIMethod(apiGatewayResource,
+			"POST",
+			http.StatusOK,
+			http.StatusBadRequest,
+			http.StatusTooManyRequests,
+			http.StatusInternalServerError)
+		if nil != apiMethodErr {
+			panic("Failed to create /batch resource: " + apiMethodErr.Error())
+		}
+		apiMethod.SupportedRequestContentTypes = []string{"application/json"}
+	}
+	return lambdaFn
+}
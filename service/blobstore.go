@@ -0,0 +1,71 @@
+package service
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrBlobNotFound is returned by BlobStore implementations when the
+// requested key doesn't exist
+var ErrBlobNotFound = errors.New("Blob not found")
+
+// IsBlobNotFound returns true if the (possibly wrapped) error indicates
+// a missing key
+func IsBlobNotFound(err error) bool {
+	return err != nil && errors.Cause(err) == ErrBlobNotFound
+}
+
+// PutOptions are the optional attributes of a stored blob
+type PutOptions struct {
+	ContentType string
+	Tags        map[string]string
+	// Metadata is user defined metadata. Keys are case insensitive and are
+	// returned in lower case.
+	Metadata map[string]string
+}
+
+// BlobInfo describes a stored blob
+type BlobInfo struct {
+	Key          string
+	Size         int64
+	ETag         string
+	ContentType  string
+	LastModified time.Time
+	// Metadata is populated by Head. List may omit it.
+	Metadata map[string]string
+}
+
+// BlobStore is the object storage the pipeline stages read from and
+// write to. Implementations are provided for S3 (and S3 compatible
+// stores), the local filesystem and memory.
+type BlobStore interface {
+	// Get returns the contents of the blob
+	Get(ctx context.Context, bucket string, key string) ([]byte, error)
+	// Open returns a reader for the contents of the blob, which the
+	// caller must close
+	Open(ctx context.Context, bucket string, key string) (io.ReadCloser, error)
+	// Put stores the blob, replacing any existing value
+	Put(ctx context.Context,
+		bucket string,
+		key string,
+		data []byte,
+		options *PutOptions) error
+	// Head returns the blob's attributes without its contents
+	Head(ctx context.Context, bucket string, key string) (*BlobInfo, error)
+	// List returns the blobs whose key starts with prefix, sorted by key
+	List(ctx context.Context, bucket string, prefix string) ([]*BlobInfo, error)
+	// Delete removes the blob. Deleting a missing blob is not an error.
+	Delete(ctx context.Context, bucket string, key string) error
+	// Copy duplicates the blob, including its attributes
+	Copy(ctx context.Context, bucket string, srcKey string, dstKey string) error
+}
+
+// Compile time checks that the implementations satisfy BlobStore
+var (
+	_ BlobStore = (*s3BlobStore)(nil)
+	_ BlobStore = (*FileSystemBlobStore)(nil)
+	_ BlobStore = (*MemoryBlobStore)(nil)
+)
@@ -0,0 +1,380 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// fsTempPrefix is the filename prefix for in-flight writes
+	fsTempPrefix = ".tmp-"
+	// fsAttributesSuffix is the filename suffix of the hidden file that
+	// stores a blob's content type, tags and ETag
+	fsAttributesSuffix = ".attrs.json"
+)
+
+// fsAttributes is the content of a blob's attributes file. The ETag is
+// only valid while the blob's size and modification time match, so files
+// that are changed outside the store are hashed again.
+type fsAttributes struct {
+	ContentType string            `json:"contentType,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+	Size        int64             `json:"size,omitempty"`
+	ModTime     time.Time         `json:"modTime,omitempty"`
+}
+
+func (attrs *fsAttributes) etag(fileInfo os.FileInfo) string {
+	if attrs.Size != fileInfo.Size() || !attrs.ModTime.Equal(fileInfo.ModTime()) {
+		return ""
+	}
+	return attrs.ETag
+}
+
+// FileSystemBlobStore is a BlobStore rooted at a local directory. Keys
+// are paths relative to the root and the bucket name is ignored, so the
+// root directory behaves like a single bucket. Blob attributes are kept
+// in hidden sibling files, which List excludes along with hidden
+// directories.
+type FileSystemBlobStore struct {
+	rootDir string
+}
+
+// NewFileSystemBlobStore returns a FileSystemBlobStore rooted at rootDir
+func NewFileSystemBlobStore(rootDir string) *FileSystemBlobStore {
+	return &FileSystemBlobStore{
+		rootDir: rootDir,
+	}
+}
+
+// Path returns the filesystem path for the key. Keys that resolve to a
+// path outside the root directory are rejected.
+func (store *FileSystemBlobStore) Path(key string) (string, error) {
+	blobPath := filepath.Join(store.rootDir, filepath.FromSlash(key))
+	relPath, relPathErr := filepath.Rel(store.rootDir, blobPath)
+	if relPathErr != nil ||
+		relPath == ".." ||
+		strings.HasPrefix(relPath, ".."+string(filepath.Separator)) {
+		return "", errors.Errorf("Invalid key: %s", key)
+	}
+	return blobPath, nil
+}
+
+func (store *FileSystemBlobStore) attributesPath(blobPath string) string {
+	return filepath.Join(filepath.Dir(blobPath),
+		"."+filepath.Base(blobPath)+fsAttributesSuffix)
+}
+
+func (store *FileSystemBlobStore) readAttributes(blobPath string) (*fsAttributes, error) {
+	attrs := &fsAttributes{}
+	attrData, attrDataErr := ioutil.ReadFile(store.attributesPath(blobPath))
+	if attrDataErr != nil {
+		return attrs, attrDataErr
+	}
+	return attrs, json.Unmarshal(attrData, attrs)
+}
+
+// createTemp creates an in-flight file in the directory of outputPath
+func (store *FileSystemBlobStore) createTemp(outputPath string) (*os.File, error) {
+	mkdirErr := os.MkdirAll(filepath.Dir(outputPath), os.ModePerm)
+	if mkdirErr != nil {
+		return nil, mkdirErr
+	}
+	return ioutil.TempFile(filepath.Dir(outputPath), fsTempPrefix)
+}
+
+// writeFile atomically replaces the file at outputPath
+func (store *FileSystemBlobStore) writeFile(outputPath string, data []byte) error {
+	tempFile, tempFileErr := store.createTemp(outputPath)
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	_, writeErr := tempFile.Write(data)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tempFile.Name(), outputPath)
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+	}
+	return writeErr
+}
+
+// writeBlob atomically replaces the blob at blobPath and its attributes.
+// The attributes are written first, so that readers never see the new
+// blob with the old attributes, and record the blob's ETag.
+func (store *FileSystemBlobStore) writeBlob(blobPath string,
+	reader io.Reader,
+	attrs *fsAttributes) error {
+	tempFile, tempFileErr := store.createTemp(blobPath)
+	if tempFileErr != nil {
+		return tempFileErr
+	}
+	digest := md5.New()
+	_, writeErr := io.Copy(io.MultiWriter(tempFile, digest), reader)
+	closeErr := tempFile.Close()
+	if writeErr == nil {
+		writeErr = closeErr
+	}
+	if writeErr == nil {
+		// Renaming the file preserves its modification time
+		fileInfo, fileInfoErr := os.Stat(tempFile.Name())
+		writeErr = fileInfoErr
+		if fileInfoErr == nil {
+			attrs.ETag = hex.EncodeToString(digest.Sum(nil))
+			attrs.Size = fileInfo.Size()
+			attrs.ModTime = fileInfo.ModTime()
+		}
+	}
+	if writeErr == nil {
+		attrData, attrDataErr := json.Marshal(attrs)
+		writeErr = attrDataErr
+		if attrDataErr == nil {
+			writeErr = store.writeFile(store.attributesPath(blobPath), attrData)
+		}
+	}
+	if writeErr == nil {
+		writeErr = os.Rename(tempFile.Name(), blobPath)
+	}
+	if writeErr != nil {
+		os.Remove(tempFile.Name())
+	}
+	return writeErr
+}
+
+// hash returns the ETag of a blob whose attributes file doesn't record
+// it, which is the case for files copied into the root directory. The
+// ETag is then recorded so that it's only computed once.
+func (store *FileSystemBlobStore) hash(blobPath string,
+	fileInfo os.FileInfo,
+	attrs *fsAttributes) (string, error) {
+	blobFile, blobFileErr := os.Open(blobPath)
+	if blobFileErr != nil {
+		return "", blobFileErr
+	}
+	defer blobFile.Close()
+	digest := md5.New()
+	_, copyErr := io.Copy(digest, blobFile)
+	if copyErr != nil {
+		return "", copyErr
+	}
+	attrs.ETag = hex.EncodeToString(digest.Sum(nil))
+	attrs.Size = fileInfo.Size()
+	attrs.ModTime = fileInfo.ModTime()
+	attrData, attrDataErr := json.Marshal(attrs)
+	if attrDataErr == nil {
+		// Best effort, since the next call computes it again
+		store.writeFile(store.attributesPath(blobPath), attrData)
+	}
+	return attrs.ETag, nil
+}
+
+func (store *FileSystemBlobStore) info(key string,
+	blobPath string,
+	fileInfo os.FileInfo) (*BlobInfo, error) {
+	// A missing or unreadable attributes file is treated as empty
+	attrs, _ := store.readAttributes(blobPath)
+	etag := attrs.etag(fileInfo)
+	if etag == "" {
+		hashEtag, hashErr := store.hash(blobPath, fileInfo, attrs)
+		if hashErr != nil {
+			return nil, hashErr
+		}
+		etag = hashEtag
+	}
+	return &BlobInfo{
+		Key:          key,
+		Size:         fileInfo.Size(),
+		ETag:         etag,
+		ContentType:  attrs.ContentType,
+		LastModified: fileInfo.ModTime(),
+		Metadata:     attrs.Metadata,
+	}, nil
+}
+
+// Get satisfies BlobStore
+func (store *FileSystemBlobStore) Get(ctx context.Context,
+	bucket string,
+	key string) ([]byte, error) {
+	blobPath, blobPathErr := store.Path(key)
+	if blobPathErr != nil {
+		return nil, blobPathErr
+	}
+	data, dataErr := ioutil.ReadFile(blobPath)
+	if os.IsNotExist(dataErr) {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s", key)
+	}
+	return data, dataErr
+}
+
+// Open satisfies BlobStore
+func (store *FileSystemBlobStore) Open(ctx context.Context,
+	bucket string,
+	key string) (io.ReadCloser, error) {
+	blobPath, blobPathErr := store.Path(key)
+	if blobPathErr != nil {
+		return nil, blobPathErr
+	}
+	blobFile, blobFileErr := os.Open(blobPath)
+	if os.IsNotExist(blobFileErr) {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s", key)
+	} else if blobFileErr != nil {
+		return nil, blobFileErr
+	}
+	return blobFile, nil
+}
+
+// Put satisfies BlobStore. Like S3, a nil options value clears the
+// existing attributes.
+func (store *FileSystemBlobStore) Put(ctx context.Context,
+	bucket string,
+	key string,
+	data []byte,
+	options *PutOptions) error {
+	blobPath, blobPathErr := store.Path(key)
+	if blobPathErr != nil {
+		return blobPathErr
+	}
+	attrs := &fsAttributes{}
+	if options != nil {
+		attrs.ContentType = options.ContentType
+		attrs.Tags = options.Tags
+		attrs.Metadata = make(map[string]string)
+		for eachKey, eachValue := range options.Metadata {
+			attrs.Metadata[strings.ToLower(eachKey)] = eachValue
+		}
+	}
+	writeErr := store.writeBlob(blobPath, bytes.NewReader(data), attrs)
+	if writeErr != nil {
+		return errors.Wrapf(writeErr, "Failed to write blob: %s", key)
+	}
+	return nil
+}
+
+// Head satisfies BlobStore
+func (store *FileSystemBlobStore) Head(ctx context.Context,
+	bucket string,
+	key string) (*BlobInfo, error) {
+	blobPath, blobPathErr := store.Path(key)
+	if blobPathErr != nil {
+		return nil, blobPathErr
+	}
+	fileInfo, fileInfoErr := os.Stat(blobPath)
+	if os.IsNotExist(fileInfoErr) {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s", key)
+	} else if fileInfoErr != nil {
+		return nil, fileInfoErr
+	}
+	return store.info(key, blobPath, fileInfo)
+}
+
+// List satisfies BlobStore
+func (store *FileSystemBlobStore) List(ctx context.Context,
+	bucket string,
+	prefix string) ([]*BlobInfo, error) {
+	blobs := make([]*BlobInfo, 0)
+	walkErr := filepath.Walk(store.rootDir, func(path string,
+		fileInfo os.FileInfo,
+		err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		hidden := strings.HasPrefix(fileInfo.Name(), ".")
+		if fileInfo.IsDir() {
+			if hidden && path != store.rootDir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if hidden {
+			return nil
+		}
+		relPath, relPathErr := filepath.Rel(store.rootDir, path)
+		if relPathErr != nil {
+			return relPathErr
+		}
+		key := filepath.ToSlash(relPath)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		blobInfo, blobInfoErr := store.info(key, path, fileInfo)
+		if blobInfoErr != nil {
+			return blobInfoErr
+		}
+		blobs = append(blobs, blobInfo)
+		return nil
+	})
+	if walkErr != nil {
+		return nil, errors.Wrapf(walkErr, "Failed to list blobs: %s", prefix)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+	return blobs, nil
+}
+
+// Delete satisfies BlobStore
+func (store *FileSystemBlobStore) Delete(ctx context.Context,
+	bucket string,
+	key string) error {
+	blobPath, blobPathErr := store.Path(key)
+	if blobPathErr != nil {
+		return blobPathErr
+	}
+	os.Remove(store.attributesPath(blobPath))
+	removeErr := os.Remove(blobPath)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return errors.Wrapf(removeErr, "Failed to delete blob: %s", key)
+	}
+	return nil
+}
+
+// Copy satisfies BlobStore. The blob is streamed rather than read into
+// memory.
+func (store *FileSystemBlobStore) Copy(ctx context.Context,
+	bucket string,
+	srcKey string,
+	dstKey string) error {
+	srcPath, srcPathErr := store.Path(srcKey)
+	if srcPathErr != nil {
+		return srcPathErr
+	}
+	dstPath, dstPathErr := store.Path(dstKey)
+	if dstPathErr != nil {
+		return dstPathErr
+	}
+	srcFile, srcFileErr := os.Open(srcPath)
+	if os.IsNotExist(srcFileErr) {
+		return errors.Wrapf(ErrBlobNotFound, "%s", srcKey)
+	} else if srcFileErr != nil {
+		return srcFileErr
+	}
+	defer srcFile.Close()
+	attrs, attrsErr := store.readAttributes(srcPath)
+	if attrsErr != nil && !os.IsNotExist(attrsErr) {
+		return errors.Wrapf(attrsErr, "Failed to read attributes: %s", srcKey)
+	}
+	writeErr := store.writeBlob(dstPath, srcFile, attrs)
+	if writeErr != nil {
+		return errors.Wrapf(writeErr, "Failed to write blob: %s", dstKey)
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type memoryBlob struct {
+	data         []byte
+	contentType  string
+	tags         map[string]string
+	metadata     map[string]string
+	lastModified time.Time
+}
+
+func (blob *memoryBlob) info(key string) *BlobInfo {
+	digest := md5.Sum(blob.data)
+	return &BlobInfo{
+		Key:          key,
+		Size:         int64(len(blob.data)),
+		ETag:         hex.EncodeToString(digest[:]),
+		ContentType:  blob.contentType,
+		LastModified: blob.lastModified,
+	}
+}
+
+// MemoryBlobStore is a BlobStore that keeps everything in memory
+type MemoryBlobStore struct {
+	mu    sync.Mutex
+	blobs map[string]map[string]*memoryBlob
+}
+
+// NewMemoryBlobStore returns an empty MemoryBlobStore
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{
+		blobs: make(map[string]map[string]*memoryBlob),
+	}
+}
+
+// Tags returns the tags assigned to the blob
+func (store *MemoryBlobStore) Tags(bucket string, key string) map[string]string {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blob, exists := store.blobs[bucket][key]
+	if !exists {
+		return nil
+	}
+	return blob.tags
+}
+
+// Get satisfies BlobStore
+func (store *MemoryBlobStore) Get(ctx context.Context,
+	bucket string,
+	key string) ([]byte, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blob, exists := store.blobs[bucket][key]
+	if !exists {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s", key)
+	}
+	data := make([]byte, len(blob.data))
+	copy(data, blob.data)
+	return data, nil
+}
+
+// Open satisfies BlobStore
+func (store *MemoryBlobStore) Open(ctx context.Context,
+	bucket string,
+	key string) (io.ReadCloser, error) {
+	data, dataErr := store.Get(ctx, bucket, key)
+	if dataErr != nil {
+		return nil, dataErr
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// Put satisfies BlobStore
+func (store *MemoryBlobStore) Put(ctx context.Context,
+	bucket string,
+	key string,
+	data []byte,
+	options *PutOptions) error {
+	blob := &memoryBlob{
+		data:         make([]byte, len(data)),
+		tags:         make(map[string]string),
+		metadata:     make(map[string]string),
+		lastModified: time.Now(),
+	}
+	copy(blob.data, data)
+	if options != nil {
+		blob.contentType = options.ContentType
+		for eachKey, eachValue := range options.Tags {
+			blob.tags[eachKey] = eachValue
+		}
+		for eachKey, eachValue := range options.Metadata {
+			blob.metadata[strings.ToLower(eachKey)] = eachValue
+		}
+	}
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	if store.blobs[bucket] == nil {
+		store.blobs[bucket] = make(map[string]*memoryBlob)
+	}
+	store.blobs[bucket][key] = blob
+	return nil
+}
+
+// Head satisfies BlobStore
+func (store *MemoryBlobStore) Head(ctx context.Context,
+	bucket string,
+	key string) (*BlobInfo, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blob, exists := store.blobs[bucket][key]
+	if !exists {
+		return nil, errors.Wrapf(ErrBlobNotFound, "%s", key)
+	}
+	blobInfo := blob.info(key)
+	blobInfo.Metadata = make(map[string]string)
+	for eachKey, eachValue := range blob.metadata {
+		blobInfo.Metadata[eachKey] = eachValue
+	}
+	return blobInfo, nil
+}
+
+// List satisfies BlobStore
+func (store *MemoryBlobStore) List(ctx context.Context,
+	bucket string,
+	prefix string) ([]*BlobInfo, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blobs := make([]*BlobInfo, 0)
+	for eachKey, eachBlob := range store.blobs[bucket] {
+		if strings.HasPrefix(eachKey, prefix) {
+			blobs = append(blobs, eachBlob.info(eachKey))
+		}
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+	return blobs, nil
+}
+
+// Delete satisfies BlobStore
+func (store *MemoryBlobStore) Delete(ctx context.Context,
+	bucket string,
+	key string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	delete(store.blobs[bucket], key)
+	return nil
+}
+
+// Copy satisfies BlobStore
+func (store *MemoryBlobStore) Copy(ctx context.Context,
+	bucket string,
+	srcKey string,
+	dstKey string) error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	blob, exists := store.blobs[bucket][srcKey]
+	if !exists {
+		return errors.Wrapf(ErrBlobNotFound, "%s", srcKey)
+	}
+	// Blobs are replaced rather than modified, so the copy can share the
+	// data
+	blobCopy := *blob
+	blobCopy.lastModified = time.Now()
+	store.blobs[bucket][dstKey] = &blobCopy
+	return nil
+}
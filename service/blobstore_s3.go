@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// s3BlobStore is the BlobStore backed by S3. It works with any
+// S3 compatible endpoint (eg: MinIO) the S3API client is configured for.
+type s3BlobStore struct {
+	s3Svc S3API
+}
+
+// NewS3BlobStore returns a BlobStore that uses the given S3 client
+func NewS3BlobStore(s3Svc S3API) BlobStore {
+	return &s3BlobStore{
+		s3Svc: s3Svc,
+	}
+}
+
+// s3NotFound translates the S3 missing key errors into ErrBlobNotFound
+func s3NotFound(err error, keyPath string) error {
+	awsErr, isAWSErr := err.(awserr.Error)
+	if isAWSErr {
+		switch awsErr.Code() {
+		case s3.ErrCodeNoSuchKey, "NotFound":
+			return errors.Wrapf(ErrBlobNotFound, "%s", keyPath)
+		}
+	}
+	return err
+}
+
+func (store *s3BlobStore) Get(ctx context.Context,
+	bucket string,
+	key string) ([]byte, error) {
+	getObjectInput := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	getResult, getResultErr := store.s3Svc.GetObjectWithContext(ctx, getObjectInput)
+	if getResultErr != nil {
+		return nil, errors.Wrapf(s3NotFound(getResultErr, key), "Failed to get object")
+	}
+	defer getResult.Body.Close()
+	allData, allDataErr := ioutil.ReadAll(getResult.Body)
+	if allDataErr != nil {
+		return nil, errors.Wrapf(allDataErr, "Failed to read all data")
+	}
+	return allData, nil
+}
+
+func (store *s3BlobStore) Open(ctx context.Context,
+	bucket string,
+	key string) (io.ReadCloser, error) {
+	getObjectInput := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	getResult, getResultErr := store.s3Svc.GetObjectWithContext(ctx, getObjectInput)
+	if getResultErr != nil {
+		return nil, errors.Wrapf(s3NotFound(getResultErr, key), "Failed to get object")
+	}
+	return getResult.Body, nil
+}
+
+func (store *s3BlobStore) Put(ctx context.Context,
+	bucket string,
+	key string,
+	data []byte,
+	options *PutOptions) error {
+	putObjectInput := &s3.PutObjectInput{
+		Body:   aws.ReadSeekCloser(bytes.NewReader(data)),
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if options != nil {
+		if options.ContentType != "" {
+			putObjectInput.ContentType = aws.String(options.ContentType)
+		}
+		if len(options.Tags) != 0 {
+			encodedTags := url.Values{}
+			for eachKey, eachValue := range options.Tags {
+				encodedTags.Set(eachKey, eachValue)
+			}
+			putObjectInput.Tagging = aws.String(encodedTags.Encode())
+		}
+		if len(options.Metadata) != 0 {
+			putObjectInput.Metadata = aws.StringMap(options.Metadata)
+		}
+	}
+	_, putResultErr := store.s3Svc.PutObjectWithContext(ctx, putObjectInput)
+	if putResultErr != nil {
+		return errors.Wrapf(putResultErr, "Failed to put object: %s", key)
+	}
+	return nil
+}
+
+func (store *s3BlobStore) Head(ctx context.Context,
+	bucket string,
+	key string) (*BlobInfo, error) {
+	headObjectInput := &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	headResult, headResultErr := store.s3Svc.HeadObjectWithContext(ctx, headObjectInput)
+	if headResultErr != nil {
+		return nil, errors.Wrapf(s3NotFound(headResultErr, key), "Failed to head object")
+	}
+	// The SDK canonicalizes the metadata header names
+	metadata := make(map[string]string)
+	for eachKey, eachValue := range headResult.Metadata {
+		metadata[strings.ToLower(eachKey)] = aws.StringValue(eachValue)
+	}
+	return &BlobInfo{
+		Key:          key,
+		Size:         aws.Int64Value(headResult.ContentLength),
+		ETag:         strings.Trim(aws.StringValue(headResult.ETag), "\""),
+		ContentType:  aws.StringValue(headResult.ContentType),
+		LastModified: aws.TimeValue(headResult.LastModified),
+		Metadata:     metadata,
+	}, nil
+}
+
+func (store *s3BlobStore) List(ctx context.Context,
+	bucket string,
+	prefix string) ([]*BlobInfo, error) {
+	listInput := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}
+	blobs := make([]*BlobInfo, 0)
+	listErr := store.s3Svc.ListObjectsV2PagesWithContext(ctx,
+		listInput,
+		func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, eachObject := range page.Contents {
+				blobs = append(blobs, &BlobInfo{
+					Key:          aws.StringValue(eachObject.Key),
+					Size:         aws.Int64Value(eachObject.Size),
+					ETag:         strings.Trim(aws.StringValue(eachObject.ETag), "\""),
+					LastModified: aws.TimeValue(eachObject.LastModified),
+				})
+			}
+			return true
+		})
+	if listErr != nil {
+		return nil, errors.Wrapf(listErr, "Failed to list objects: %s", prefix)
+	}
+	sort.Slice(blobs, func(i, j int) bool {
+		return blobs[i].Key < blobs[j].Key
+	})
+	return blobs, nil
+}
+
+func (store *s3BlobStore) Delete(ctx context.Context,
+	bucket string,
+	key string) error {
+	deleteObjectInput := &s3.DeleteObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	_, deleteErr := store.s3Svc.DeleteObjectWithContext(ctx, deleteObjectInput)
+	if deleteErr != nil {
+		return errors.Wrapf(deleteErr, "Failed to delete object: %s", key)
+	}
+	return nil
+}
+
+func (store *s3BlobStore) Copy(ctx context.Context,
+	bucket string,
+	srcKey string,
+	dstKey string) error {
+	// The object's metadata and tags are copied by default
+	copyObjectInput := &s3.CopyObjectInput{
+		Bucket:     aws.String(bucket),
+		Key:        aws.String(dstKey),
+		CopySource: aws.String(url.PathEscape(bucket + "/" + srcKey)),
+	}
+	_, copyErr := store.s3Svc.CopyObjectWithContext(ctx, copyObjectInput)
+	if copyErr != nil {
+		return errors.Wrapf(s3NotFound(copyErr, srcKey), "Failed to copy object: %s", srcKey)
+	}
+	return nil
+}
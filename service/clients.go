@@ -0,0 +1,165 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/s3"
+	sparta "github.com/mweagle/Sparta"
+	spartaAWS "github.com/mweagle/Sparta/aws"
+	ssmcache "github.com/mweagle/ssm-cache"
+	"github.com/sirupsen/logrus"
+)
+
+// S3API is the subset of the S3 client the service depends on
+type S3API interface {
+	GetObjectWithContext(ctx aws.Context,
+		input *s3.GetObjectInput,
+		opts ...request.Option) (*s3.GetObjectOutput, error)
+	PutObjectWithContext(ctx aws.Context,
+		input *s3.PutObjectInput,
+		opts ...request.Option) (*s3.PutObjectOutput, error)
+	PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput)
+	HeadObjectWithContext(ctx aws.Context,
+		input *s3.HeadObjectInput,
+		opts ...request.Option) (*s3.HeadObjectOutput, error)
+	ListObjectsV2PagesWithContext(ctx aws.Context,
+		input *s3.ListObjectsV2Input,
+		fn func(*s3.ListObjectsV2Output, bool) bool,
+		opts ...request.Option) error
+	DeleteObjectWithContext(ctx aws.Context,
+		input *s3.DeleteObjectInput,
+		opts ...request.Option) (*s3.DeleteObjectOutput, error)
+	CopyObjectWithContext(ctx aws.Context,
+		input *s3.CopyObjectInput,
+		opts ...request.Option) (*s3.CopyObjectOutput, error)
+	CreateMultipartUploadWithContext(ctx aws.Context,
+		input *s3.CreateMultipartUploadInput,
+		opts ...request.Option) (*s3.CreateMultipartUploadOutput, error)
+	UploadPartRequest(input *s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput)
+	ListPartsPagesWithContext(ctx aws.Context,
+		input *s3.ListPartsInput,
+		fn func(*s3.ListPartsOutput, bool) bool,
+		opts ...request.Option) error
+	CompleteMultipartUploadWithContext(ctx aws.Context,
+		input *s3.CompleteMultipartUploadInput,
+		opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error)
+	AbortMultipartUploadWithContext(ctx aws.Context,
+		input *s3.AbortMultipartUploadInput,
+		opts ...request.Option) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// RekognitionAPI is the subset of the Rekognition client the service
+// depends on
+type RekognitionAPI interface {
+	DetectLabelsWithContext(ctx aws.Context,
+		input *rekognition.DetectLabelsInput,
+		opts ...request.Option) (*rekognition.DetectLabelsOutput, error)
+	DetectTextWithContext(ctx aws.Context,
+		input *rekognition.DetectTextInput,
+		opts ...request.Option) (*rekognition.DetectTextOutput, error)
+	DetectModerationLabelsWithContext(ctx aws.Context,
+		input *rekognition.DetectModerationLabelsInput,
+		opts ...request.Option) (*rekognition.DetectModerationLabelsOutput, error)
+	DetectFacesWithContext(ctx aws.Context,
+		input *rekognition.DetectFacesInput,
+		opts ...request.Option) (*rekognition.DetectFacesOutput, error)
+	RecognizeCelebritiesWithContext(ctx aws.Context,
+		input *rekognition.RecognizeCelebritiesInput,
+		opts ...request.Option) (*rekognition.RecognizeCelebritiesOutput, error)
+}
+
+// PollyAPI is the subset of the Polly client the service depends on
+type PollyAPI interface {
+	SynthesizeSpeechWithContext(ctx aws.Context,
+		input *polly.SynthesizeSpeechInput,
+		opts ...request.Option) (*polly.SynthesizeSpeechOutput, error)
+}
+
+// ComprehendAPI is the subset of the Comprehend client the service
+// depends on
+type ComprehendAPI interface {
+	DetectSentimentWithContext(ctx aws.Context,
+		input *comprehend.DetectSentimentInput,
+		opts ...request.Option) (*comprehend.DetectSentimentOutput, error)
+}
+
+// DynamoDBAPI is the subset of the DynamoDB client the service depends on
+type DynamoDBAPI interface {
+	UpdateItemWithContext(ctx aws.Context,
+		input *dynamodb.UpdateItemInput,
+		opts ...request.Option) (*dynamodb.UpdateItemOutput, error)
+}
+
+// ParameterStore is the subset of the SSM parameter cache the service
+// depends on
+type ParameterStore interface {
+	GetExpiringString(key string, expiry time.Duration) (string, error)
+}
+
+// Clients is the set of AWS service clients used by the lambda functions.
+// Provide a custom Clients instance to New in order to exercise the
+// handlers without AWS credentials. If Blobs is nil, the S3 client
+// is used for object storage. If RateLimits is nil, the counters are
+// kept in memory.
+type Clients struct {
+	S3          S3API
+	Blobs       BlobStore
+	Rekognition RekognitionAPI
+	Polly       PollyAPI
+	Comprehend  ComprehendAPI
+	Parameters  ParameterStore
+	RateLimits  RateLimitStore
+}
+
+// NewClients returns the set of AWS service clients bound to the
+// given session
+func NewClients(awsSession *session.Session) *Clients {
+	s3Svc := s3.New(awsSession)
+	return &Clients{
+		S3:          s3Svc,
+		Blobs:       NewS3BlobStore(s3Svc),
+		Rekognition: rekognition.New(awsSession),
+		Polly:       polly.New(awsSession),
+		Comprehend:  comprehend.New(awsSession),
+		Parameters:  newMissingParameterCache(ssmcache.NewClient(5 * time.Minute)),
+		RateLimits:  NewDynamoDBRateLimitStore(dynamodb.New(awsSession)),
+	}
+}
+
+// lazyClients defers creating the AWS clients until the first
+// invocation, so that they're configured with the request scoped logger
+type lazyClients struct {
+	once    sync.Once
+	clients *Clients
+}
+
+func (lc *lazyClients) get(ctx context.Context) *Clients {
+	lc.once.Do(func() {
+		if lc.clients != nil {
+			clients := *lc.clients
+			if clients.Blobs == nil && clients.S3 != nil {
+				clients.Blobs = NewS3BlobStore(clients.S3)
+			}
+			if clients.RateLimits == nil {
+				clients.RateLimits = NewMemoryRateLimitStore()
+			}
+			lc.clients = &clients
+			return
+		}
+		logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+		if logger == nil {
+			logger = logrus.StandardLogger()
+		}
+		lc.clients = NewClients(spartaAWS.NewSession(logger))
+	})
+	return lc.clients
+}
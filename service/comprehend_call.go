@@ -9,10 +9,8 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/comprehend"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
 	spartaEvents "github.com/mweagle/Sparta/aws/events"
 	gocf "github.com/mweagle/go-cloudformation"
-	"github.com/sirupsen/logrus"
 )
 
 // FeedbackBody is the typed body submitted in a FeedbackRequest
@@ -33,6 +31,8 @@ type FeedbackRequest struct {
 type FeedbackResponse struct {
 	Sentiment *comprehend.DetectSentimentOutput `json:"sentiment"`
 	Comment   string                            `json:"comment"`
+	// Subject is the authenticated user that submitted the feedback
+	Subject string `json:"subject,omitempty"`
 }
 
 /*
@@ -41,46 +41,60 @@ type FeedbackResponse struct {
 ║  ╠═╣║║║╠╩╗ ║║╠═╣
 ╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
 ================================================================================
-Create a presigned URL
+Detect the sentiment of the submitted feedback. Clients that exceed their
+quota receive a 429 with Retry-After. When the JWT authorizer is enabled
+the feedback is attributed to the token's subject.
 */
 func (gws *ServicefulService) onFeedbackDetectSentiment(ctx context.Context,
-	apigRequest FeedbackRequest) (*FeedbackResponse, error) {
+	apigRequest FeedbackRequest) (interface{}, error) {
 
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
 	lambdaContext, _ := awsLambdaContext.FromContext(ctx)
-	discover, discoveryInfoErr := sparta.Discover()
-	if discoveryInfoErr != nil {
-		return nil, discoveryInfoErr
+	exceeded := gws.checkRateLimit(ctx,
+		"feedback",
+		gws.config.RateLimits.FeedbackPerMinute,
+		gws.config.RateLimits.FeedbackPerDay,
+		&apigRequest.Context,
+		1)
+	if exceeded != nil {
+		return rateLimitedResponse(exceeded), nil
+	}
+	subject, subjectErr := gws.requestSubject(ctx, apigRequest.Headers)
+	if subjectErr != nil {
+		return nil, subjectErr
+	}
+	bucketName, bucketNameErr := gws.bucketName()
+	if bucketNameErr != nil {
+		return nil, bucketNameErr
 	}
-	s3Resource := discover.Resources[gws.connections.S3UploadBucketResourceName]
 	comment := apigRequest.Body.Comment
 	language := apigRequest.Body.Language
 	if language == "" {
 		language = "en"
 	}
-	awsSession := spartaAWS.NewSession(logger)
-	svcComprehend := comprehend.New(awsSession)
+	svcComprehend := gws.clients(ctx).Comprehend
 	detectSentimentInput := &comprehend.DetectSentimentInput{
 		LanguageCode: aws.String(language),
 		Text:         aws.String(comment),
 	}
-	detectSentimentResult, detectSentimentResultErr := svcComprehend.DetectSentiment(detectSentimentInput)
+	detectSentimentResult, detectSentimentResultErr := svcComprehend.DetectSentimentWithContext(ctx,
+		detectSentimentInput)
 	if detectSentimentResultErr != nil {
 		return nil, detectSentimentResultErr
 	}
 	response := &FeedbackResponse{
 		Sentiment: detectSentimentResult,
-		Comment:   comment}
+		Comment:   comment,
+		Subject:   subject}
 
 	// Super, save this to a location...
 	outputKey := fmt.Sprintf("%s/%s.json",
 		gws.connections.S3KeyspaceComprehendArtifacts,
 		lambdaContext.AwsRequestID)
-	putErr := gws.putJSONObjectToS3(ctx,
-		s3Resource.ResourceRef,
+	putErr := gws.putJSONObject(ctx,
+		bucketName,
 		outputKey,
 		response,
-		nil)
+		&PutOptions{Metadata: subjectMetadata(subject)})
 	if putErr != nil {
 		return nil, putErr
 	}
@@ -100,15 +114,18 @@ func (gws *ServicefulService) newOnFeedbackDetectSentiment(api *sparta.API) *spa
 		Mode: gocf.String("Active"),
 	}
 
-	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges("comprehend:DetectSentiment")
+	lambdaFn.RoleDefinition.Privileges = append(gws.bucketGetPutPrivileges("comprehend:DetectSentiment"),
+		gws.rateLimitPrivilege())
 
-	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName,
+		gws.connections.RateLimitTableResourceName}
 	if api != nil {
 		apiGatewayResource, _ := api.NewResource("/feedback", lambdaFn)
 
-		// We only return http.StatusOK
-		apiMethod, apiMethodErr := apiGatewayResource.NewMethod("POST",
+		apiMethod, apiMethodErr := gws.newAPIMethod(apiGatewayResource,
+			"POST",
 			http.StatusOK,
+			http.StatusTooManyRequests,
 			http.StatusInternalServerError)
 		if nil != apiMethodErr {
 			panic("Failed to create /feedback resource: " + apiMethodErr.Error())
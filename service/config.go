@@ -0,0 +1,741 @@
+package service
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/pkg/errors"
+)
+
+// EnvConfigPath is the environment variable that names the optional
+// YAML or JSON configuration file
+const EnvConfigPath = "GEEKWIRE_CONFIG"
+
+// Config is the externalized service configuration. Values are resolved
+// from the defaults, then the optional configuration file, then the
+// environment variables named by each field's env tag.
+type Config struct {
+	Connections   Connections           `json:"connections"`
+	Pipeline      PipelineSettings      `json:"pipeline"`
+	Uploads       UploadSettings        `json:"uploads"`
+	Validation    ValidationSettings    `json:"validation"`
+	Normalization NormalizationSettings `json:"normalization"`
+	RateLimits    RateLimitSettings     `json:"rateLimits"`
+	Auth          AuthSettings          `json:"auth"`
+	Rekognition   RekognitionSettings   `json:"rekognition"`
+	Moderation    ModerationSettings    `json:"moderation"`
+	Labels        LabelSettings         `json:"labels"`
+	Annotation    AnnotationSettings    `json:"annotation"`
+}
+
+// AnnotationSettings control the annotated image, which outlines the
+// detected label instances
+type AnnotationSettings struct {
+	// MaxDimensionPixels is the longest side of the annotated image
+	MaxDimensionPixels int `json:"maxDimensionPixels" env:"GEEKWIRE_ANNOTATION_MAX_DIMENSION_PIXELS"`
+}
+
+// LabelSettings configure how the detected labels are normalized before
+// they're narrated and summarized
+type LabelSettings struct {
+	// Synonyms rename labels (eg: "Human" to "Person"). Labels that have
+	// the same name after renaming are merged.
+	Synonyms map[string]string `json:"synonyms" env:"GEEKWIRE_LABELS_SYNONYMS"`
+}
+
+// ModerationSettings configure the content moderation gate. Uploads with
+// a moderation label whose confidence meets the threshold of the label,
+// or of its top level category, are rejected before they're narrated.
+type ModerationSettings struct {
+	Enabled bool `json:"enabled" env:"GEEKWIRE_MODERATION_ENABLED"`
+	// Thresholds map moderation labels and categories (eg: "Violence")
+	// to the minimum confidence that rejects an upload. Zero disables
+	// the category.
+	Thresholds map[string]float64 `json:"thresholds" env:"GEEKWIRE_MODERATION_THRESHOLDS"`
+}
+
+// RekognitionSettings select the analyses the RekognitionRelay submits
+// normalized images to
+type RekognitionSettings struct {
+	// Analyses are any of labels, text, moderation, faces and celebrities.
+	// Labels are required, since the narration is based on them.
+	Analyses []string `json:"analyses" env:"GEEKWIRE_REKOGNITION_ANALYSES"`
+	// PublishIdentities includes the faces and celebrities responses in
+	// the public consolidated report. Otherwise only the number of faces
+	// and celebrities is published.
+	PublishIdentities bool `json:"publishIdentities" env:"GEEKWIRE_REKOGNITION_PUBLISH_IDENTITIES"`
+}
+
+// AuthSettings configure the optional JWT authorizer, which is
+// provisioned when JWKSURL is set. Tokens must be signed by a key in the
+// JWKS document. The issuer and audience are only checked if they're set.
+type AuthSettings struct {
+	JWKSURL  string `json:"jwksURL" env:"GEEKWIRE_AUTH_JWKS_URL"`
+	Issuer   string `json:"issuer" env:"GEEKWIRE_AUTH_ISSUER"`
+	Audience string `json:"audience" env:"GEEKWIRE_AUTH_AUDIENCE"`
+	// JWKSCacheSeconds is how long the JWKS keys are used before the
+	// document is refetched
+	JWKSCacheSeconds int `json:"jwksCacheSeconds" env:"GEEKWIRE_AUTH_JWKS_CACHE_SECONDS"`
+	// ResultTTLSeconds is how long API Gateway caches the authorizer's
+	// result for a token
+	ResultTTLSeconds int `json:"resultTTLSeconds" env:"GEEKWIRE_AUTH_RESULT_TTL_SECONDS"`
+}
+
+// RateLimitSettings are the per client quotas of the public endpoints
+// that call the paid AWS services. Clients are identified by their API
+// key or, failing that, their source IP. A zero quota is disabled.
+type RateLimitSettings struct {
+	// The /presigned quotas also apply to /batch, where each member counts
+	// as a request
+	PresignedPerMinute int `json:"presignedPerMinute" env:"GEEKWIRE_RATE_LIMITS_PRESIGNED_PER_MINUTE"`
+	PresignedPerDay    int `json:"presignedPerDay" env:"GEEKWIRE_RATE_LIMITS_PRESIGNED_PER_DAY"`
+	FeedbackPerMinute  int `json:"feedbackPerMinute" env:"GEEKWIRE_RATE_LIMITS_FEEDBACK_PER_MINUTE"`
+	FeedbackPerDay     int `json:"feedbackPerDay" env:"GEEKWIRE_RATE_LIMITS_FEEDBACK_PER_DAY"`
+}
+
+// NormalizationSettings control the JPEG that's submitted to Rekognition
+// and its thumbnail
+type NormalizationSettings struct {
+	// MaxDimensionPixels is the longest side of the normalized image.
+	// Larger images are downsized.
+	MaxDimensionPixels       int `json:"maxDimensionPixels" env:"GEEKWIRE_NORMALIZATION_MAX_DIMENSION_PIXELS"`
+	ThumbnailDimensionPixels int `json:"thumbnailDimensionPixels" env:"GEEKWIRE_NORMALIZATION_THUMBNAIL_DIMENSION_PIXELS"`
+	JPEGQuality              int `json:"jpegQuality" env:"GEEKWIRE_NORMALIZATION_JPEG_QUALITY"`
+}
+
+// ValidationSettings are the limits uploads must satisfy before they're
+// submitted to Rekognition
+type ValidationSettings struct {
+	// MaxSizeBytes defaults to the Rekognition limit for S3 images
+	MaxSizeBytes       int64 `json:"maxSizeBytes" env:"GEEKWIRE_VALIDATION_MAX_SIZE_BYTES"`
+	MinDimensionPixels int   `json:"minDimensionPixels" env:"GEEKWIRE_VALIDATION_MIN_DIMENSION_PIXELS"`
+	MaxDimensionPixels int   `json:"maxDimensionPixels" env:"GEEKWIRE_VALIDATION_MAX_DIMENSION_PIXELS"`
+}
+
+// UploadSettings constrain the uploads accepted by presigned POST
+// policies
+type UploadSettings struct {
+	// MinSizeBytes and MaxSizeBytes bound the upload's content length
+	MinSizeBytes int64 `json:"minSizeBytes" env:"GEEKWIRE_UPLOADS_MIN_SIZE_BYTES"`
+	MaxSizeBytes int64 `json:"maxSizeBytes" env:"GEEKWIRE_UPLOADS_MAX_SIZE_BYTES"`
+	// ContentTypes are the accepted image types. They should match the
+	// types the Accept component advertises.
+	ContentTypes []string `json:"contentTypes" env:"GEEKWIRE_UPLOADS_CONTENT_TYPES"`
+	// PresignExpirySeconds is the default lifetime of presigned URLs and
+	// POST policies. Clients may request up to MaxPresignExpirySeconds.
+	PresignExpirySeconds    int `json:"presignExpirySeconds" env:"GEEKWIRE_UPLOADS_PRESIGN_EXPIRY_SECONDS"`
+	MaxPresignExpirySeconds int `json:"maxPresignExpirySeconds" env:"GEEKWIRE_UPLOADS_MAX_PRESIGN_EXPIRY_SECONDS"`
+	// MultipartMaxSizeBytes bounds the total size of a multipart upload.
+	// It can't exceed validation.maxSizeBytes.
+	MultipartMaxSizeBytes int64 `json:"multipartMaxSizeBytes" env:"GEEKWIRE_UPLOADS_MULTIPART_MAX_SIZE_BYTES"`
+	// MultipartContentTypes are the types accepted by multipart uploads,
+	// which are intended for larger images. They must be types that
+	// ValidateImage accepts.
+	MultipartContentTypes []string `json:"multipartContentTypes" env:"GEEKWIRE_UPLOADS_MULTIPART_CONTENT_TYPES"`
+	// IdempotencyWindowSeconds is how long a repeated Idempotency-Key
+	// returns the original upload. The bucket expires the records after
+	// a day.
+	IdempotencyWindowSeconds int `json:"idempotencyWindowSeconds" env:"GEEKWIRE_UPLOADS_IDEMPOTENCY_WINDOW_SECONDS"`
+	// MaxBatchSize is the number of uploads a batch may include
+	MaxBatchSize int `json:"maxBatchSize" env:"GEEKWIRE_UPLOADS_MAX_BATCH_SIZE"`
+}
+
+// PipelineSettings control how the S3 triggered stages handle failures
+type PipelineSettings struct {
+	// MaxAttempts is the number of failed invocations of a stage after
+	// which a retryable error is treated as terminal. Lambda makes three
+	// attempts for asynchronous invocations.
+	MaxAttempts int `json:"maxAttempts" env:"GEEKWIRE_PIPELINE_MAX_ATTEMPTS"`
+	// MaxConcurrentRecords is the number of records in an S3 event that
+	// are processed concurrently
+	MaxConcurrentRecords int `json:"maxConcurrentRecords" env:"GEEKWIRE_PIPELINE_MAX_CONCURRENT_RECORDS"`
+	// DeadlineMarginMillis is the amount of the Lambda's remaining time
+	// that's reserved for reporting the outcome of each record
+	DeadlineMarginMillis int `json:"deadlineMarginMillis" env:"GEEKWIRE_PIPELINE_DEADLINE_MARGIN_MILLIS"`
+	// Force reprocesses objects whose artifacts were already produced from
+	// the same source object
+	Force bool `json:"force" env:"GEEKWIRE_PIPELINE_FORCE"`
+}
+
+// DefaultConfig returns the configuration used when nothing is
+// overridden
+func DefaultConfig() *Config {
+	return &Config{
+		Connections: Connections{
+			S3UploadBucketResourceName:     "S3UploadBucket",
+			S3KeyspaceUploads:              "uploads",
+			S3KeyspaceRekognitionArtifacts: "rekognition-artifacts",
+			S3KeyspacePollyArtifacts:       "polly-artifacts",
+			S3KeyspaceComprehendArtifacts:  "comprehend-artifacts",
+			S3KeyspaceConsolidatedStatus:   "consolidated",
+			S3KeyspaceJobStatus:            "status",
+			S3KeyspaceUploadMetadata:       "upload-metadata",
+			S3KeyspaceIdempotencyKeys:      "idempotency-keys",
+			S3KeyspaceBatches:              "batches",
+			S3KeyspaceBatchConsolidated:    "batch-consolidated",
+			S3KeyspaceValidations:          "validations",
+			S3KeyspaceQuarantine:           "quarantine",
+			S3KeyspaceNormalized:           "normalized",
+			S3KeyspaceThumbnails:           "thumbnails",
+			S3KeyspaceAnnotated:            "annotated",
+			DeadLetterQueueResourceName:    "PipelineDeadLetterQueue",
+			RateLimitTableResourceName:     "RateLimitTable",
+		},
+		Pipeline: PipelineSettings{
+			MaxAttempts:          3,
+			MaxConcurrentRecords: 4,
+			DeadlineMarginMillis: 1000,
+		},
+		Uploads: UploadSettings{
+			MinSizeBytes:             1,
+			MaxSizeBytes:             10 * 1024 * 1024,
+			ContentTypes:             []string{"image/jpeg", "image/png"},
+			MultipartMaxSizeBytes:    15 * 1024 * 1024,
+			MultipartContentTypes:    []string{"image/jpeg", "image/png"},
+			PresignExpirySeconds:     300,
+			MaxPresignExpirySeconds:  3600,
+			IdempotencyWindowSeconds: 300,
+			MaxBatchSize:             20,
+		},
+		Validation: ValidationSettings{
+			MaxSizeBytes:       15 * 1024 * 1024,
+			MinDimensionPixels: 80,
+			MaxDimensionPixels: 10000,
+		},
+		Normalization: NormalizationSettings{
+			MaxDimensionPixels:       4096,
+			ThumbnailDimensionPixels: 320,
+			JPEGQuality:              90,
+		},
+		RateLimits: RateLimitSettings{
+			PresignedPerMinute: 30,
+			PresignedPerDay:    1000,
+			FeedbackPerMinute:  10,
+			FeedbackPerDay:     500,
+		},
+		Auth: AuthSettings{
+			JWKSCacheSeconds: 3600,
+			ResultTTLSeconds: 300,
+		},
+		Rekognition: RekognitionSettings{
+			Analyses: []string{rekognitionAnalysisLabels},
+		},
+		Labels: LabelSettings{
+			Synonyms: map[string]string{
+				"Human":      "Person",
+				"People":     "Person",
+				"Automobile": "Car",
+				"Canine":     "Dog",
+				"Feline":     "Cat",
+			},
+		},
+		Annotation: AnnotationSettings{
+			MaxDimensionPixels: 1024,
+		},
+		Moderation: ModerationSettings{
+			Enabled: true,
+			Thresholds: map[string]float64{
+				"Explicit Nudity":     80,
+				"Violence":            80,
+				"Visually Disturbing": 80,
+				"Hate Symbols":        80,
+			},
+		},
+	}
+}
+
+// ConfigError is returned when the configuration is invalid. It includes
+// every problem that was found.
+type ConfigError struct {
+	Problems []string
+}
+
+func (ce *ConfigError) Error() string {
+	return fmt.Sprintf("Invalid configuration:\n\t%s",
+		strings.Join(ce.Problems, "\n\t"))
+}
+
+// LoadConfig returns the validated configuration. configPath is optional;
+// when empty the EnvConfigPath environment variable is consulted.
+func LoadConfig(configPath string) (*Config, error) {
+	config := DefaultConfig()
+	if configPath == "" {
+		configPath = os.Getenv(EnvConfigPath)
+	}
+	if configPath != "" {
+		configData, configDataErr := ioutil.ReadFile(configPath)
+		if configDataErr != nil {
+			return nil, errors.Wrapf(configDataErr, "Failed to read configuration")
+		}
+		// YAML is a superset of JSON, so this handles both
+		fileConfig := &Config{}
+		unmarshalErr := yaml.Unmarshal(configData, fileConfig)
+		if unmarshalErr == nil {
+			// Maps in the file replace the defaults rather than being
+			// merged into them, so that default entries can be removed
+			resetConfiguredMaps(reflect.ValueOf(config).Elem(),
+				reflect.ValueOf(fileConfig).Elem())
+			unmarshalErr = yaml.Unmarshal(configData, config)
+		}
+		if unmarshalErr != nil {
+			return nil, errors.Wrapf(unmarshalErr,
+				"Failed to parse configuration file: %s",
+				configPath)
+		}
+	}
+	problems := applyEnvironment(reflect.ValueOf(config).Elem(), os.LookupEnv)
+	problems = append(problems, config.validate()...)
+	if len(problems) != 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return config, nil
+}
+
+// configSectionDependencies are the sections that validating a section
+// compares it with. A function that reads the section also needs them,
+// so that its configuration is valid. The comparisons involve both
+// sections, so the dependencies are symmetric.
+var configSectionDependencies = map[string][]string{
+	"uploads":       []string{"validation"},
+	"validation":    []string{"uploads"},
+	"annotation":    []string{"normalization"},
+	"normalization": []string{"annotation"},
+}
+
+// Environment returns the environment variables that reproduce the
+// connections and the named sections of this configuration, together with
+// their dependencies. Sections are named by their JSON keys. The sections
+// that aren't included have their default values at runtime.
+func (config *Config) Environment(sections ...string) map[string]string {
+	included := map[string]bool{
+		"connections": true,
+	}
+	for _, eachSection := range sections {
+		included[eachSection] = true
+		for _, eachDependency := range configSectionDependencies[eachSection] {
+			included[eachDependency] = true
+		}
+	}
+	env := make(map[string]string)
+	configValue := reflect.ValueOf(config).Elem()
+	for i := 0; i < configValue.NumField(); i++ {
+		jsonName := strings.Split(configValue.Type().Field(i).Tag.Get("json"), ",")[0]
+		if included[jsonName] {
+			collectEnvironment(configValue.Field(i), env)
+		}
+	}
+	return env
+}
+
+var cloudFormationLogicalID = regexp.MustCompile("^[A-Za-z0-9]+$")
+var keyspaceName = regexp.MustCompile("^[A-Za-z0-9!_.*'()-]+(/[A-Za-z0-9!_.*'()-]+)*$")
+
+func (config *Config) validate() []string {
+	problems := make([]string, 0)
+	connections := config.Connections
+	resourceNames := []struct {
+		name  string
+		value string
+	}{
+		{"connections.bucketResourceName", connections.S3UploadBucketResourceName},
+		{"connections.deadLetterQueueResourceName", connections.DeadLetterQueueResourceName},
+		{"connections.rateLimitTableResourceName", connections.RateLimitTableResourceName},
+	}
+	for _, eachResourceName := range resourceNames {
+		if eachResourceName.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", eachResourceName.name))
+		} else if !cloudFormationLogicalID.MatchString(eachResourceName.value) {
+			problems = append(problems,
+				fmt.Sprintf("%s must be alphanumeric: %s",
+					eachResourceName.name,
+					eachResourceName.value))
+		}
+	}
+	if connections.S3UploadBucketResourceName == connections.DeadLetterQueueResourceName {
+		problems = append(problems,
+			"connections.deadLetterQueueResourceName duplicates connections.bucketResourceName")
+	}
+	if connections.RateLimitTableResourceName == connections.S3UploadBucketResourceName ||
+		connections.RateLimitTableResourceName == connections.DeadLetterQueueResourceName {
+		problems = append(problems,
+			"connections.rateLimitTableResourceName duplicates another resource name")
+	}
+	keyspaces := []struct {
+		name  string
+		value string
+	}{
+		{"connections.uploads", connections.S3KeyspaceUploads},
+		{"connections.rekognitionArtifacts", connections.S3KeyspaceRekognitionArtifacts},
+		{"connections.pollyArtifacts", connections.S3KeyspacePollyArtifacts},
+		{"connections.comprehendArtifacts", connections.S3KeyspaceComprehendArtifacts},
+		{"connections.consolidated", connections.S3KeyspaceConsolidatedStatus},
+		{"connections.status", connections.S3KeyspaceJobStatus},
+		{"connections.uploadMetadata", connections.S3KeyspaceUploadMetadata},
+		{"connections.idempotencyKeys", connections.S3KeyspaceIdempotencyKeys},
+		{"connections.batches", connections.S3KeyspaceBatches},
+		{"connections.batchConsolidated", connections.S3KeyspaceBatchConsolidated},
+		{"connections.validations", connections.S3KeyspaceValidations},
+		{"connections.quarantine", connections.S3KeyspaceQuarantine},
+		{"connections.normalized", connections.S3KeyspaceNormalized},
+		{"connections.thumbnails", connections.S3KeyspaceThumbnails},
+		{"connections.annotated", connections.S3KeyspaceAnnotated},
+	}
+	seen := make(map[string]string)
+	for _, eachKeyspace := range keyspaces {
+		if eachKeyspace.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is required", eachKeyspace.name))
+			continue
+		}
+		if !keyspaceName.MatchString(eachKeyspace.value) {
+			problems = append(problems,
+				fmt.Sprintf("%s must be a relative key path without leading or trailing slashes: %s",
+					eachKeyspace.name,
+					eachKeyspace.value))
+		}
+		if existing, exists := seen[eachKeyspace.value]; exists {
+			problems = append(problems,
+				fmt.Sprintf("%s duplicates %s: %s",
+					eachKeyspace.name,
+					existing,
+					eachKeyspace.value))
+		}
+		seen[eachKeyspace.value] = eachKeyspace.name
+	}
+	if config.Pipeline.MaxAttempts < 1 {
+		problems = append(problems,
+			fmt.Sprintf("pipeline.maxAttempts must be at least 1: %d",
+				config.Pipeline.MaxAttempts))
+	}
+	if config.Pipeline.MaxConcurrentRecords < 1 {
+		problems = append(problems,
+			fmt.Sprintf("pipeline.maxConcurrentRecords must be at least 1: %d",
+				config.Pipeline.MaxConcurrentRecords))
+	}
+	if config.Pipeline.DeadlineMarginMillis < 0 {
+		problems = append(problems,
+			fmt.Sprintf("pipeline.deadlineMarginMillis must not be negative: %d",
+				config.Pipeline.DeadlineMarginMillis))
+	}
+	if config.Uploads.MinSizeBytes < 0 || config.Uploads.MaxSizeBytes < config.Uploads.MinSizeBytes {
+		problems = append(problems,
+			fmt.Sprintf("uploads size range is invalid: %d-%d",
+				config.Uploads.MinSizeBytes,
+				config.Uploads.MaxSizeBytes))
+	}
+	if len(config.Uploads.ContentTypes) == 0 {
+		problems = append(problems, "uploads.contentTypes is required")
+	}
+	if config.Uploads.MultipartMaxSizeBytes < 1 {
+		problems = append(problems,
+			fmt.Sprintf("uploads.multipartMaxSizeBytes must be at least 1: %d",
+				config.Uploads.MultipartMaxSizeBytes))
+	}
+	// SigV4 presigned URLs are valid for at most 7 days
+	if config.Uploads.PresignExpirySeconds < 1 ||
+		config.Uploads.PresignExpirySeconds > config.Uploads.MaxPresignExpirySeconds ||
+		config.Uploads.MaxPresignExpirySeconds > 7*24*60*60 {
+		problems = append(problems,
+			fmt.Sprintf("uploads presign expiry must satisfy 1 <= presignExpirySeconds (%d) <= maxPresignExpirySeconds (%d) <= 604800",
+				config.Uploads.PresignExpirySeconds,
+				config.Uploads.MaxPresignExpirySeconds))
+	}
+	if len(config.Uploads.MultipartContentTypes) == 0 {
+		problems = append(problems, "uploads.multipartContentTypes is required")
+	}
+	// The pipeline would quarantine anything else
+	for _, eachContentType := range config.Uploads.MultipartContentTypes {
+		if !isImageContentType(eachContentType) {
+			problems = append(problems,
+				fmt.Sprintf("uploads.multipartContentTypes must be image types that are validated: %s",
+					eachContentType))
+		}
+	}
+	if config.Uploads.MultipartMaxSizeBytes > config.Validation.MaxSizeBytes {
+		problems = append(problems,
+			fmt.Sprintf("uploads.multipartMaxSizeBytes (%d) must not exceed validation.maxSizeBytes (%d)",
+				config.Uploads.MultipartMaxSizeBytes,
+				config.Validation.MaxSizeBytes))
+	}
+	if config.Uploads.IdempotencyWindowSeconds < 1 ||
+		config.Uploads.IdempotencyWindowSeconds > 24*60*60 {
+		problems = append(problems,
+			fmt.Sprintf("uploads.idempotencyWindowSeconds must be 1-86400: %d",
+				config.Uploads.IdempotencyWindowSeconds))
+	}
+	if config.Uploads.MaxBatchSize < 1 || config.Uploads.MaxBatchSize > 100 {
+		problems = append(problems,
+			fmt.Sprintf("uploads.maxBatchSize must be 1-100: %d",
+				config.Uploads.MaxBatchSize))
+	}
+	if config.Validation.MaxSizeBytes < 1 {
+		problems = append(problems,
+			fmt.Sprintf("validation.maxSizeBytes must be at least 1: %d",
+				config.Validation.MaxSizeBytes))
+	}
+	if config.Validation.MinDimensionPixels < 1 ||
+		config.Validation.MaxDimensionPixels < config.Validation.MinDimensionPixels {
+		problems = append(problems,
+			fmt.Sprintf("validation dimension range is invalid: %d-%d",
+				config.Validation.MinDimensionPixels,
+				config.Validation.MaxDimensionPixels))
+	}
+	if config.Normalization.ThumbnailDimensionPixels < 1 ||
+		config.Normalization.MaxDimensionPixels < config.Normalization.ThumbnailDimensionPixels {
+		problems = append(problems,
+			fmt.Sprintf("normalization.thumbnailDimensionPixels must be 1-%d: %d",
+				config.Normalization.MaxDimensionPixels,
+				config.Normalization.ThumbnailDimensionPixels))
+	}
+	if config.Normalization.JPEGQuality < 1 || config.Normalization.JPEGQuality > 100 {
+		problems = append(problems,
+			fmt.Sprintf("normalization.jpegQuality must be 1-100: %d",
+				config.Normalization.JPEGQuality))
+	}
+	if config.RateLimits.PresignedPerMinute < 0 ||
+		config.RateLimits.PresignedPerDay < 0 ||
+		config.RateLimits.FeedbackPerMinute < 0 ||
+		config.RateLimits.FeedbackPerDay < 0 {
+		problems = append(problems, "rateLimits quotas must not be negative")
+	}
+	if config.Auth.JWKSURL != "" {
+		jwksURL, jwksURLErr := url.Parse(config.Auth.JWKSURL)
+		if jwksURLErr != nil || jwksURL.Scheme != "https" || jwksURL.Host == "" {
+			problems = append(problems,
+				fmt.Sprintf("auth.jwksURL must be an https URL: %s", config.Auth.JWKSURL))
+		}
+	}
+	if config.Auth.JWKSCacheSeconds < 1 {
+		problems = append(problems,
+			fmt.Sprintf("auth.jwksCacheSeconds must be at least 1: %d",
+				config.Auth.JWKSCacheSeconds))
+	}
+	analysisNames := rekognitionAnalysisNames()
+	supportedAnalyses := make(map[string]bool)
+	for _, eachName := range analysisNames {
+		supportedAnalyses[eachName] = true
+	}
+	enabledAnalyses := make(map[string]bool)
+	for _, eachName := range config.Rekognition.Analyses {
+		if !supportedAnalyses[eachName] {
+			problems = append(problems,
+				fmt.Sprintf("rekognition.analyses includes unsupported analysis %q (must be one of: %s)",
+					eachName,
+					strings.Join(analysisNames, ", ")))
+		} else if enabledAnalyses[eachName] {
+			problems = append(problems,
+				fmt.Sprintf("rekognition.analyses includes %q more than once", eachName))
+		}
+		enabledAnalyses[eachName] = true
+	}
+	if !enabledAnalyses[rekognitionAnalysisLabels] {
+		problems = append(problems,
+			fmt.Sprintf("rekognition.analyses must include %q", rekognitionAnalysisLabels))
+	}
+	// DetectModerationLabels only returns labels with at least 50%
+	// confidence
+	categories := make([]string, 0, len(config.Moderation.Thresholds))
+	for eachCategory := range config.Moderation.Thresholds {
+		categories = append(categories, eachCategory)
+	}
+	sort.Strings(categories)
+	for _, eachCategory := range categories {
+		eachThreshold := config.Moderation.Thresholds[eachCategory]
+		if eachThreshold != 0 && (eachThreshold < 50 || eachThreshold > 100) {
+			problems = append(problems,
+				fmt.Sprintf("moderation.thresholds[%q] must be 0 or 50-100: %g",
+					eachCategory,
+					eachThreshold))
+		}
+	}
+	synonymNames := make([]string, 0, len(config.Labels.Synonyms))
+	for eachName := range config.Labels.Synonyms {
+		synonymNames = append(synonymNames, eachName)
+	}
+	sort.Strings(synonymNames)
+	for _, eachName := range synonymNames {
+		eachRename := config.Labels.Synonyms[eachName]
+		if strings.TrimSpace(eachName) == "" || strings.TrimSpace(eachRename) == "" {
+			problems = append(problems,
+				fmt.Sprintf("labels.synonyms must map names to names: %q=%q", eachName, eachRename))
+		}
+	}
+	if config.Annotation.MaxDimensionPixels < 1 ||
+		config.Annotation.MaxDimensionPixels > config.Normalization.MaxDimensionPixels {
+		problems = append(problems,
+			fmt.Sprintf("annotation.maxDimensionPixels must be 1-%d: %d",
+				config.Normalization.MaxDimensionPixels,
+				config.Annotation.MaxDimensionPixels))
+	}
+	// API Gateway's limit
+	if config.Auth.ResultTTLSeconds < 0 || config.Auth.ResultTTLSeconds > 3600 {
+		problems = append(problems,
+			fmt.Sprintf("auth.resultTTLSeconds must be 0-3600: %d",
+				config.Auth.ResultTTLSeconds))
+	}
+	return problems
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Environment overrides
+
+// applyEnvironment assigns every field with an env tag whose variable is
+// set, recursing into nested structs
+func applyEnvironment(value reflect.Value,
+	lookup func(string) (string, bool)) []string {
+	problems := make([]string, 0)
+	valueType := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		fieldType := valueType.Field(i)
+		envName := fieldType.Tag.Get("env")
+		if envName == "" {
+			if field.Kind() == reflect.Struct {
+				problems = append(problems, applyEnvironment(field, lookup)...)
+			}
+			continue
+		}
+		envValue, exists := lookup(envName)
+		if !exists {
+			continue
+		}
+		parseErr := setField(field, envValue)
+		if parseErr != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", envName, parseErr))
+		}
+	}
+	return problems
+}
+
+// resetConfiguredMaps clears the maps in value that are set in
+// configured, recursing into nested structs
+func resetConfiguredMaps(value reflect.Value, configured reflect.Value) {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		switch field.Kind() {
+		case reflect.Struct:
+			resetConfiguredMaps(field, configured.Field(i))
+		case reflect.Map:
+			if !configured.Field(i).IsNil() {
+				field.Set(reflect.Zero(field.Type()))
+			}
+		}
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func setField(field reflect.Value, envValue string) error {
+	if field.Type() == durationType {
+		duration, durationErr := time.ParseDuration(envValue)
+		if durationErr != nil {
+			return durationErr
+		}
+		field.SetInt(int64(duration))
+		return nil
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(envValue)
+	case reflect.Bool:
+		boolValue, boolErr := strconv.ParseBool(envValue)
+		if boolErr != nil {
+			return boolErr
+		}
+		field.SetBool(boolValue)
+	case reflect.Int, reflect.Int64:
+		intValue, intErr := strconv.ParseInt(envValue, 10, 64)
+		if intErr != nil {
+			return intErr
+		}
+		field.SetInt(intValue)
+	case reflect.Float64:
+		floatValue, floatErr := strconv.ParseFloat(envValue, 64)
+		if floatErr != nil {
+			return floatErr
+		}
+		field.SetFloat(floatValue)
+	case reflect.Slice:
+		values := reflect.MakeSlice(field.Type(), 0, 0)
+		for _, eachValue := range strings.Split(envValue, ",") {
+			trimmed := strings.TrimSpace(eachValue)
+			if trimmed == "" {
+				continue
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			elemErr := setField(elem, trimmed)
+			if elemErr != nil {
+				return elemErr
+			}
+			values = reflect.Append(values, elem)
+		}
+		field.Set(values)
+	case reflect.Map:
+		values := reflect.MakeMap(field.Type())
+		for _, eachPair := range strings.Split(envValue, ",") {
+			if strings.TrimSpace(eachPair) == "" {
+				continue
+			}
+			pairParts := strings.SplitN(eachPair, "=", 2)
+			if len(pairParts) != 2 {
+				return errors.Errorf("expected key=value pair: %s", eachPair)
+			}
+			elem := reflect.New(field.Type().Elem()).Elem()
+			elemErr := setField(elem, strings.TrimSpace(pairParts[1]))
+			if elemErr != nil {
+				return elemErr
+			}
+			values.SetMapIndex(reflect.ValueOf(strings.TrimSpace(pairParts[0])), elem)
+		}
+		field.Set(values)
+	default:
+		return errors.Errorf("unsupported field type: %s", field.Type())
+	}
+	return nil
+}
+
+// collectEnvironment is the inverse of applyEnvironment
+func collectEnvironment(value reflect.Value, env map[string]string) {
+	valueType := value.Type()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Field(i)
+		envName := valueType.Field(i).Tag.Get("env")
+		if envName == "" {
+			if field.Kind() == reflect.Struct {
+				collectEnvironment(field, env)
+			}
+			continue
+		}
+		if field.Type() == durationType {
+			env[envName] = time.Duration(field.Int()).String()
+			continue
+		}
+		switch field.Kind() {
+		case reflect.Slice:
+			values := make([]string, 0)
+			for j := 0; j < field.Len(); j++ {
+				values = append(values, fmt.Sprintf("%v", field.Index(j).Interface()))
+			}
+			env[envName] = strings.Join(values, ",")
+		case reflect.Map:
+			pairs := make([]string, 0)
+			for _, eachKey := range field.MapKeys() {
+				pairs = append(pairs, fmt.Sprintf("%v=%v",
+					eachKey.Interface(),
+					field.MapIndex(eachKey).Interface()))
+			}
+			sort.Strings(pairs)
+			env[envName] = strings.Join(pairs, ",")
+		default:
+			env[envName] = fmt.Sprintf("%v", field.Interface())
+		}
+	}
+}
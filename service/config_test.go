@@ -0,0 +1,54 @@
+package service_test
+
+import (
+	"os"
+	"testing"
+
+	"github.com/mweagle/SpartaGeekwire/service"
+	"github.com/mweagle/SpartaGeekwire/service/servicetest"
+)
+
+// TestPublishedConfig checks that each function's published sections
+// load, including the sections their validation compares them with
+func TestPublishedConfig(t *testing.T) {
+	testCases := []struct {
+		name      string
+		configure func(config *service.Config)
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "smaller validation limit",
+			configure: func(config *service.Config) {
+				config.Validation.MaxSizeBytes = 10 * 1024 * 1024
+				config.Uploads.MultipartMaxSizeBytes = 10 * 1024 * 1024
+			},
+		},
+		{
+			name: "smaller normalization limit",
+			configure: func(config *service.Config) {
+				config.Normalization.MaxDimensionPixels = 800
+				config.Annotation.MaxDimensionPixels = 800
+			},
+		},
+	}
+	for _, eachTestCase := range testCases {
+		config := servicetest.NewConfig()
+		if eachTestCase.configure != nil {
+			eachTestCase.configure(config)
+		}
+		for eachFunction, eachSections := range service.LambdaConfigSections {
+			t.Run(eachTestCase.name+"/"+eachFunction, func(t *testing.T) {
+				os.Unsetenv(service.EnvConfigPath)
+				for eachKey, eachValue := range config.Environment(eachSections...) {
+					t.Setenv(eachKey, eachValue)
+				}
+				_, loadErr := service.LoadConfig("")
+				if loadErr != nil {
+					t.Errorf("Failed to load %v: %s", eachSections, loadErr)
+				}
+			})
+		}
+	}
+}
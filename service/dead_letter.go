@@ -0,0 +1,228 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+// DeadLetter is an S3 event that a stage failed to process
+type DeadLetter struct {
+	ID       string                 `json:"id"`
+	Received time.Time              `json:"received"`
+	Error    string                 `json:"error,omitempty"`
+	Event    awsLamdaEvents.S3Event `json:"event"`
+	// receipt identifies the dead letter to the source for deletion
+	receipt string
+	// invalid is the error parsing the dead letter, which can't be
+	// replayed
+	invalid error
+}
+
+// DeadLetterSource provides the captured dead letters
+type DeadLetterSource interface {
+	// Receive returns the next batch of dead letters. An empty batch means
+	// the source is drained.
+	Receive(ctx context.Context) ([]*DeadLetter, error)
+	// Delete removes a dead letter that was successfully replayed
+	Delete(ctx context.Context, deadLetter *DeadLetter) error
+}
+
+// SQSAPI is the subset of the SQS client the dead letter queue
+// source depends on
+type SQSAPI interface {
+	ReceiveMessageWithContext(ctx aws.Context,
+		input *sqs.ReceiveMessageInput,
+		opts ...request.Option) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessageWithContext(ctx aws.Context,
+		input *sqs.DeleteMessageInput,
+		opts ...request.Option) (*sqs.DeleteMessageOutput, error)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// SQS
+
+// sqsDeadLetterSource reads the messages Lambda publishes to the dead
+// letter queue. The message body is the original S3 event.
+type sqsDeadLetterSource struct {
+	sqsSvc   SQSAPI
+	queueURL string
+	seen     map[string]bool
+}
+
+// NewSQSDeadLetterSource returns a DeadLetterSource backed by the queue
+func NewSQSDeadLetterSource(sqsSvc SQSAPI, queueURL string) DeadLetterSource {
+	return &sqsDeadLetterSource{
+		sqsSvc:   sqsSvc,
+		queueURL: queueURL,
+		seen:     make(map[string]bool),
+	}
+}
+
+func (source *sqsDeadLetterSource) Receive(ctx context.Context) ([]*DeadLetter, error) {
+	receiveInput := &sqs.ReceiveMessageInput{
+		QueueUrl:              aws.String(source.queueURL),
+		MaxNumberOfMessages:   aws.Int64(10),
+		WaitTimeSeconds:       aws.Int64(1),
+		AttributeNames:        []*string{aws.String(sqs.MessageSystemAttributeNameSentTimestamp)},
+		MessageAttributeNames: []*string{aws.String("All")},
+	}
+	receiveOutput, receiveErr := source.sqsSvc.ReceiveMessageWithContext(ctx, receiveInput)
+	if receiveErr != nil {
+		return nil, errors.Wrapf(receiveErr, "Failed to receive dead letters")
+	}
+	deadLetters := make([]*DeadLetter, 0)
+	for _, eachMessage := range receiveOutput.Messages {
+		messageID := aws.StringValue(eachMessage.MessageId)
+		// Messages that were filtered out become visible again, so stop
+		// once we only see messages we've already considered
+		if source.seen[messageID] {
+			continue
+		}
+		source.seen[messageID] = true
+		deadLetter := &DeadLetter{
+			ID:      messageID,
+			receipt: aws.StringValue(eachMessage.ReceiptHandle),
+		}
+		unmarshalErr := json.Unmarshal([]byte(aws.StringValue(eachMessage.Body)), &deadLetter.Event)
+		if unmarshalErr != nil {
+			deadLetter.invalid = errors.Wrapf(unmarshalErr, "Failed to parse dead letter: %s", messageID)
+		}
+		sentTimestamp := eachMessage.Attributes[sqs.MessageSystemAttributeNameSentTimestamp]
+		sentMillis, sentMillisErr := strconv.ParseInt(aws.StringValue(sentTimestamp), 10, 64)
+		if sentMillisErr == nil {
+			deadLetter.Received = time.Unix(0, sentMillis*int64(time.Millisecond)).UTC()
+		}
+		errorMessage, exists := eachMessage.MessageAttributes["ErrorMessage"]
+		if exists {
+			deadLetter.Error = aws.StringValue(errorMessage.StringValue)
+		}
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	return deadLetters, nil
+}
+
+func (source *sqsDeadLetterSource) Delete(ctx context.Context, deadLetter *DeadLetter) error {
+	_, deleteErr := source.sqsSvc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(source.queueURL),
+		ReceiptHandle: aws.String(deadLetter.receipt),
+	})
+	if deleteErr != nil {
+		return errors.Wrapf(deleteErr, "Failed to delete dead letter: %s", deadLetter.ID)
+	}
+	return nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Directory
+
+// directoryDeadLetterSource reads dead letters stored as JSON files. Each
+// file is either a DeadLetter document or a bare S3 event, such as a
+// message body copied from the queue.
+type directoryDeadLetterSource struct {
+	dir     string
+	drained bool
+}
+
+// NewDirectoryDeadLetterSource returns a DeadLetterSource backed by the
+// JSON files in dir
+func NewDirectoryDeadLetterSource(dir string) DeadLetterSource {
+	return &directoryDeadLetterSource{
+		dir: dir,
+	}
+}
+
+func (source *directoryDeadLetterSource) Receive(ctx context.Context) ([]*DeadLetter, error) {
+	// Every file is returned in the first batch
+	if source.drained {
+		return nil, nil
+	}
+	source.drained = true
+	fileInfos, readDirErr := ioutil.ReadDir(source.dir)
+	if os.IsNotExist(readDirErr) {
+		return nil, nil
+	} else if readDirErr != nil {
+		return nil, errors.Wrapf(readDirErr, "Failed to read dead letter directory")
+	}
+	deadLetters := make([]*DeadLetter, 0)
+	for _, eachFileInfo := range fileInfos {
+		if eachFileInfo.IsDir() || !strings.HasSuffix(eachFileInfo.Name(), ".json") {
+			continue
+		}
+		filePath := filepath.Join(source.dir, eachFileInfo.Name())
+		fileData, fileDataErr := ioutil.ReadFile(filePath)
+		if fileDataErr != nil {
+			return nil, errors.Wrapf(fileDataErr, "Failed to read dead letter")
+		}
+		deadLetter := &DeadLetter{}
+		unmarshalErr := json.Unmarshal(fileData, deadLetter)
+		if unmarshalErr == nil && len(deadLetter.Event.Records) == 0 {
+			unmarshalErr = json.Unmarshal(fileData, &deadLetter.Event)
+		}
+		if unmarshalErr != nil {
+			deadLetter.invalid = errors.Wrapf(unmarshalErr, "Failed to parse dead letter: %s", filePath)
+		}
+		if deadLetter.ID == "" {
+			deadLetter.ID = strings.TrimSuffix(eachFileInfo.Name(), ".json")
+		}
+		if deadLetter.Received.IsZero() {
+			deadLetter.Received = eachFileInfo.ModTime().UTC()
+		}
+		deadLetter.receipt = filePath
+		deadLetters = append(deadLetters, deadLetter)
+	}
+	sort.Slice(deadLetters, func(i, j int) bool {
+		return deadLetters[i].Received.Before(deadLetters[j].Received)
+	})
+	return deadLetters, nil
+}
+
+func (source *directoryDeadLetterSource) Delete(ctx context.Context, deadLetter *DeadLetter) error {
+	removeErr := os.Remove(deadLetter.receipt)
+	if removeErr != nil && !os.IsNotExist(removeErr) {
+		return errors.Wrapf(removeErr, "Failed to delete dead letter: %s", deadLetter.ID)
+	}
+	return nil
+}
+
+// writeDeadLetter saves the event the stage failed to process to dir so
+// that it can be replayed by a directory DeadLetterSource
+func writeDeadLetter(dir string,
+	stageName string,
+	event awsLamdaEvents.S3Event,
+	stageErr error) error {
+	mkdirErr := os.MkdirAll(dir, os.ModePerm)
+	if mkdirErr != nil {
+		return errors.Wrapf(mkdirErr, "Failed to create dead letter directory")
+	}
+	now := time.Now().UTC()
+	deadLetter := &DeadLetter{
+		ID:       fmt.Sprintf("%s-%s", now.Format("20060102T150405.000000000"), stageName),
+		Received: now,
+		Error:    stageErr.Error(),
+		Event:    event,
+	}
+	jsonData, jsonDataErr := json.MarshalIndent(deadLetter, "", "  ")
+	if jsonDataErr != nil {
+		return errors.Wrapf(jsonDataErr, "Failed to marshal dead letter")
+	}
+	outputPath := filepath.Join(dir, deadLetter.ID+".json")
+	writeErr := ioutil.WriteFile(outputPath, jsonData, 0644)
+	if writeErr != nil {
+		return errors.Wrapf(writeErr, "Failed to write dead letter")
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package service
+
+import (
+	"context"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+)
+
+// The handler tests use the servicetest fakes, which import this package,
+// so they're in the external service_test package. These expose the
+// unexported handlers to them.
+
+// NewTestService returns a service that uses the given clients
+func NewTestService(config *Config, clients *Clients) *ServicefulService {
+	return newServicefulService(config, clients)
+}
+
+// OnS3PutValidateImage runs the ValidateImage handler
+func (gws *ServicefulService) OnS3PutValidateImage(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	return gws.onS3PutValidateImage(ctx, s3Event)
+}
+
+// OnS3PutUploadEvent runs the RekognitionRelay handler
+func (gws *ServicefulService) OnS3PutUploadEvent(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	return gws.onS3PutUploadEvent(ctx, s3Event)
+}
+
+// OnS3PutCallPolly runs the PollyRelay handler
+func (gws *ServicefulService) OnS3PutCallPolly(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	return gws.onS3PutCallPolly(ctx, s3Event)
+}
+
+// OnS3PutGenerateSummary runs the GenerateSummary handler
+func (gws *ServicefulService) OnS3PutGenerateSummary(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	return gws.onS3PutGenerateSummary(ctx, s3Event)
+}
+
+// OnFeedbackDetectSentiment runs the FeedbackDetectSentiment handler
+func (gws *ServicefulService) OnFeedbackDetectSentiment(ctx context.Context,
+	apigRequest FeedbackRequest) (interface{}, error) {
+	return gws.onFeedbackDetectSentiment(ctx, apigRequest)
+}
+
+// LambdaConfigSections are the configuration sections each function is
+// published
+var LambdaConfigSections = lambdaConfigSections
+
+// CheckTriggerGraph returns the trigger graph problems of the pipeline
+// the configuration defines
+func CheckTriggerGraph(config *Config) error {
+	_, graphErr := pipelineTriggerGraph(config)
+	return graphErr
+}
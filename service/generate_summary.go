@@ -9,12 +9,47 @@ import (
 	"github.com/aws/aws-sdk-go/service/rekognition"
 	sparta "github.com/mweagle/Sparta"
 	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
 type summaryInfo struct {
-	Rekognition *rekognition.DetectLabelsOutput `json:"rekognition"`
-	Polly       []byte                          `json:"polly"`
+	Status       string                          `json:"status"`
+	Upload       *UploadMetadata                 `json:"upload,omitempty"`
+	ThumbnailURL string                          `json:"thumbnail_url,omitempty"`
+	AnnotatedURL string                          `json:"annotated_url,omitempty"`
+	Checksum     *UploadChecksum                 `json:"checksum,omitempty"`
+	Rekognition  *rekognition.DetectLabelsOutput `json:"rekognition,omitempty"`
+	// Labels are the normalized labels, most confident first
+	Labels []*rankedLabel `json:"labels,omitempty"`
+	// The optional analyses are included when they're enabled
+	Text        *rekognition.DetectTextOutput             `json:"text,omitempty"`
+	Moderation  *rekognition.DetectModerationLabelsOutput `json:"moderation,omitempty"`
+	Faces       *rekognition.DetectFacesOutput            `json:"faces,omitempty"`
+	Celebrities *rekognition.RecognizeCelebritiesOutput   `json:"celebrities,omitempty"`
+	// FaceCount and CelebrityCount replace the faces and celebrities
+	// responses unless rekognition.publishIdentities is set
+	FaceCount      *int              `json:"face_count,omitempty"`
+	CelebrityCount *int              `json:"celebrity_count,omitempty"`
+	Polly          []byte            `json:"polly,omitempty"`
+	Failure        *stageFailure     `json:"failure,omitempty"`
+	Rejection      *contentRejection `json:"rejection,omitempty"`
+}
+
+// redactIdentities replaces the faces and celebrities responses, which
+// describe the people in the image, with their counts. The report is
+// public.
+func (summary *summaryInfo) redactIdentities() {
+	if summary.Faces != nil {
+		faceCount := len(summary.Faces.FaceDetails)
+		summary.FaceCount = &faceCount
+		summary.Faces = nil
+	}
+	if summary.Celebrities != nil {
+		celebrityCount := len(summary.Celebrities.CelebrityFaces)
+		summary.CelebrityCount = &celebrityCount
+		summary.Celebrities = nil
+	}
 }
 
 /*
@@ -32,55 +67,93 @@ func (gws *ServicefulService) onS3PutGenerateSummary(ctx context.Context, s3Even
 	handler := func(ctx context.Context, event awsLamdaEvents.S3EventRecord) (interface{}, error) {
 		// Super - what's the base name?
 		baseName := gws.baseKeyname(event.S3.Object.Key)
-
-		// Get the rekognition data
-		keyPath := fmt.Sprintf("%s/%s",
-			gws.connections.S3KeyspaceRekognitionArtifacts,
+		outputKey := fmt.Sprintf("%s/%s",
+			gws.connections.S3KeyspaceConsolidatedStatus,
 			baseName)
-
-		rekognitionData, rekognitionDataErr := gws.getS3Object(ctx,
-			event.S3.Bucket.Name,
-			keyPath)
-		if rekognitionDataErr != nil {
-			return nil, rekognitionDataErr
+		if gws.isFresh(ctx, event, outputKey) {
+			return &stageSkipped{Key: outputKey}, nil
 		}
 
-		rekognitionResponse := rekognition.DetectLabelsOutput{}
-		unmarshalErr := json.Unmarshal(rekognitionData, &rekognitionResponse)
-		if unmarshalErr != nil {
-			return nil, unmarshalErr
+		// Get the rekognition data for each enabled analysis
+		summary := summaryInfo{
+			Status: summaryStatusComplete,
+		}
+		for _, eachAnalysis := range gws.enabledRekognitionAnalyses() {
+			keyPath := fmt.Sprintf("%s/%s",
+				gws.rekognitionKeyspace(eachAnalysis.name),
+				baseName)
+			rekognitionData, rekognitionDataErr := gws.getObject(ctx,
+				event.S3.Bucket.Name,
+				keyPath)
+			if rekognitionDataErr != nil {
+				return nil, rekognitionDataErr
+			}
+			unmarshalErr := json.Unmarshal(rekognitionData,
+				eachAnalysis.summaryField(&summary))
+			if unmarshalErr != nil {
+				return nil, errors.Wrapf(unmarshalErr, "Failed to parse %s", keyPath)
+			}
+		}
+		if !gws.config.Rekognition.PublishIdentities {
+			summary.redactIdentities()
 		}
 		// Then get the Polly data....
-		keyPath = fmt.Sprintf("%s/%s",
+		keyPath := fmt.Sprintf("%s/%s",
 			gws.connections.S3KeyspacePollyArtifacts,
 			baseName)
-		pollyData, pollyDataErr := gws.getS3Object(ctx,
+		pollyData, pollyDataErr := gws.getObject(ctx,
 			event.S3.Bucket.Name,
 			keyPath)
 		if pollyDataErr != nil {
 			return nil, pollyDataErr
 		}
+		uploadMetadata, uploadMetadataErr := gws.getUploadMetadata(ctx,
+			event.S3.Bucket.Name,
+			baseName)
+		if uploadMetadataErr != nil {
+			return nil, uploadMetadataErr
+		}
+		var checksum *UploadChecksum
+		if uploadMetadata != nil && uploadMetadata.Checksum != nil {
+			verifiedChecksum, verifiedChecksumErr := gws.verifyUploadChecksum(ctx,
+				event.S3.Bucket.Name,
+				baseName,
+				uploadMetadata.Checksum)
+			if verifiedChecksumErr != nil {
+				return nil, verifiedChecksumErr
+			}
+			checksum = verifiedChecksum
+		}
+		// The annotated image is optional, so the report doesn't fail
+		// without it. The failure is recorded in the job status instead.
+		annotateErr := gws.annotateUpload(ctx, event, baseName)
+		gws.recordStepFailure(ctx, event.S3.Bucket.Name, baseName, "AnnotateImage", annotateErr)
+		if annotateErr == nil {
+			summary.AnnotatedURL = gws.annotatedURL(event.S3.Bucket.Name, baseName)
+		}
 		// And Base64Encode the Polly Data, which is implicit since it's a
 		// []byte in the struct
-		summary := summaryInfo{
-			Rekognition: &rekognitionResponse,
-			Polly:       pollyData,
-		}
-		outputKey := fmt.Sprintf("%s/%s",
-			gws.connections.S3KeyspaceConsolidatedStatus,
-			baseName)
-
-		tags := map[string]string{
-			tagNameAccess: tagAccessPublic,
+		summary.Labels = gws.rankLabels(summary.Rekognition)
+		summary.Upload = uploadMetadata.redacted()
+		summary.ThumbnailURL = gws.thumbnailURL(event.S3.Bucket.Name, baseName)
+		summary.Checksum = checksum
+		summary.Polly = pollyData
+		putOptions := &PutOptions{
+			Tags: map[string]string{
+				tagNameAccess: tagAccessPublic,
+			},
+			Metadata: sourceMetadata(event),
 		}
-		putErr := gws.putJSONObjectToS3(ctx,
+		putErr := gws.putJSONObject(ctx,
 			event.S3.Bucket.Name,
 			outputKey,
 			&summary,
-			tags)
+			putOptions)
 		return nil, putErr
 	}
-	handleResult, handleErr := gws.handleS3Records(ctx, s3Event, handler)
+	handleResult, handleErr := gws.handleS3Records(ctx,
+		s3Event,
+		gws.withJobStatus("GenerateSummary", JobStateComplete, handler))
 	logger.WithField("Results", handleResult).Info("S3 event results")
 	return handleErr
 }
@@ -141,10 +214,12 @@ func (gws *ServicefulService) newOnS3PutGenerateSummary(api *sparta.API) *sparta
 	lambdaFn := sparta.HandleAWSLambda("GenerateSummary",
 		gws.onS3PutGenerateSummary,
 		sparta.IAMRoleDefinition{})
+	// Decoding the normalized image for the annotated copy needs the
+	// memory, and the CPU that comes with it
 	lambdaFn.Options = &sparta.LambdaFunctionOptions{
 		Description: "Produce a consolidated processing report",
-		MemorySize:  256,
-		Timeout:     10,
+		MemorySize:  1024,
+		Timeout:     30,
 		TracingConfig: &gocf.LambdaFunctionTracingConfig{
 			Mode: gocf.String("Active"),
 		},
@@ -156,8 +231,12 @@ func (gws *ServicefulService) newOnS3PutGenerateSummary(api *sparta.API) *sparta
 	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
 
 	// Event Triggers
-	lambdaFn.Permissions = append(lambdaFn.Permissions,
-		gws.s3NotificationPrefixBasedPermission(gws.connections.S3KeyspacePollyArtifacts))
+	gws.subscribeS3Prefix(lambdaFn,
+		"GenerateSummary",
+		gws.connections.S3KeyspacePollyArtifacts,
+		gws.onS3PutGenerateSummary,
+		gws.connections.S3KeyspaceConsolidatedStatus,
+		gws.connections.S3KeyspaceAnnotated)
 
 	// Add the decorator so that the assets we publish are marked as public
 	lambdaFn.Decorators = append(lambdaFn.Decorators,
@@ -0,0 +1,710 @@
+package service_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	awsLambdaContext "github.com/aws/aws-lambda-go/lambdacontext"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/mweagle/SpartaGeekwire/service"
+	"github.com/mweagle/SpartaGeekwire/service/servicetest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	testUploadID   = "01J9Z3X8Q4R7M2N5P6T8V0W1YZ"
+	testSourceETag = "0123456789abcdef0123456789abcdef"
+)
+
+// testHarness is a service backed by the servicetest fakes
+type testHarness struct {
+	t       *testing.T
+	config  *service.Config
+	fakes   *servicetest.Fakes
+	service *service.ServicefulService
+	ctx     context.Context
+}
+
+func newTestHarness(t *testing.T, configure func(config *service.Config)) *testHarness {
+	config := servicetest.NewConfig()
+	if configure != nil {
+		configure(config)
+	}
+	fakes := servicetest.NewFakes()
+	logger := logrus.New()
+	logger.Out = ioutil.Discard
+	return &testHarness{
+		t:       t,
+		config:  config,
+		fakes:   fakes,
+		service: service.NewTestService(config, fakes.Clients()),
+		ctx:     servicetest.Context(logger),
+	}
+}
+
+// key returns the test upload's key in the keyspace
+func (harness *testHarness) key(keyspace string) string {
+	return fmt.Sprintf("%s/%s", keyspace, testUploadID)
+}
+
+func (harness *testHarness) labelsKey() string {
+	return harness.key(harness.config.Connections.S3KeyspaceRekognitionArtifacts + "/labels")
+}
+
+func (harness *testHarness) moderationKey() string {
+	return harness.key(harness.config.Connections.S3KeyspaceRekognitionArtifacts + "/moderation")
+}
+
+// put stores the value, marshalled to JSON unless it's a []byte
+func (harness *testHarness) put(key string, value interface{}) {
+	data, isBytes := value.([]byte)
+	if !isBytes {
+		var dataErr error
+		data, dataErr = json.Marshal(value)
+		if dataErr != nil {
+			harness.t.Fatalf("Failed to marshal %s: %s", key, dataErr)
+		}
+	}
+	putErr := harness.fakes.Blobs.Put(harness.ctx, servicetest.BucketName, key, data, nil)
+	if putErr != nil {
+		harness.t.Fatalf("Failed to put %s: %s", key, putErr)
+	}
+}
+
+func (harness *testHarness) exists(key string) bool {
+	_, headErr := harness.fakes.Blobs.Head(harness.ctx, servicetest.BucketName, key)
+	return headErr == nil
+}
+
+func (harness *testHarness) get(key string) []byte {
+	data, dataErr := harness.fakes.Blobs.Get(harness.ctx, servicetest.BucketName, key)
+	if dataErr != nil {
+		harness.t.Fatalf("Failed to get %s: %s", key, dataErr)
+	}
+	return data
+}
+
+func (harness *testHarness) getJSON(key string, value interface{}) {
+	unmarshalErr := json.Unmarshal(harness.get(key), value)
+	if unmarshalErr != nil {
+		harness.t.Fatalf("Failed to parse %s: %s", key, unmarshalErr)
+	}
+}
+
+// event returns the notification S3 delivers for the key
+func (harness *testHarness) event(key string) awsLamdaEvents.S3Event {
+	record := awsLamdaEvents.S3EventRecord{}
+	record.S3.Bucket.Name = servicetest.BucketName
+	record.S3.Object.Key = key
+	record.S3.Object.ETag = testSourceETag
+	return awsLamdaEvents.S3Event{
+		Records: []awsLamdaEvents.S3EventRecord{record},
+	}
+}
+
+// summary is the subset of the consolidated report the tests check
+type summary struct {
+	Status       string `json:"status"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	AnnotatedURL string `json:"annotated_url"`
+	Polly        []byte `json:"polly"`
+	Labels       []struct {
+		Name string `json:"name"`
+	} `json:"labels"`
+	Upload *struct {
+		Title    string `json:"title"`
+		Filename string `json:"filename"`
+		Subject  string `json:"subject"`
+	} `json:"upload"`
+	Faces          json.RawMessage `json:"faces"`
+	Celebrities    json.RawMessage `json:"celebrities"`
+	FaceCount      *int            `json:"face_count"`
+	CelebrityCount *int            `json:"celebrity_count"`
+	Failure        *struct {
+		ErrorClass string `json:"error_class"`
+		Message    string `json:"message"`
+		Attempts   int    `json:"attempts"`
+	} `json:"failure"`
+}
+
+func (harness *testHarness) summary() *summary {
+	report := &summary{}
+	harness.getJSON(harness.key(harness.config.Connections.S3KeyspaceConsolidatedStatus), report)
+	return report
+}
+
+// jpegImage returns an encoded blank image
+func jpegImage(t *testing.T) []byte {
+	var output bytes.Buffer
+	encodeErr := jpeg.Encode(&output, image.NewGray(image.Rect(0, 0, 100, 100)), nil)
+	if encodeErr != nil {
+		t.Fatalf("Failed to encode image: %s", encodeErr)
+	}
+	return output.Bytes()
+}
+
+func label(name string, confidence float64, parents ...string) *rekognition.Label {
+	detected := &rekognition.Label{
+		Name:       aws.String(name),
+		Confidence: aws.Float64(confidence),
+	}
+	for _, eachParent := range parents {
+		detected.Parents = append(detected.Parents, &rekognition.Parent{
+			Name: aws.String(eachParent),
+		})
+	}
+	return detected
+}
+
+func TestOnS3PutValidateImage(t *testing.T) {
+	testCases := []struct {
+		name        string
+		configure   func(config *service.Config)
+		upload      func(t *testing.T) []byte
+		wantMessage string
+	}{
+		{
+			name:   "accepts the image",
+			upload: jpegImage,
+		},
+		{
+			name: "reports why a small image was rejected",
+			configure: func(config *service.Config) {
+				config.Validation.MinDimensionPixels = 200
+			},
+			upload:      jpegImage,
+			wantMessage: "The image is 100x100 pixels. Images must be at least 200 pixels on each side.",
+		},
+		{
+			name: "reports why a document was rejected",
+			upload: func(t *testing.T) []byte {
+				return []byte("Not an image")
+			},
+			wantMessage: "The upload appears to be text/plain, which isn't a JPEG or PNG image",
+		},
+	}
+	for _, eachCase := range testCases {
+		t.Run(eachCase.name, func(t *testing.T) {
+			harness := newTestHarness(t, eachCase.configure)
+			uploadKey := harness.key(harness.config.Connections.S3KeyspaceUploads)
+			harness.put(uploadKey, eachCase.upload(t))
+			handlerErr := harness.service.OnS3PutValidateImage(harness.ctx, harness.event(uploadKey))
+			validationKey := harness.key(harness.config.Connections.S3KeyspaceValidations)
+			if eachCase.wantMessage == "" {
+				if handlerErr != nil {
+					t.Fatalf("Unexpected error: %s", handlerErr)
+				}
+				if !harness.exists(validationKey) {
+					t.Errorf("Validation artifact wasn't written")
+				}
+				return
+			}
+			if harness.exists(validationKey) || harness.exists(uploadKey) {
+				t.Errorf("Rejected upload wasn't quarantined")
+			}
+			report := harness.summary()
+			if report.Status != "failed" || report.Failure == nil {
+				t.Fatalf("Unexpected status: %s", report.Status)
+			}
+			if report.Failure.ErrorClass != "InvalidImage" ||
+				report.Failure.Message != eachCase.wantMessage {
+				t.Errorf("Unexpected failure: %+v", report.Failure)
+			}
+		})
+	}
+}
+
+func TestOnS3PutUploadEvent(t *testing.T) {
+	flagged := &rekognition.DetectModerationLabelsOutput{
+		ModerationLabels: []*rekognition.ModerationLabel{
+			&rekognition.ModerationLabel{
+				Name:       aws.String("Graphic Violence Or Gore"),
+				ParentName: aws.String("Violence"),
+				Confidence: aws.Float64(95),
+			},
+		},
+	}
+	testCases := []struct {
+		name      string
+		configure func(config *service.Config)
+		setup     func(harness *testHarness)
+		wantErr   bool
+		check     func(t *testing.T, harness *testHarness)
+	}{
+		{
+			name: "writes the labels and moderation artifacts",
+			check: func(t *testing.T, harness *testHarness) {
+				labels := &rekognition.DetectLabelsOutput{}
+				harness.getJSON(harness.labelsKey(), labels)
+				if len(labels.Labels) != 1 || aws.StringValue(labels.Labels[0].Name) != "Dog" {
+					t.Errorf("Unexpected labels: %v", labels.Labels)
+				}
+				if !harness.exists(harness.moderationKey()) {
+					t.Errorf("Moderation artifact wasn't written")
+				}
+			},
+		},
+		{
+			name: "writes the optional analyses",
+			configure: func(config *service.Config) {
+				config.Rekognition.Analyses = []string{"labels", "text"}
+			},
+			setup: func(harness *testHarness) {
+				harness.fakes.Rekognition.TextOutput = &rekognition.DetectTextOutput{
+					TextDetections: []*rekognition.TextDetection{
+						&rekognition.TextDetection{DetectedText: aws.String("GEEKWIRE")},
+					},
+				}
+			},
+			check: func(t *testing.T, harness *testHarness) {
+				text := &rekognition.DetectTextOutput{}
+				harness.getJSON(harness.key(harness.config.Connections.S3KeyspaceRekognitionArtifacts+"/text"), text)
+				if len(text.TextDetections) != 1 {
+					t.Errorf("Unexpected text: %v", text.TextDetections)
+				}
+			},
+		},
+		{
+			name: "skips analyses whose artifacts are current",
+			setup: func(harness *testHarness) {
+				runErr := harness.service.OnS3PutUploadEvent(harness.ctx,
+					harness.event(harness.key(harness.config.Connections.S3KeyspaceNormalized)))
+				if runErr != nil {
+					harness.t.Fatalf("Failed to run the first delivery: %s", runErr)
+				}
+				harness.fakes.Rekognition.Err = errors.New("Rekognition shouldn't be called")
+			},
+		},
+		{
+			name: "rejects flagged uploads",
+			setup: func(harness *testHarness) {
+				uploadKey := harness.key(harness.config.Connections.S3KeyspaceUploads) + ".jpg"
+				harness.put(uploadKey, []byte("image"))
+				harness.put(harness.key(harness.config.Connections.S3KeyspaceValidations),
+					map[string]string{"key": uploadKey})
+				harness.fakes.Rekognition.ModerationOutput = flagged
+			},
+			check: func(t *testing.T, harness *testHarness) {
+				if harness.exists(harness.labelsKey()) {
+					t.Errorf("Labels were detected for a rejected upload")
+				}
+				if !harness.exists(harness.key(harness.config.Connections.S3KeyspaceQuarantine)) {
+					t.Errorf("Upload wasn't quarantined")
+				}
+				if status := harness.summary().Status; status != "rejected" {
+					t.Errorf("Unexpected status: %s", status)
+				}
+			},
+		},
+		{
+			name: "doesn't moderate when the gate is disabled",
+			configure: func(config *service.Config) {
+				config.Moderation.Enabled = false
+			},
+			setup: func(harness *testHarness) {
+				harness.fakes.Rekognition.ModerationOutput = flagged
+			},
+			check: func(t *testing.T, harness *testHarness) {
+				if !harness.exists(harness.labelsKey()) {
+					t.Errorf("Labels weren't written")
+				}
+				if harness.exists(harness.moderationKey()) {
+					t.Errorf("Moderation artifact was written")
+				}
+			},
+		},
+		{
+			name: "returns Rekognition errors",
+			setup: func(harness *testHarness) {
+				harness.fakes.Rekognition.Err = errors.New("Rekognition is unavailable")
+			},
+			wantErr: true,
+			check: func(t *testing.T, harness *testHarness) {
+				if harness.exists(harness.labelsKey()) {
+					t.Errorf("Labels were written")
+				}
+			},
+		},
+	}
+	for _, eachCase := range testCases {
+		t.Run(eachCase.name, func(t *testing.T) {
+			harness := newTestHarness(t, eachCase.configure)
+			harness.fakes.Rekognition.Output = &rekognition.DetectLabelsOutput{
+				Labels: []*rekognition.Label{label("Dog", 97)},
+			}
+			if eachCase.setup != nil {
+				eachCase.setup(harness)
+			}
+			runErr := harness.service.OnS3PutUploadEvent(harness.ctx,
+				harness.event(harness.key(harness.config.Connections.S3KeyspaceNormalized)))
+			if (runErr != nil) != eachCase.wantErr {
+				t.Fatalf("Unexpected error: %v", runErr)
+			}
+			if eachCase.check != nil {
+				eachCase.check(t, harness)
+			}
+		})
+	}
+}
+
+func TestOnS3PutCallPolly(t *testing.T) {
+	testCases := []struct {
+		name         string
+		labels       []*rekognition.Label
+		setup        func(harness *testHarness)
+		wantErr      bool
+		wantTextType string
+		wantText     string
+	}{
+		{
+			name:         "narrates the most specific label",
+			labels:       []*rekognition.Label{label("Animal", 99), label("Dog", 97, "Animal")},
+			wantTextType: "ssml",
+			wantText:     "Dog",
+		},
+		{
+			name:         "narrates the renamed label",
+			labels:       []*rekognition.Label{label("Canine", 90)},
+			wantTextType: "ssml",
+			wantText:     "Dog",
+		},
+		{
+			name:         "refers to the upload by its title",
+			labels:       []*rekognition.Label{label("Dog", 97)},
+			wantTextType: "ssml",
+			wantText:     "your photo Rover",
+			setup: func(harness *testHarness) {
+				harness.put(harness.key(harness.config.Connections.S3KeyspaceUploadMetadata),
+					&service.UploadMetadata{UploadID: testUploadID, Title: "Rover"})
+			},
+		},
+		{
+			name:         "says when nothing was found",
+			wantTextType: "text",
+			wantText:     "didn't find anything",
+		},
+		{
+			name:   "returns Polly errors",
+			labels: []*rekognition.Label{label("Dog", 97)},
+			setup: func(harness *testHarness) {
+				harness.fakes.Polly.Err = errors.New("Polly is unavailable")
+			},
+			wantErr: true,
+		},
+	}
+	for _, eachCase := range testCases {
+		t.Run(eachCase.name, func(t *testing.T) {
+			harness := newTestHarness(t, nil)
+			harness.fakes.Polly.Audio = []byte("mp3")
+			harness.put(harness.labelsKey(), &rekognition.DetectLabelsOutput{
+				Labels: eachCase.labels,
+			})
+			if eachCase.setup != nil {
+				eachCase.setup(harness)
+			}
+			runErr := harness.service.OnS3PutCallPolly(harness.ctx,
+				harness.event(harness.labelsKey()))
+			pollyKey := harness.key(harness.config.Connections.S3KeyspacePollyArtifacts)
+			if eachCase.wantErr {
+				if runErr == nil {
+					t.Fatalf("Expected an error")
+				}
+				if harness.exists(pollyKey) {
+					t.Errorf("Narration was written")
+				}
+				return
+			}
+			if runErr != nil {
+				t.Fatalf("Unexpected error: %s", runErr)
+			}
+			if audio := string(harness.get(pollyKey)); audio != "mp3" {
+				t.Errorf("Unexpected narration: %s", audio)
+			}
+			if len(harness.fakes.Polly.Inputs) != 1 {
+				t.Fatalf("Unexpected Polly requests: %d", len(harness.fakes.Polly.Inputs))
+			}
+			input := harness.fakes.Polly.Inputs[0]
+			if aws.StringValue(input.TextType) != eachCase.wantTextType {
+				t.Errorf("Unexpected text type: %s", aws.StringValue(input.TextType))
+			}
+			if !strings.Contains(aws.StringValue(input.Text), eachCase.wantText) {
+				t.Errorf("Narration doesn't include %q: %s",
+					eachCase.wantText,
+					aws.StringValue(input.Text))
+			}
+		})
+	}
+}
+
+func TestOnS3PutGenerateSummary(t *testing.T) {
+	identities := func(harness *testHarness) {
+		artifacts := harness.config.Connections.S3KeyspaceRekognitionArtifacts
+		harness.put(harness.key(artifacts+"/faces"), &rekognition.DetectFacesOutput{
+			FaceDetails: []*rekognition.FaceDetail{
+				&rekognition.FaceDetail{Confidence: aws.Float64(99)},
+				&rekognition.FaceDetail{Confidence: aws.Float64(98)},
+			},
+		})
+		harness.put(harness.key(artifacts+"/celebrities"), &rekognition.RecognizeCelebritiesOutput{
+			CelebrityFaces: []*rekognition.Celebrity{
+				&rekognition.Celebrity{Name: aws.String("Jane Doe")},
+			},
+		})
+	}
+	enableIdentities := func(config *service.Config) {
+		config.Rekognition.Analyses = append(config.Rekognition.Analyses, "faces", "celebrities")
+	}
+	testCases := []struct {
+		name      string
+		configure func(config *service.Config)
+		setup     func(harness *testHarness)
+		check     func(t *testing.T, harness *testHarness, report *summary)
+	}{
+		{
+			name: "consolidates the artifacts",
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if report.Status != "complete" {
+					t.Errorf("Unexpected status: %s", report.Status)
+				}
+				if len(report.Labels) != 1 || report.Labels[0].Name != "Dog" {
+					t.Errorf("Unexpected labels: %v", report.Labels)
+				}
+				if string(report.Polly) != "mp3" {
+					t.Errorf("Unexpected narration: %s", report.Polly)
+				}
+				if !strings.HasSuffix(report.ThumbnailURL,
+					harness.key(harness.config.Connections.S3KeyspaceThumbnails)) {
+					t.Errorf("Unexpected thumbnail URL: %s", report.ThumbnailURL)
+				}
+				tags := harness.fakes.Blobs.Tags(servicetest.BucketName,
+					harness.key(harness.config.Connections.S3KeyspaceConsolidatedStatus))
+				if tags["access"] != "public" {
+					t.Errorf("Report isn't public: %v", tags)
+				}
+				annotatedKey := harness.key(harness.config.Connections.S3KeyspaceAnnotated)
+				if !strings.HasSuffix(report.AnnotatedURL, annotatedKey) ||
+					!harness.exists(annotatedKey) {
+					t.Errorf("Unexpected annotated URL: %s", report.AnnotatedURL)
+				}
+			},
+		},
+		{
+			name: "omits the annotated image it can't draw",
+			setup: func(harness *testHarness) {
+				deleteErr := harness.fakes.Blobs.Delete(harness.ctx,
+					servicetest.BucketName,
+					harness.key(harness.config.Connections.S3KeyspaceNormalized))
+				if deleteErr != nil {
+					harness.t.Fatalf("Failed to delete normalized image: %s", deleteErr)
+				}
+			},
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if report.Status != "complete" || report.AnnotatedURL != "" {
+					t.Errorf("Unexpected report: %s %s", report.Status, report.AnnotatedURL)
+				}
+				jobStatus := &service.JobStatus{}
+				harness.getJSON(harness.key(harness.config.Connections.S3KeyspaceJobStatus), jobStatus)
+				if len(jobStatus.Warnings) != 1 ||
+					jobStatus.Warnings[0].Stage != "AnnotateImage" ||
+					jobStatus.Warnings[0].ErrorClass != "NotFound" {
+					t.Errorf("Unexpected warnings: %+v", jobStatus.Warnings)
+				}
+				if jobStatus.State != service.JobStateComplete {
+					t.Errorf("Unexpected state: %s", jobStatus.State)
+				}
+			},
+		},
+		{
+			name:      "publishes only the number of faces and celebrities",
+			configure: enableIdentities,
+			setup:     identities,
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if report.Faces != nil || report.Celebrities != nil {
+					t.Errorf("Identities were published: %s %s", report.Faces, report.Celebrities)
+				}
+				if report.FaceCount == nil || *report.FaceCount != 2 ||
+					report.CelebrityCount == nil || *report.CelebrityCount != 1 {
+					t.Errorf("Unexpected counts: %v %v", report.FaceCount, report.CelebrityCount)
+				}
+			},
+		},
+		{
+			name: "publishes the faces and celebrities when configured",
+			configure: func(config *service.Config) {
+				enableIdentities(config)
+				config.Rekognition.PublishIdentities = true
+			},
+			setup: identities,
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if !strings.Contains(string(report.Celebrities), "Jane Doe") ||
+					!strings.Contains(string(report.Faces), "FaceDetails") {
+					t.Errorf("Identities weren't published: %s %s", report.Faces, report.Celebrities)
+				}
+			},
+		},
+		{
+			name: "includes the redacted upload metadata",
+			setup: func(harness *testHarness) {
+				harness.put(harness.key(harness.config.Connections.S3KeyspaceUploadMetadata),
+					&service.UploadMetadata{
+						UploadID: testUploadID,
+						Title:    "Rover",
+						Filename: "IMG_0001.jpg",
+						Subject:  "user-1",
+					})
+			},
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if report.Upload == nil || report.Upload.Title != "Rover" {
+					t.Errorf("Unexpected upload: %v", report.Upload)
+				} else if report.Upload.Filename != "" || report.Upload.Subject != "" {
+					t.Errorf("Upload isn't redacted: %+v", report.Upload)
+				}
+			},
+		},
+		{
+			name: "reports the failure when an artifact is missing",
+			setup: func(harness *testHarness) {
+				deleteErr := harness.fakes.Blobs.Delete(harness.ctx,
+					servicetest.BucketName,
+					harness.key(harness.config.Connections.S3KeyspacePollyArtifacts))
+				if deleteErr != nil {
+					harness.t.Fatalf("Failed to delete narration: %s", deleteErr)
+				}
+			},
+			check: func(t *testing.T, harness *testHarness, report *summary) {
+				if report.Status != "failed" || report.Failure == nil {
+					t.Fatalf("Unexpected status: %s", report.Status)
+				}
+				// The error names the missing key, which isn't published
+				if report.Failure.ErrorClass != "NotFound" ||
+					report.Failure.Message != "The upload couldn't be processed" ||
+					report.Failure.Attempts != 1 {
+					t.Errorf("Unexpected failure: %+v", report.Failure)
+				}
+			},
+		},
+	}
+	for _, eachCase := range testCases {
+		t.Run(eachCase.name, func(t *testing.T) {
+			harness := newTestHarness(t, eachCase.configure)
+			harness.put(harness.labelsKey(), &rekognition.DetectLabelsOutput{
+				Labels: []*rekognition.Label{label("Dog", 97)},
+			})
+			harness.put(harness.moderationKey(), &rekognition.DetectModerationLabelsOutput{})
+			harness.put(harness.key(harness.config.Connections.S3KeyspaceNormalized), jpegImage(t))
+			pollyKey := harness.key(harness.config.Connections.S3KeyspacePollyArtifacts)
+			harness.put(pollyKey, []byte("mp3"))
+			if eachCase.setup != nil {
+				eachCase.setup(harness)
+			}
+			// Failures are reported in the consolidated report
+			harness.service.OnS3PutGenerateSummary(harness.ctx, harness.event(pollyKey))
+			eachCase.check(t, harness, harness.summary())
+		})
+	}
+}
+
+func TestOnFeedbackDetectSentiment(t *testing.T) {
+	positive := &comprehend.DetectSentimentOutput{
+		Sentiment: aws.String(comprehend.SentimentTypePositive),
+	}
+	testCases := []struct {
+		name          string
+		configure     func(config *service.Config)
+		body          service.FeedbackBody
+		requests      int
+		comprehend    *comprehend.DetectSentimentOutput
+		comprehendErr error
+		wantErr       bool
+		wantLanguage  string
+		wantStored    int
+	}{
+		{
+			name:         "stores the sentiment",
+			body:         service.FeedbackBody{Language: "fr", Comment: "Magnifique"},
+			comprehend:   positive,
+			wantLanguage: "fr",
+			wantStored:   1,
+		},
+		{
+			name:         "defaults to English",
+			body:         service.FeedbackBody{Comment: "Great"},
+			comprehend:   positive,
+			wantLanguage: "en",
+			wantStored:   1,
+		},
+		{
+			name:          "returns Comprehend errors",
+			body:          service.FeedbackBody{Comment: "Great"},
+			comprehendErr: errors.New("Comprehend is unavailable"),
+			wantErr:       true,
+			wantLanguage:  "en",
+		},
+		{
+			name: "rate limits the client",
+			configure: func(config *service.Config) {
+				config.RateLimits.FeedbackPerMinute = 1
+			},
+			body:         service.FeedbackBody{Comment: "Great"},
+			requests:     2,
+			comprehend:   positive,
+			wantLanguage: "en",
+			wantStored:   1,
+		},
+	}
+	for _, eachCase := range testCases {
+		t.Run(eachCase.name, func(t *testing.T) {
+			harness := newTestHarness(t, eachCase.configure)
+			harness.fakes.Comprehend.Output = eachCase.comprehend
+			harness.fakes.Comprehend.Err = eachCase.comprehendErr
+			requests := eachCase.requests
+			if requests == 0 {
+				requests = 1
+			}
+			for eachRequest := 1; eachRequest <= requests; eachRequest++ {
+				ctx := awsLambdaContext.NewContext(harness.ctx, &awsLambdaContext.LambdaContext{
+					AwsRequestID: fmt.Sprintf("request-%d", eachRequest),
+				})
+				request := service.FeedbackRequest{Body: eachCase.body}
+				request.Context.Identity.SourceIP = "192.0.2.1"
+				_, runErr := harness.service.OnFeedbackDetectSentiment(ctx, request)
+				if (runErr != nil) != eachCase.wantErr {
+					t.Fatalf("Unexpected error: %v", runErr)
+				}
+			}
+			if len(harness.fakes.Comprehend.Inputs) == 0 ||
+				aws.StringValue(harness.fakes.Comprehend.Inputs[0].LanguageCode) != eachCase.wantLanguage {
+				t.Errorf("Expected a %s request", eachCase.wantLanguage)
+			}
+			stored, storedErr := harness.fakes.Blobs.List(harness.ctx,
+				servicetest.BucketName,
+				harness.config.Connections.S3KeyspaceComprehendArtifacts)
+			if storedErr != nil {
+				t.Fatalf("Failed to list feedback: %s", storedErr)
+			}
+			if len(stored) != eachCase.wantStored {
+				t.Fatalf("Unexpected feedback count: %d", len(stored))
+			}
+			if eachCase.wantStored == 0 {
+				return
+			}
+			response := &service.FeedbackResponse{}
+			harness.getJSON(stored[0].Key, response)
+			if response.Comment != eachCase.body.Comment ||
+				aws.StringValue(response.Sentiment.Sentiment) != comprehend.SentimentTypePositive {
+				t.Errorf("Unexpected feedback: %+v", response)
+			}
+		})
+	}
+}
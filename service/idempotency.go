@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+	"strings"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+// Artifact metadata that identifies the object a stage processed
+const (
+	metadataSourceETag    = "source-etag"
+	metadataSourceVersion = "source-version"
+)
+
+// forceResponseElement marks records that the replay command reprocesses
+// even if their artifacts are current. The provisioned functions don't
+// share the replay command's configuration, so it's sent with the event.
+const forceResponseElement = "x-geekwire-force"
+
+// stageSkipped is the record handler result when the stage's artifact
+// was already produced from the same source object
+type stageSkipped struct {
+	Key string `json:"key"`
+}
+
+// sourceMetadata returns the artifact metadata for the object that
+// triggered the event
+func sourceMetadata(event awsLamdaEvents.S3EventRecord) map[string]string {
+	metadata := map[string]string{
+		metadataSourceETag: strings.Trim(event.S3.Object.ETag, "\""),
+	}
+	if event.S3.Object.VersionID != "" {
+		metadata[metadataSourceVersion] = event.S3.Object.VersionID
+	}
+	return metadata
+}
+
+// isFresh returns true if the artifact at keyPath was produced from the
+// exact object that triggered the event, in which case the stage doesn't
+// need to run again. S3 delivers notifications at least once. Setting
+// pipeline.force, or forceResponseElement, disables the check.
+func (gws *ServicefulService) isFresh(ctx context.Context,
+	event awsLamdaEvents.S3EventRecord,
+	keyPath string) bool {
+	if gws.config.Pipeline.Force ||
+		event.ResponseElements[forceResponseElement] == "true" ||
+		event.S3.Object.ETag == "" {
+		return false
+	}
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	artifactInfo, artifactInfoErr := gws.clients(ctx).Blobs.Head(ctx,
+		event.S3.Bucket.Name,
+		keyPath)
+	if artifactInfoErr != nil {
+		if !IsBlobNotFound(artifactInfoErr) {
+			logger.WithField("Error", artifactInfoErr).Warn("Failed to check artifact")
+		}
+		return false
+	}
+	for eachKey, eachValue := range sourceMetadata(event) {
+		if artifactInfo.Metadata[eachKey] != eachValue {
+			return false
+		}
+	}
+	logger.WithFields(logrus.Fields{
+		"Source":   event.S3.Object.Key,
+		"Artifact": keyPath,
+	}).Info("Artifact is current, skipping")
+	return true
+}
@@ -0,0 +1,129 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// idempotencyKeyHeader is the optional header clients send so that
+	// retried requests return the original upload
+	idempotencyKeyHeader    = "Idempotency-Key"
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyRecord is the response returned for an idempotency key
+type idempotencyRecord struct {
+	// Fingerprint identifies the request parameters the key was first
+	// used with
+	Fingerprint string             `json:"fingerprint"`
+	Created     time.Time          `json:"created"`
+	Response    *presignedResponse `json:"response"`
+}
+
+// errIdempotencyKeyReused is returned when a key is reused with
+// different request parameters
+var errIdempotencyKeyReused = errors.New("Idempotency-Key was already used with different parameters")
+
+// headerValue returns the named header. API Gateway preserves the
+// client's capitalization, so the lookup is case insensitive.
+func headerValue(headers map[string]string, name string) string {
+	for eachName, eachValue := range headers {
+		if strings.EqualFold(eachName, name) {
+			return eachValue
+		}
+	}
+	return ""
+}
+
+// idempotencyKey returns the validated Idempotency-Key header, or the
+// empty string if it wasn't supplied
+func idempotencyKey(headers map[string]string) (string, error) {
+	key := strings.TrimSpace(headerValue(headers, idempotencyKeyHeader))
+	if len(key) > maxIdempotencyKeyLength {
+		return "", errors.Errorf("%s must be at most %d characters",
+			idempotencyKeyHeader,
+			maxIdempotencyKeyLength)
+	}
+	for _, eachRune := range key {
+		if eachRune < ' ' || eachRune > '~' {
+			return "", errors.Errorf("%s must be printable ASCII", idempotencyKeyHeader)
+		}
+	}
+	return key, nil
+}
+
+// requestFingerprint hashes the query parameters so that a reused key can
+// be detected
+func requestFingerprint(queryParams map[string]string) string {
+	names := make([]string, 0, len(queryParams))
+	for eachName := range queryParams {
+		names = append(names, eachName)
+	}
+	sort.Strings(names)
+	digest := sha256.New()
+	for _, eachName := range names {
+		fmt.Fprintf(digest, "%s=%s\n", eachName, queryParams[eachName])
+	}
+	return hex.EncodeToString(digest.Sum(nil))
+}
+
+// idempotencyRecordKey hashes the client's key, since it may include
+// characters that aren't safe in an S3 key
+func (gws *ServicefulService) idempotencyRecordKey(key string) string {
+	keyDigest := sha256.Sum256([]byte(key))
+	return fmt.Sprintf("%s/%s",
+		gws.connections.S3KeyspaceIdempotencyKeys,
+		hex.EncodeToString(keyDigest[:]))
+}
+
+// getIdempotentResponse returns the response previously returned for the
+// key, or nil if there isn't one within the configured window
+func (gws *ServicefulService) getIdempotentResponse(ctx context.Context,
+	bucket string,
+	key string,
+	fingerprint string) (*presignedResponse, error) {
+	recordData, recordDataErr := gws.getObject(ctx, bucket, gws.idempotencyRecordKey(key))
+	if IsBlobNotFound(recordDataErr) {
+		return nil, nil
+	} else if recordDataErr != nil {
+		return nil, recordDataErr
+	}
+	record := &idempotencyRecord{}
+	unmarshalErr := json.Unmarshal(recordData, record)
+	if unmarshalErr != nil {
+		return nil, errors.Wrapf(unmarshalErr, "Failed to parse idempotency record")
+	}
+	window := time.Duration(gws.config.Uploads.IdempotencyWindowSeconds) * time.Second
+	if time.Since(record.Created) > window {
+		return nil, nil
+	}
+	if record.Fingerprint != fingerprint {
+		return nil, errIdempotencyKeyReused
+	}
+	return record.Response, nil
+}
+
+// putIdempotentResponse saves the response for the key. Concurrent first
+// requests with the same key may both create uploads; the last one saved
+// is returned to later retries.
+func (gws *ServicefulService) putIdempotentResponse(ctx context.Context,
+	bucket string,
+	key string,
+	fingerprint string,
+	response *presignedResponse) error {
+	record := &idempotencyRecord{
+		Fingerprint: fingerprint,
+		Created:     time.Now().UTC(),
+		Response:    response,
+	}
+	return gws.putJSONObject(ctx, bucket, gws.idempotencyRecordKey(key), record, nil)
+}
@@ -0,0 +1,244 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
+	spartaEvents "github.com/mweagle/Sparta/aws/events"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+// JobState is the processing state of an upload
+type JobState string
+
+const (
+	// JobStateAwaitingUpload means a presigned URL was issued
+	JobStateAwaitingUpload JobState = "awaiting_upload"
+	// JobStateUploaded means the upload was received
+	JobStateUploaded JobState = "uploaded"
+	// JobStateValidated means the upload is an image Rekognition accepts
+	JobStateValidated JobState = "validated"
+	// JobStateNormalized means the upright JPEG and thumbnail are available
+	JobStateNormalized JobState = "normalized"
+	// JobStateLabelsDetected means Rekognition labels are available
+	JobStateLabelsDetected JobState = "labels_detected"
+	// JobStateAudioSynthesized means the Polly narration is available
+	JobStateAudioSynthesized JobState = "audio_synthesized"
+	// JobStateComplete means the consolidated report is available
+	JobStateComplete JobState = "complete"
+	// JobStateFailed means a stage failed
+	JobStateFailed JobState = "failed"
+	// JobStateRejected means the upload was flagged by content moderation
+	JobStateRejected JobState = "rejected"
+)
+
+// JobTransition is a timestamped state change
+type JobTransition struct {
+	State     JobState  `json:"state"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// JobError describes the most recent stage failure
+type JobError struct {
+	Stage      string `json:"stage"`
+	ErrorClass string `json:"error_class"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	Attempt    int    `json:"attempt"`
+}
+
+// JobStatus is the status document maintained for each upload
+type JobStatus struct {
+	ID      string          `json:"id"`
+	State   JobState        `json:"state"`
+	Created time.Time       `json:"created"`
+	Updated time.Time       `json:"updated"`
+	History []JobTransition `json:"history"`
+	Error   *JobError       `json:"error,omitempty"`
+	// Warnings describe the failures of optional steps, such as drawing
+	// the annotated image, which don't fail the job
+	Warnings []*JobError `json:"warnings,omitempty"`
+	// Attempts is the number of failed invocations of each stage
+	Attempts map[string]int `json:"attempts,omitempty"`
+}
+
+// warning returns the failure recorded for the optional step, if any
+func (jobStatus *JobStatus) warning(stepName string) *JobError {
+	for _, eachWarning := range jobStatus.Warnings {
+		if eachWarning.Stage == stepName {
+			return eachWarning
+		}
+	}
+	return nil
+}
+
+func (jobStatus *JobStatus) transition(state JobState, now time.Time) {
+	jobStatus.State = state
+	jobStatus.History = append(jobStatus.History, JobTransition{
+		State:     state,
+		Timestamp: now,
+	})
+}
+
+// uploadIDPattern matches the ULIDs uploadIDGenerator returns
+var uploadIDPattern = regexp.MustCompile("^[0-9A-HJKMNP-TV-Z]{26}$")
+
+func (gws *ServicefulService) jobStatusKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceJobStatus, uploadID)
+}
+
+// getJobStatus returns the status document for the upload
+func (gws *ServicefulService) getJobStatus(ctx context.Context,
+	bucket string,
+	uploadID string) (*JobStatus, error) {
+	statusData, statusDataErr := gws.getObject(ctx, bucket, gws.jobStatusKey(uploadID))
+	if statusDataErr != nil {
+		return nil, statusDataErr
+	}
+	jobStatus := &JobStatus{}
+	unmarshalErr := json.Unmarshal(statusData, jobStatus)
+	if unmarshalErr != nil {
+		return nil, unmarshalErr
+	}
+	return jobStatus, nil
+}
+
+// modifyJobStatus applies the modification to the upload's status
+// document. Status updates are best effort, so failures are logged
+// rather than returned. A document that can't be read is left alone,
+// rather than replaced by one without its history and attempts.
+func (gws *ServicefulService) modifyJobStatus(ctx context.Context,
+	bucket string,
+	uploadID string,
+	modify func(jobStatus *JobStatus, now time.Time)) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	now := time.Now().UTC()
+	jobStatus, jobStatusErr := gws.getJobStatus(ctx, bucket, uploadID)
+	if jobStatusErr != nil && !IsBlobNotFound(jobStatusErr) {
+		logger.WithFields(logrus.Fields{
+			"UploadID": uploadID,
+			"Error":    jobStatusErr,
+		}).Warn("Failed to read job status")
+		return
+	} else if jobStatusErr != nil {
+		jobStatus = &JobStatus{
+			ID:      uploadID,
+			Created: now,
+			History: make([]JobTransition, 0),
+		}
+	}
+	if jobStatus.Attempts == nil {
+		jobStatus.Attempts = make(map[string]int)
+	}
+	modify(jobStatus, now)
+	jobStatus.Updated = now
+
+	putErr := gws.putJSONObject(ctx, bucket, gws.jobStatusKey(uploadID), jobStatus, nil)
+	if putErr != nil {
+		logger.WithFields(logrus.Fields{
+			"UploadID": uploadID,
+			"State":    jobStatus.State,
+			"Error":    putErr,
+		}).Warn("Failed to update job status")
+	}
+}
+
+// updateJobStatus records the state transition for the upload
+func (gws *ServicefulService) updateJobStatus(ctx context.Context,
+	bucket string,
+	uploadID string,
+	state JobState) {
+	gws.modifyJobStatus(ctx, bucket, uploadID, func(jobStatus *JobStatus, now time.Time) {
+		jobStatus.transition(state, now)
+		jobStatus.Error = nil
+	})
+}
+
+// withJobStatus wraps a record handler so that the upload's status
+// advances to completedState on success. Skipped records leave the status
+// unchanged and failures are recorded by onStageFailure.
+func (gws *ServicefulService) withJobStatus(stageName string,
+	completedState JobState,
+	handler recordHandler) recordHandler {
+	return func(ctx context.Context, event awsLamdaEvents.S3EventRecord) (interface{}, error) {
+		ret, err := callRecordHandler(ctx, handler, event)
+		uploadID := gws.baseKeyname(event.S3.Object.Key)
+		_, skipped := ret.(*stageSkipped)
+		_, halted := ret.(*stageHalted)
+		if err != nil {
+			gws.onStageFailure(ctx, event.S3.Bucket.Name, uploadID, stageName, err)
+		} else if !skipped && !halted {
+			gws.updateJobStatus(ctx, event.S3.Bucket.Name, uploadID, completedState)
+		}
+		return ret, err
+	}
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Return the status document for an upload
+*/
+func (gws *ServicefulService) getJobStatusLambda(ctx context.Context,
+	apigRequest spartaEvents.APIGatewayRequest) (*JobStatus, error) {
+	uploadID := apigRequest.PathParams["id"]
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("Invalid upload ID: %s", uploadID))
+	}
+	bucketName, bucketNameErr := gws.bucketName()
+	if bucketNameErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			bucketNameErr)
+	}
+	jobStatus, jobStatusErr := gws.getJobStatus(ctx, bucketName, uploadID)
+	if IsBlobNotFound(jobStatusErr) {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusNotFound,
+			fmt.Sprintf("Unknown upload ID: %s", uploadID))
+	} else if jobStatusErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			jobStatusErr)
+	}
+	return jobStatus, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newJobStatusLambda defines a Lambda function that returns the status
+// of an upload
+func (gws *ServicefulService) newJobStatusLambda(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("JobStatusProvider",
+		gws.getJobStatusLambda,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges()
+	lambdaFn.Options.TracingConfig = &gocf.LambdaFunctionTracingConfig{
+		Mode: gocf.String("Active"),
+	}
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+	if api != nil {
+		apiGatewayResource, _ := api.NewResource("/status/{id}", lambdaFn)
+		apiMethod, apiMethodErr := apiGatewayResource.NewMethod("GET",
+			http.StatusOK,
+			http.StatusBadRequest,
+			http.StatusNotFound,
+			http.StatusInternalServerError)
+		if nil != apiMethodErr {
+			panic("Failed to create /status/{id} resource: " + apiMethodErr.Error())
+		}
+		apiMethod.Parameters["method.request.path.id"] = true
+		apiMethod.SupportedRequestContentTypes = []string{"application/json"}
+	}
+	return lambdaFn
+}
@@ -0,0 +1,365 @@
+package service
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// jwtLeeway is the allowed clock skew for the exp and nbf claims
+	jwtLeeway = time.Minute
+	// jwksMinRefreshInterval limits how often an unknown key ID refetches
+	// the JWKS document
+	jwksMinRefreshInterval = 30 * time.Second
+	maxJWKSDocumentBytes   = 1024 * 1024
+)
+
+// jwtAlgorithm is a supported JWS signature algorithm
+type jwtAlgorithm struct {
+	keyType string
+	hash    crypto.Hash
+	newHash func() hash.Hash
+}
+
+// jwtAlgorithms are the asymmetric algorithms JWKS documents publish keys
+// for. HMAC and "none" are deliberately absent.
+var jwtAlgorithms = map[string]*jwtAlgorithm{
+	"RS256": &jwtAlgorithm{keyType: "RSA", hash: crypto.SHA256, newHash: sha256.New},
+	"RS384": &jwtAlgorithm{keyType: "RSA", hash: crypto.SHA384, newHash: sha512.New384},
+	"RS512": &jwtAlgorithm{keyType: "RSA", hash: crypto.SHA512, newHash: sha512.New},
+	"ES256": &jwtAlgorithm{keyType: "EC", hash: crypto.SHA256, newHash: sha256.New},
+	"ES384": &jwtAlgorithm{keyType: "EC", hash: crypto.SHA384, newHash: sha512.New384},
+}
+
+// jwtAudience is the aud claim, which may be a string or an array
+type jwtAudience []string
+
+func (audience *jwtAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if json.Unmarshal(data, &single) == nil {
+		*audience = jwtAudience{single}
+		return nil
+	}
+	var multiple []string
+	unmarshalErr := json.Unmarshal(data, &multiple)
+	if unmarshalErr != nil {
+		return errors.Wrapf(unmarshalErr, "Invalid aud claim")
+	}
+	*audience = multiple
+	return nil
+}
+
+// jwtClaims are the registered claims the verifier checks
+type jwtClaims struct {
+	Subject   string      `json:"sub"`
+	Issuer    string      `json:"iss"`
+	Audience  jwtAudience `json:"aud"`
+	Expires   *float64    `json:"exp"`
+	NotBefore *float64    `json:"nbf"`
+}
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+// jsonWebKey is a public key in a JWKS document
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	Use     string `json:"use"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, decodeErr := base64.RawURLEncoding.DecodeString(value)
+	if decodeErr != nil || len(data) == 0 {
+		return nil, errors.New("Invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// publicKey returns the key's *rsa.PublicKey or *ecdsa.PublicKey
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.KeyType {
+	case "RSA":
+		modulus, modulusErr := decodeBigInt(key.N)
+		if modulusErr != nil {
+			return nil, modulusErr
+		}
+		exponent, exponentErr := decodeBigInt(key.E)
+		if exponentErr != nil || !exponent.IsInt64() || exponent.Int64() > 1<<31-1 {
+			return nil, errors.New("Invalid RSA exponent")
+		}
+		return &rsa.PublicKey{
+			N: modulus,
+			E: int(exponent.Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, errors.Errorf("Unsupported curve: %s", key.Curve)
+		}
+		x, xErr := decodeBigInt(key.X)
+		if xErr != nil {
+			return nil, xErr
+		}
+		y, yErr := decodeBigInt(key.Y)
+		if yErr != nil {
+			return nil, yErr
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC key isn't on its curve")
+		}
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     x,
+			Y:     y,
+		}, nil
+	}
+	return nil, errors.Errorf("Unsupported key type: %s", key.KeyType)
+}
+
+// jwksCache fetches the JWKS document and keeps its keys until they
+// expire. Tokens signed with an unknown key ID refresh it early, so that
+// rotated keys are picked up.
+type jwksCache struct {
+	mu         sync.Mutex
+	url        string
+	expiry     time.Duration
+	httpClient *http.Client
+	keys       map[string]crypto.PublicKey
+	fetched    time.Time
+}
+
+func newJWKSCache(url string, expiry time.Duration) *jwksCache {
+	return &jwksCache{
+		url:    url,
+		expiry: expiry,
+		httpClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+}
+
+// key returns the public key with the given ID
+func (cache *jwksCache) key(ctx context.Context, keyID string) (crypto.PublicKey, error) {
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+
+	age := time.Since(cache.fetched)
+	key, exists := cache.keys[keyID]
+	if exists && age < cache.expiry {
+		return key, nil
+	}
+	if age >= cache.expiry || age >= jwksMinRefreshInterval {
+		refreshErr := cache.refresh(ctx)
+		if refreshErr != nil {
+			return nil, refreshErr
+		}
+		key, exists = cache.keys[keyID]
+	}
+	if !exists {
+		return nil, errors.Errorf("Unknown key ID: %s", keyID)
+	}
+	return key, nil
+}
+
+// refresh replaces the keys with the current JWKS document's. Keys that
+// can't be used for signatures are skipped.
+func (cache *jwksCache) refresh(ctx context.Context) error {
+	request, requestErr := http.NewRequest(http.MethodGet, cache.url, nil)
+	if requestErr != nil {
+		return errors.Wrapf(requestErr, "Failed to create JWKS request")
+	}
+	response, responseErr := cache.httpClient.Do(request.WithContext(ctx))
+	if responseErr != nil {
+		return errors.Wrapf(responseErr, "Failed to fetch JWKS: %s", cache.url)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("Failed to fetch JWKS: %s returned %d", cache.url, response.StatusCode)
+	}
+	documentData, documentDataErr := ioutil.ReadAll(&io.LimitedReader{
+		R: response.Body,
+		N: maxJWKSDocumentBytes,
+	})
+	if documentDataErr != nil {
+		return errors.Wrapf(documentDataErr, "Failed to read JWKS: %s", cache.url)
+	}
+	document := struct {
+		Keys []*jsonWebKey `json:"keys"`
+	}{}
+	unmarshalErr := json.Unmarshal(documentData, &document)
+	if unmarshalErr != nil {
+		return errors.Wrapf(unmarshalErr, "Failed to parse JWKS: %s", cache.url)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, eachKey := range document.Keys {
+		if eachKey.Use != "" && eachKey.Use != "sig" {
+			continue
+		}
+		publicKey, publicKeyErr := eachKey.publicKey()
+		if publicKeyErr == nil {
+			keys[eachKey.KeyID] = publicKey
+		}
+	}
+	cache.keys = keys
+	cache.fetched = time.Now()
+	return nil
+}
+
+// jwtVerifier validates bearer tokens against the configured JWKS
+// document, issuer and audience
+type jwtVerifier struct {
+	settings *AuthSettings
+	keys     *jwksCache
+}
+
+func newJWTVerifier(settings *AuthSettings) *jwtVerifier {
+	return &jwtVerifier{
+		settings: settings,
+		keys: newJWKSCache(settings.JWKSURL,
+			time.Duration(settings.JWKSCacheSeconds)*time.Second),
+	}
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, decodeErr := base64.RawURLEncoding.DecodeString(segment)
+	if decodeErr != nil {
+		return errors.Wrapf(decodeErr, "Invalid token encoding")
+	}
+	return json.Unmarshal(data, value)
+}
+
+// verifySignature checks the JWS signature over the signing input
+func verifySignature(algorithm *jwtAlgorithm,
+	key crypto.PublicKey,
+	signingInput string,
+	signature []byte) error {
+	digest := algorithm.newHash()
+	digest.Write([]byte(signingInput))
+	hashed := digest.Sum(nil)
+
+	switch publicKey := key.(type) {
+	case *rsa.PublicKey:
+		if algorithm.keyType != "RSA" {
+			break
+		}
+		return rsa.VerifyPKCS1v15(publicKey, algorithm.hash, hashed, signature)
+	case *ecdsa.PublicKey:
+		if algorithm.keyType != "EC" {
+			break
+		}
+		// JWS ECDSA signatures are the fixed size R and S values
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("Invalid ECDSA signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(publicKey, hashed, r, s) {
+			return errors.New("Invalid ECDSA signature")
+		}
+		return nil
+	}
+	return errors.New("Key doesn't match the token algorithm")
+}
+
+// verify returns the claims of a valid token. Tokens must be signed by
+// a key in the JWKS document, include a subject, be within their
+// validity period and match the configured issuer and audience.
+func (verifier *jwtVerifier) verify(ctx context.Context, token string) (*jwtClaims, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("Token isn't a compact JWS")
+	}
+	header := &jwtHeader{}
+	headerErr := decodeSegment(segments[0], header)
+	if headerErr != nil {
+		return nil, headerErr
+	}
+	algorithm, algorithmExists := jwtAlgorithms[header.Algorithm]
+	if !algorithmExists {
+		return nil, errors.Errorf("Unsupported algorithm: %s", header.Algorithm)
+	}
+	key, keyErr := verifier.keys.key(ctx, header.KeyID)
+	if keyErr != nil {
+		return nil, keyErr
+	}
+	signature, signatureErr := base64.RawURLEncoding.DecodeString(segments[2])
+	if signatureErr != nil {
+		return nil, errors.Wrapf(signatureErr, "Invalid signature encoding")
+	}
+	verifyErr := verifySignature(algorithm, key, segments[0]+"."+segments[1], signature)
+	if verifyErr != nil {
+		return nil, verifyErr
+	}
+
+	claims := &jwtClaims{}
+	claimsErr := decodeSegment(segments[1], claims)
+	if claimsErr != nil {
+		return nil, claimsErr
+	}
+	now := time.Now()
+	if claims.Expires == nil {
+		return nil, errors.New("Token doesn't expire")
+	}
+	if now.Add(-jwtLeeway).After(time.Unix(int64(*claims.Expires), 0)) {
+		return nil, errors.New("Token has expired")
+	}
+	if claims.NotBefore != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return nil, errors.New("Token isn't valid yet")
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("Token has no subject")
+	}
+	if verifier.settings.Issuer != "" && claims.Issuer != verifier.settings.Issuer {
+		return nil, errors.Errorf("Unexpected issuer: %s", claims.Issuer)
+	}
+	if verifier.settings.Audience != "" {
+		audienceMatch := false
+		for _, eachAudience := range claims.Audience {
+			audienceMatch = audienceMatch || eachAudience == verifier.settings.Audience
+		}
+		if !audienceMatch {
+			return nil, errors.New("Token isn't intended for this audience")
+		}
+	}
+	return claims, nil
+}
+
+// bearerToken returns the token in an Authorization header value
+func bearerToken(authorization string) (string, error) {
+	const prefix = "Bearer "
+	if len(authorization) <= len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return "", errors.New("Authorization isn't a bearer token")
+	}
+	return strings.TrimSpace(authorization[len(prefix):]), nil
+}
@@ -0,0 +1,220 @@
+package service
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// metadataSubject is the artifact metadata that attributes an upload
+	// or feedback to the authenticated user
+	metadataSubject = "subject"
+	// authorizerContextSubject is the authorizer context key for the
+	// token's subject claim
+	authorizerContextSubject = "sub"
+)
+
+// errUnauthorized is the error an authorizer returns for API Gateway to
+// respond with a 401
+var errUnauthorized = errors.New("Unauthorized")
+
+// authEnabled returns true if the JWT authorizer is configured
+func (gws *ServicefulService) authEnabled() bool {
+	return gws.config.Auth.JWKSURL != ""
+}
+
+// authorizerResourceName is the logical name of the API Gateway
+// authorizer
+func (gws *ServicefulService) authorizerResourceName() string {
+	return sparta.CloudFormationResourceName("JWTAuthorizer", "JWTAuthorizer")
+}
+
+// newAPIMethod creates the resource's method, using the JWT authorizer
+// when it's configured. Requests without a valid token are rejected by
+// API Gateway before the function is invoked.
+func (gws *ServicefulService) newAPIMethod(resource *sparta.Resource,
+	httpMethod string,
+	defaultHTTPStatusCode int,
+	possibleHTTPStatusCodeResponses ...int) (*sparta.Method, error) {
+	if !gws.authEnabled() {
+		return resource.NewMethod(httpMethod,
+			defaultHTTPStatusCode,
+			possibleHTTPStatusCodeResponses...)
+	}
+	possibleHTTPStatusCodeResponses = append(possibleHTTPStatusCodeResponses,
+		http.StatusUnauthorized)
+	return resource.NewAuthorizedMethod(httpMethod,
+		gocf.Ref(gws.authorizerResourceName()),
+		defaultHTTPStatusCode,
+		possibleHTTPStatusCodeResponses...)
+}
+
+// requestSubject returns the subject of the request's bearer token, or
+// the empty string if the authorizer isn't configured. The token was
+// already accepted by the authorizer; it's verified again, against the
+// cached JWKS, so that the subject doesn't depend on the integration's
+// request template.
+func (gws *ServicefulService) requestSubject(ctx context.Context,
+	headers map[string]string) (string, error) {
+	if !gws.authEnabled() {
+		return "", nil
+	}
+	token, tokenErr := bearerToken(headerValue(headers, "Authorization"))
+	if tokenErr != nil {
+		return "", spartaAPIGateway.NewErrorResponse(http.StatusUnauthorized,
+			tokenErr.Error())
+	}
+	claims, claimsErr := gws.jwtVerifier.verify(ctx, token)
+	if claimsErr != nil {
+		return "", spartaAPIGateway.NewErrorResponse(http.StatusUnauthorized,
+			claimsErr.Error())
+	}
+	return claims.Subject, nil
+}
+
+// subjectMetadata returns the artifact metadata for the subject
+func subjectMetadata(subject string) map[string]string {
+	if subject == "" {
+		return nil
+	}
+	return map[string]string{
+		metadataSubject: subject,
+	}
+}
+
+// authorizerPolicyResource returns the API wide resource for the method
+// ARN. API Gateway caches the policy by token, so it must allow every
+// method the token may be used for.
+func authorizerPolicyResource(methodARN string) string {
+	// arn:aws:execute-api:region:account:api-id/stage/verb/path
+	arnParts := strings.SplitN(methodARN, "/", 3)
+	if len(arnParts) < 2 {
+		return methodARN
+	}
+	return arnParts[0] + "/" + arnParts[1] + "/*"
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Validate the bearer JWT in the Authorization header against the
+configured JWKS document and pass its subject to the API
+*/
+func (gws *ServicefulService) jwtAuthorizerLambda(ctx context.Context,
+	request awsLamdaEvents.APIGatewayCustomAuthorizerRequest) (*awsLamdaEvents.APIGatewayCustomAuthorizerResponse, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	token, tokenErr := bearerToken(request.AuthorizationToken)
+	if tokenErr != nil {
+		logger.WithField("Error", tokenErr).Warn("Request rejected")
+		return nil, errUnauthorized
+	}
+	claims, claimsErr := gws.jwtVerifier.verify(ctx, token)
+	if claimsErr != nil {
+		logger.WithField("Error", claimsErr).Warn("Request rejected")
+		return nil, errUnauthorized
+	}
+	logger.WithField("Subject", claims.Subject).Info("Request authorized")
+	return &awsLamdaEvents.APIGatewayCustomAuthorizerResponse{
+		PrincipalID: claims.Subject,
+		PolicyDocument: awsLamdaEvents.APIGatewayCustomAuthorizerPolicy{
+			Version: "2012-10-17",
+			Statement: []awsLamdaEvents.IAMPolicyStatement{
+				awsLamdaEvents.IAMPolicyStatement{
+					Action:   []string{"execute-api:Invoke"},
+					Effect:   "Allow",
+					Resource: []string{authorizerPolicyResource(request.MethodArn)},
+				},
+			},
+		},
+		Context: map[string]interface{}{
+			authorizerContextSubject: claims.Subject,
+		},
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Register the authorizer with the API and allow API Gateway to invoke it
+func jwtAuthorizerDecorator(api *sparta.API,
+	authorizerResourceName string,
+	settings *AuthSettings) sparta.TemplateDecoratorHookFunc {
+	return func(serviceName string,
+		lambdaResourceName string,
+		lambdaResource gocf.LambdaFunction,
+		resourceMetadata map[string]interface{},
+		S3Bucket string,
+		S3Key string,
+		buildID string,
+		cfTemplate *gocf.Template,
+		context map[string]interface{},
+		logger *logrus.Logger) error {
+
+		restAPIID := gocf.Ref(api.LogicalResourceName()).String()
+		cfTemplate.AddResource(authorizerResourceName, &gocf.APIGatewayAuthorizer{
+			Name:           gocf.String("JWTAuthorizer"),
+			Type:           gocf.String("TOKEN"),
+			RestAPIID:      restAPIID,
+			IdentitySource: gocf.String("method.request.header.Authorization"),
+			// Malformed headers are rejected without invoking the function
+			IdentityValidationExpression: gocf.String("^[Bb]earer [-0-9A-Za-z_]+\\.[-0-9A-Za-z_]+\\.[-0-9A-Za-z_]+$"),
+			AuthorizerResultTTLInSeconds: gocf.Integer(int64(settings.ResultTTLSeconds)),
+			AuthorizerURI: gocf.Join("",
+				gocf.String("arn:aws:apigateway:"),
+				gocf.Ref("AWS::Region").String(),
+				gocf.String(":lambda:path/2015-03-31/functions/"),
+				gocf.GetAtt(lambdaResourceName, "Arn"),
+				gocf.String("/invocations")),
+		})
+		permissionResourceName := sparta.CloudFormationResourceName("JWTAuthorizerPermission",
+			lambdaResourceName)
+		cfTemplate.AddResource(permissionResourceName, &gocf.LambdaPermission{
+			Action:       gocf.String("lambda:InvokeFunction"),
+			FunctionName: gocf.GetAtt(lambdaResourceName, "Arn"),
+			Principal:    gocf.String("apigateway.amazonaws.com"),
+			SourceArn: gocf.Join("",
+				gocf.String("arn:aws:execute-api:"),
+				gocf.Ref("AWS::Region").String(),
+				gocf.String(":"),
+				gocf.Ref("AWS::AccountId").String(),
+				gocf.String(":"),
+				restAPIID,
+				gocf.String("/authorizers/"),
+				gocf.Ref(authorizerResourceName).String()),
+		})
+		return nil
+	}
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newJWTAuthorizerLambda defines the Lambda authorizer for the API. It's
+// only provisioned when the JWKS URL is configured.
+func (gws *ServicefulService) newJWTAuthorizerLambda(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("JWTAuthorizer",
+		gws.jwtAuthorizerLambda,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.Options = &sparta.LambdaFunctionOptions{
+		Description: "Validate bearer JWTs for the API",
+		MemorySize:  128,
+		Timeout:     10,
+		TracingConfig: &gocf.LambdaFunctionTracingConfig{
+			Mode: gocf.String("Active"),
+		},
+	}
+	if api != nil {
+		lambdaFn.Decorators = append(lambdaFn.Decorators,
+			jwtAuthorizerDecorator(api, gws.authorizerResourceName(), &gws.config.Auth))
+	}
+	return lambdaFn
+}
@@ -0,0 +1,177 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Parameter Store keys for the DetectLabels parameters. The allow and
+// deny lists are comma separated label names.
+const (
+	parameterLabelMinConfidence = "/SpartaPollyWorkflow/DetectLabels/MinConfidence"
+	parameterLabelMaxLabels     = "/SpartaPollyWorkflow/DetectLabels/MaxLabels"
+	parameterLabelAllowList     = "/SpartaPollyWorkflow/DetectLabels/AllowLabels"
+	parameterLabelDenyList      = "/SpartaPollyWorkflow/DetectLabels/DenyLabels"
+	labelParametersExpiry       = 30 * time.Second
+
+	defaultLabelMinConfidence = 70.0
+	defaultLabelMaxLabels     = 20
+	maxLabelMaxLabels         = 1000
+)
+
+// labelParameters tune the DetectLabels request and which of the
+// returned labels are kept
+type labelParameters struct {
+	minConfidence float64
+	maxLabels     int64
+	// allow and deny are keyed by the lowercase label name. An empty
+	// allow list keeps every label that isn't denied.
+	allow map[string]bool
+	deny  map[string]bool
+}
+
+// isParameterNotFound returns true if the error reports that the
+// parameter isn't set
+func isParameterNotFound(err error) bool {
+	awsErr, isAWSErr := errors.Cause(err).(awserr.Error)
+	return isAWSErr && awsErr.Code() == ssm.ErrCodeParameterNotFound
+}
+
+// missingParameter is a parameter that wasn't set when it was read
+type missingParameter struct {
+	err     error
+	expires time.Time
+}
+
+// missingParameterCache wraps a ParameterStore so that parameters that
+// aren't set are only read again once their expiry passes. The SSM cache
+// only caches the parameters that exist.
+type missingParameterCache struct {
+	ParameterStore
+	mu      sync.Mutex
+	missing map[string]*missingParameter
+}
+
+func newMissingParameterCache(parameters ParameterStore) *missingParameterCache {
+	return &missingParameterCache{
+		ParameterStore: parameters,
+		missing:        make(map[string]*missingParameter),
+	}
+}
+
+// GetExpiringString satisfies ParameterStore
+func (cache *missingParameterCache) GetExpiringString(key string, expiry time.Duration) (string, error) {
+	cache.mu.Lock()
+	missing, exists := cache.missing[key]
+	cache.mu.Unlock()
+	if exists && time.Now().Before(missing.expires) {
+		return "", missing.err
+	}
+	value, valueErr := cache.ParameterStore.GetExpiringString(key, expiry)
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if isParameterNotFound(valueErr) {
+		cache.missing[key] = &missingParameter{
+			err:     valueErr,
+			expires: time.Now().Add(expiry),
+		}
+	} else {
+		delete(cache.missing, key)
+	}
+	return value, valueErr
+}
+
+// labelSet parses a comma separated list of label names
+func labelSet(value string) map[string]bool {
+	labels := make(map[string]bool)
+	for _, eachLabel := range strings.Split(value, ",") {
+		trimmed := strings.ToLower(strings.TrimSpace(eachLabel))
+		if trimmed != "" {
+			labels[trimmed] = true
+		}
+	}
+	return labels
+}
+
+// newLabelParameters returns the current parameters. Missing values use
+// the defaults, as do invalid and unreadable ones, which are logged.
+func newLabelParameters(ctx context.Context, parameters ParameterStore) *labelParameters {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	get := func(key string) string {
+		value, valueErr := parameters.GetExpiringString(key, labelParametersExpiry)
+		if valueErr != nil && !isParameterNotFound(valueErr) {
+			logger.WithFields(logrus.Fields{
+				"Parameter": key,
+				"Error":     valueErr,
+			}).Warn("Failed to read parameter")
+		}
+		return value
+	}
+	invalid := func(key string, value string) {
+		logger.WithFields(logrus.Fields{
+			"Parameter": key,
+			"Value":     value,
+		}).Warn("Ignoring invalid parameter")
+	}
+	labelParams := &labelParameters{
+		minConfidence: defaultLabelMinConfidence,
+		maxLabels:     defaultLabelMaxLabels,
+	}
+	minConfidence := get(parameterLabelMinConfidence)
+	if minConfidence != "" {
+		value, valueErr := strconv.ParseFloat(strings.TrimSpace(minConfidence), 64)
+		if valueErr != nil || value < 0 || value > 100 {
+			invalid(parameterLabelMinConfidence, minConfidence)
+		} else {
+			labelParams.minConfidence = value
+		}
+	}
+	maxLabels := get(parameterLabelMaxLabels)
+	if maxLabels != "" {
+		value, valueErr := strconv.ParseInt(strings.TrimSpace(maxLabels), 10, 64)
+		if valueErr != nil || value < 1 || value > maxLabelMaxLabels {
+			invalid(parameterLabelMaxLabels, maxLabels)
+		} else {
+			labelParams.maxLabels = value
+		}
+	}
+	labelParams.allow = labelSet(get(parameterLabelAllowList))
+	labelParams.deny = labelSet(get(parameterLabelDenyList))
+	return labelParams
+}
+
+func (labelParams *labelParameters) detectLabelsInput(image *rekognition.Image) *rekognition.DetectLabelsInput {
+	return &rekognition.DetectLabelsInput{
+		Image:         image,
+		MinConfidence: aws.Float64(labelParams.minConfidence),
+		MaxLabels:     aws.Int64(labelParams.maxLabels),
+	}
+}
+
+// filter returns the labels that are allowed and not denied, in their
+// original order
+func (labelParams *labelParameters) filter(labels []*rekognition.Label) []*rekognition.Label {
+	filtered := make([]*rekognition.Label, 0, len(labels))
+	for _, eachLabel := range labels {
+		name := strings.ToLower(aws.StringValue(eachLabel.Name))
+		if len(labelParams.allow) != 0 && !labelParams.allow[name] {
+			continue
+		}
+		if labelParams.deny[name] {
+			continue
+		}
+		filtered = append(filtered, eachLabel)
+	}
+	return filtered
+}
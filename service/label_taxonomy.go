@@ -0,0 +1,144 @@
+package service
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+// rankedLabel is a normalized label. Labels are renamed by the synonym
+// map, deduplicated and collapsed into the most specific label.
+type rankedLabel struct {
+	Name       string  `json:"name"`
+	Confidence float64 `json:"confidence"`
+	// Collapsed are the less specific labels, such as "Animal" for
+	// "Dog", that were merged into this one
+	Collapsed []string `json:"collapsed,omitempty"`
+}
+
+// taxonomyEntry is a detected label, after renaming, together with the
+// labels Rekognition reported as its parents
+type taxonomyEntry struct {
+	label   *rankedLabel
+	parents map[string]bool
+}
+
+// labelTaxonomy normalizes Rekognition labels
+type labelTaxonomy struct {
+	// synonyms are keyed by the lowercase label name
+	synonyms map[string]string
+}
+
+// newLabelTaxonomy returns the taxonomy that applies the rename map
+func newLabelTaxonomy(synonyms map[string]string) *labelTaxonomy {
+	taxonomy := &labelTaxonomy{
+		synonyms: make(map[string]string),
+	}
+	for eachName, eachRename := range synonyms {
+		taxonomy.synonyms[strings.ToLower(strings.TrimSpace(eachName))] = strings.TrimSpace(eachRename)
+	}
+	return taxonomy
+}
+
+// canonicalName returns the label's name after renaming
+func (taxonomy *labelTaxonomy) canonicalName(name string) string {
+	if rename, exists := taxonomy.synonyms[strings.ToLower(name)]; exists {
+		return rename
+	}
+	return name
+}
+
+// ancestors returns the lowercase names of every detected label that
+// key descends from
+func ancestors(entries map[string]*taxonomyEntry, key string) map[string]bool {
+	found := make(map[string]bool)
+	pending := []string{key}
+	for len(pending) != 0 {
+		current := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		entry, exists := entries[current]
+		if !exists {
+			continue
+		}
+		for eachParent := range entry.parents {
+			if !found[eachParent] {
+				found[eachParent] = true
+				pending = append(pending, eachParent)
+			}
+		}
+	}
+	delete(found, key)
+	return found
+}
+
+// rank returns the deduplicated labels, most confident first. A label
+// that's an ancestor of another detected label is collapsed into it.
+func (taxonomy *labelTaxonomy) rank(labels []*rekognition.Label) []*rankedLabel {
+	entries := make(map[string]*taxonomyEntry)
+	order := make([]string, 0, len(labels))
+	for _, eachLabel := range labels {
+		name := taxonomy.canonicalName(aws.StringValue(eachLabel.Name))
+		if name == "" {
+			continue
+		}
+		key := strings.ToLower(name)
+		entry, exists := entries[key]
+		if !exists {
+			entry = &taxonomyEntry{
+				label:   &rankedLabel{Name: name},
+				parents: make(map[string]bool),
+			}
+			entries[key] = entry
+			order = append(order, key)
+		}
+		confidence := aws.Float64Value(eachLabel.Confidence)
+		if confidence > entry.label.Confidence {
+			entry.label.Confidence = confidence
+		}
+		for _, eachParent := range eachLabel.Parents {
+			parentKey := strings.ToLower(taxonomy.canonicalName(aws.StringValue(eachParent.Name)))
+			if parentKey != "" && parentKey != key {
+				entry.parents[parentKey] = true
+			}
+		}
+	}
+	entryAncestors := make(map[string]map[string]bool)
+	for _, eachKey := range order {
+		entryAncestors[eachKey] = ancestors(entries, eachKey)
+	}
+	ranked := make([]*rankedLabel, 0, len(order))
+	for _, eachKey := range order {
+		collapsed := false
+		for _, eachOther := range order {
+			// Labels that are each other's ancestors are both kept
+			if entryAncestors[eachOther][eachKey] && !entryAncestors[eachKey][eachOther] {
+				collapsed = true
+				break
+			}
+		}
+		if collapsed {
+			continue
+		}
+		label := entries[eachKey].label
+		for _, eachOther := range order {
+			if entryAncestors[eachKey][eachOther] && !entryAncestors[eachOther][eachKey] {
+				label.Collapsed = append(label.Collapsed, entries[eachOther].label.Name)
+			}
+		}
+		ranked = append(ranked, label)
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return ranked[i].Confidence > ranked[j].Confidence
+	})
+	return ranked
+}
+
+// rankLabels normalizes the detected labels with the configured synonyms
+func (gws *ServicefulService) rankLabels(output *rekognition.DetectLabelsOutput) []*rankedLabel {
+	if output == nil {
+		return nil
+	}
+	return newLabelTaxonomy(gws.config.Labels.Synonyms).rank(output.Labels)
+}
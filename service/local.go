@@ -0,0 +1,202 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// LocalBucketName is the bucket name reported in the synthetic S3 events
+// when the Connections don't specify one
+const LocalBucketName = "local"
+
+// localDeadLetterDir is the hidden directory under the bucket root that
+// stores the events the local stages failed to process
+const localDeadLetterDir = ".dead-letter"
+
+// LocalDeadLetterDirectory returns the directory where the local pipeline
+// rooted at rootDir saves the events its stages failed to process
+func LocalDeadLetterDirectory(rootDir string) string {
+	return filepath.Join(rootDir, localDeadLetterDir)
+}
+
+// LocalPipeline runs the S3 triggered stages against a filesystem backed
+// bucket. New objects under a stage's trigger keyspace produce a
+// synthetic ObjectCreated event that's delivered to the same handler the
+// lambda function uses.
+type LocalPipeline struct {
+	gws           *ServicefulService
+	blobs         *FileSystemBlobStore
+	deadLetterDir string
+	pollInterval  time.Duration
+	seen          map[string]time.Time
+}
+
+// NewLocalPipeline returns a LocalPipeline that treats rootDir as the
+// bucket root and uses stand-in ML backends
+func NewLocalPipeline(config *Config,
+	rootDir string,
+	pollInterval time.Duration) *LocalPipeline {
+	localConfig := *config
+	if localConfig.Connections.S3BucketName == "" {
+		localConfig.Connections.S3BucketName = LocalBucketName
+	}
+	blobs := NewFileSystemBlobStore(rootDir)
+	gws := newServicefulService(&localConfig, newLocalClients(blobs))
+	// Creating the functions registers the S3 triggered stages
+	gws.lambdaFunctions(nil)
+
+	return &LocalPipeline{
+		gws:           gws,
+		blobs:         blobs,
+		deadLetterDir: LocalDeadLetterDirectory(rootDir),
+		pollInterval:  pollInterval,
+		seen:          make(map[string]time.Time),
+	}
+}
+
+// Run watches the bucket root until the context is cancelled. Objects
+// that exist when Run starts are not processed.
+func (lp *LocalPipeline) Run(ctx context.Context, logger *logrus.Logger) error {
+	_, graphErr := newTriggerGraph(lp.gws.stages)
+	if graphErr != nil {
+		return graphErr
+	}
+	for _, eachKeyspace := range []string{
+		lp.gws.connections.S3KeyspaceUploads,
+		lp.gws.connections.S3KeyspaceConsolidatedStatus,
+	} {
+		keyspacePath, keyspacePathErr := lp.blobs.Path(eachKeyspace)
+		if keyspacePathErr != nil {
+			return keyspacePathErr
+		}
+		mkdirErr := os.MkdirAll(keyspacePath, os.ModePerm)
+		if mkdirErr != nil {
+			return errors.Wrapf(mkdirErr, "Failed to create keyspace directory")
+		}
+	}
+	for _, eachStage := range lp.gws.stages {
+		logger.WithFields(logrus.Fields{
+			"Stage":   eachStage.name,
+			"Trigger": eachStage.triggerPrefix,
+		}).Info("Registered stage")
+	}
+	_, scanErr := lp.scan(ctx, time.Now())
+	if scanErr != nil {
+		return scanErr
+	}
+	uploadsPath, _ := lp.blobs.Path(lp.gws.connections.S3KeyspaceUploads)
+	logger.WithFields(logrus.Fields{
+		"Root":    lp.blobs.rootDir,
+		"Uploads": uploadsPath,
+	}).Info("Watching local bucket")
+
+	ctx = context.WithValue(ctx, sparta.ContextKeyLogger, logger)
+	ticker := time.NewTicker(lp.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			// Only consider objects that have been quiet for one interval so
+			// that we don't deliver partially copied files
+			createdBlobs, scanErr := lp.scan(ctx, time.Now().Add(-lp.pollInterval))
+			if scanErr != nil {
+				return scanErr
+			}
+			for _, eachBlob := range createdBlobs {
+				dispatchErr := lp.dispatch(ctx, logger, eachBlob)
+				if dispatchErr != nil {
+					logger.WithFields(logrus.Fields{
+						"Key":   eachBlob.Key,
+						"Error": dispatchErr,
+					}).Error("Stage failed")
+				}
+			}
+		}
+	}
+}
+
+// scan returns the sorted keys that were created or modified since the
+// previous scan, ignoring anything modified after the cutoff
+func (lp *LocalPipeline) scan(ctx context.Context, cutoff time.Time) ([]*BlobInfo, error) {
+	blobs, blobsErr := lp.blobs.List(ctx, lp.gws.connections.S3BucketName, "")
+	if blobsErr != nil {
+		return nil, errors.Wrapf(blobsErr, "Failed to scan local bucket")
+	}
+	createdBlobs := make([]*BlobInfo, 0)
+	for _, eachBlob := range blobs {
+		if eachBlob.LastModified.After(cutoff) {
+			continue
+		}
+		lastModified, exists := lp.seen[eachBlob.Key]
+		if !exists || !lastModified.Equal(eachBlob.LastModified) {
+			lp.seen[eachBlob.Key] = eachBlob.LastModified
+			createdBlobs = append(createdBlobs, eachBlob)
+		}
+	}
+	return createdBlobs, nil
+}
+
+// dispatch delivers a synthetic ObjectCreated event for the blob to every
+// stage whose trigger prefix matches
+func (lp *LocalPipeline) dispatch(ctx context.Context,
+	logger *logrus.Logger,
+	blob *BlobInfo) error {
+	event := lp.s3Event(blob)
+	for _, eachStage := range lp.gws.stages {
+		if !eachStage.triggeredBy(blob.Key) {
+			continue
+		}
+		logger.WithFields(logrus.Fields{
+			"Stage": eachStage.name,
+			"Key":   blob.Key,
+		}).Info("Delivering ObjectCreated event")
+		handlerErr := eachStage.handler(ctx, event)
+		if handlerErr != nil {
+			// Mirror the lambda dead letter queue so the event can be replayed
+			deadLetterErr := writeDeadLetter(lp.deadLetterDir, eachStage.name, event, handlerErr)
+			if deadLetterErr != nil {
+				logger.WithField("Error", deadLetterErr).Warn("Failed to save dead letter")
+			}
+			return errors.Wrapf(handlerErr, "%s failed", eachStage.name)
+		}
+	}
+	return nil
+}
+
+// s3Event returns the notification S3 would publish for the blob
+func (lp *LocalPipeline) s3Event(blob *BlobInfo) awsLamdaEvents.S3Event {
+	bucketName := lp.gws.connections.S3BucketName
+	return awsLamdaEvents.S3Event{
+		Records: []awsLamdaEvents.S3EventRecord{
+			awsLamdaEvents.S3EventRecord{
+				EventVersion: "2.0",
+				EventSource:  "aws:s3",
+				AWSRegion:    "local",
+				EventTime:    time.Now().UTC(),
+				EventName:    "ObjectCreated:Put",
+				S3: awsLamdaEvents.S3Entity{
+					SchemaVersion: "1.0",
+					Bucket: awsLamdaEvents.S3Bucket{
+						Name: bucketName,
+						Arn:  fmt.Sprintf("arn:aws:s3:::%s", bucketName),
+					},
+					Object: awsLamdaEvents.S3Object{
+						Key:  blob.Key,
+						Size: blob.Size,
+						ETag: blob.ETag,
+					},
+				},
+			},
+		},
+	}
+}
@@ -0,0 +1,193 @@
+package service
+
+import (
+	"bytes"
+	"image"
+	// Register the decoders for the image types the pipeline accepts
+	_ "image/jpeg"
+	_ "image/png"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+/*
+================================================================================
+╦  ╔═╗╔═╗╔═╗╦
+║  ║ ║║  ╠═╣║
+╩═╝╚═╝╚═╝╩ ╩╩═╝
+================================================================================
+Stand-in backends used to run the pipeline without AWS
+*/
+
+// newLocalS3 returns an S3 client with static credentials. It's only
+// used to sign requests, which doesn't require network access.
+func newLocalS3() *s3.S3 {
+	signerSession := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-east-1"),
+		Credentials: credentials.NewStaticCredentials("local", "local", ""),
+	}))
+	return s3.New(signerSession)
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// localRekognition produces labels from the image header rather than
+// the image content
+type localRekognition struct {
+	blobs BlobStore
+}
+
+func (lr *localRekognition) DetectLabelsWithContext(ctx aws.Context,
+	input *rekognition.DetectLabelsInput,
+	opts ...request.Option) (*rekognition.DetectLabelsOutput, error) {
+	imageData := input.Image.Bytes
+	if input.Image.S3Object != nil {
+		data, dataErr := lr.blobs.Get(ctx,
+			aws.StringValue(input.Image.S3Object.Bucket),
+			aws.StringValue(input.Image.S3Object.Name))
+		if dataErr != nil {
+			return nil, dataErr
+		}
+		imageData = data
+	}
+	config, format, configErr := image.DecodeConfig(bytes.NewReader(imageData))
+	if configErr != nil {
+		return nil, awserr.New(rekognition.ErrCodeInvalidImageFormatException,
+			"Request has invalid image format",
+			configErr)
+	}
+	orientation := "Landscape"
+	if config.Height > config.Width {
+		orientation = "Portrait"
+	}
+	labels := []*rekognition.Label{
+		&rekognition.Label{
+			Name:       aws.String("Image"),
+			Confidence: aws.Float64(99.0),
+		},
+		&rekognition.Label{
+			Name:       aws.String(strings.ToUpper(format)),
+			Confidence: aws.Float64(90.0),
+		},
+		&rekognition.Label{
+			Name:       aws.String(orientation),
+			Confidence: aws.Float64(75.0),
+		},
+	}
+	// Apply the request's limits, as Rekognition does
+	detected := make([]*rekognition.Label, 0, len(labels))
+	for _, eachLabel := range labels {
+		if input.MaxLabels != nil && int64(len(detected)) >= *input.MaxLabels {
+			break
+		}
+		if aws.Float64Value(eachLabel.Confidence) >= aws.Float64Value(input.MinConfidence) {
+			detected = append(detected, eachLabel)
+		}
+	}
+	return &rekognition.DetectLabelsOutput{
+		Labels: detected,
+	}, nil
+}
+
+// The other analyses don't find anything in local images
+
+func (lr *localRekognition) DetectTextWithContext(ctx aws.Context,
+	input *rekognition.DetectTextInput,
+	opts ...request.Option) (*rekognition.DetectTextOutput, error) {
+	return &rekognition.DetectTextOutput{
+		TextDetections: []*rekognition.TextDetection{},
+	}, nil
+}
+
+func (lr *localRekognition) DetectModerationLabelsWithContext(ctx aws.Context,
+	input *rekognition.DetectModerationLabelsInput,
+	opts ...request.Option) (*rekognition.DetectModerationLabelsOutput, error) {
+	return &rekognition.DetectModerationLabelsOutput{
+		ModerationLabels: []*rekognition.ModerationLabel{},
+	}, nil
+}
+
+func (lr *localRekognition) DetectFacesWithContext(ctx aws.Context,
+	input *rekognition.DetectFacesInput,
+	opts ...request.Option) (*rekognition.DetectFacesOutput, error) {
+	return &rekognition.DetectFacesOutput{
+		FaceDetails: []*rekognition.FaceDetail{},
+	}, nil
+}
+
+func (lr *localRekognition) RecognizeCelebritiesWithContext(ctx aws.Context,
+	input *rekognition.RecognizeCelebritiesInput,
+	opts ...request.Option) (*rekognition.RecognizeCelebritiesOutput, error) {
+	return &rekognition.RecognizeCelebritiesOutput{
+		CelebrityFaces:    []*rekognition.Celebrity{},
+		UnrecognizedFaces: []*rekognition.ComparedFace{},
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// localPolly returns the input text as the audio stream, so the
+// consolidated report contains the narration that would be spoken
+type localPolly struct {
+}
+
+func (lp *localPolly) SynthesizeSpeechWithContext(ctx aws.Context,
+	input *polly.SynthesizeSpeechInput,
+	opts ...request.Option) (*polly.SynthesizeSpeechOutput, error) {
+	if input.Text == nil {
+		return nil, errors.New("Text is required")
+	}
+	return &polly.SynthesizeSpeechOutput{
+		AudioStream: ioutil.NopCloser(strings.NewReader(*input.Text)),
+		ContentType: aws.String("text/plain"),
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// localComprehend reports every comment as neutral
+type localComprehend struct {
+}
+
+func (lc *localComprehend) DetectSentimentWithContext(ctx aws.Context,
+	input *comprehend.DetectSentimentInput,
+	opts ...request.Option) (*comprehend.DetectSentimentOutput, error) {
+	return &comprehend.DetectSentimentOutput{
+		Sentiment: aws.String(comprehend.SentimentTypeNeutral),
+		SentimentScore: &comprehend.SentimentScore{
+			Neutral: aws.Float64(1.0),
+		},
+	}, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// localParameters has no values, so every parameter uses its default
+type localParameters struct {
+}
+
+func (lp *localParameters) GetExpiringString(key string, expiry time.Duration) (string, error) {
+	return "", nil
+}
+
+// newLocalClients returns the stand-in clients that use the given
+// BlobStore
+func newLocalClients(blobs BlobStore) *Clients {
+	return &Clients{
+		S3:          newLocalS3(),
+		Blobs:       blobs,
+		Rekognition: &localRekognition{blobs: blobs},
+		Polly:       &localPolly{},
+		Comprehend:  &localComprehend{},
+		Parameters:  &localParameters{},
+		RateLimits:  NewMemoryRateLimitStore(),
+	}
+}
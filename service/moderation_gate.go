@@ -0,0 +1,134 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	summaryStatusRejected = "rejected"
+	// moderationRejectionReason is published in the rejected report. The
+	// flagged categories are only logged, so that the report doesn't
+	// describe the image.
+	moderationRejectionReason = "The image was flagged by content moderation and won't be published"
+)
+
+// stageHalted is returned by stages that stopped the pipeline for an
+// upload. The stage records the job's state itself.
+type stageHalted struct {
+	Key string `json:"key"`
+}
+
+// contentRejection is the reason published in a rejected report
+type contentRejection struct {
+	Reason string `json:"reason"`
+}
+
+// moderationEnabled returns true if uploads are moderated before
+// they're narrated
+func (gws *ServicefulService) moderationEnabled() bool {
+	return gws.config.Moderation.Enabled
+}
+
+// moderationThreshold returns the configured threshold for the category,
+// or zero if it isn't moderated
+func (gws *ServicefulService) moderationThreshold(category string) float64 {
+	for eachCategory, eachThreshold := range gws.config.Moderation.Thresholds {
+		if strings.EqualFold(eachCategory, category) {
+			return eachThreshold
+		}
+	}
+	return 0
+}
+
+// flaggedModerationLabels returns the names of the moderation labels that
+// meet the threshold of either their own or their parent category
+func (gws *ServicefulService) flaggedModerationLabels(moderation *rekognition.DetectModerationLabelsOutput) []string {
+	flagged := make([]string, 0)
+	for _, eachLabel := range moderation.ModerationLabels {
+		confidence := aws.Float64Value(eachLabel.Confidence)
+		for _, eachCategory := range []string{aws.StringValue(eachLabel.Name),
+			aws.StringValue(eachLabel.ParentName)} {
+			threshold := gws.moderationThreshold(eachCategory)
+			if eachCategory != "" && threshold > 0 && confidence >= threshold {
+				flagged = append(flagged, aws.StringValue(eachLabel.Name))
+				break
+			}
+		}
+	}
+	return flagged
+}
+
+// rejectContent halts the pipeline for a flagged upload. The upload is
+// moved to the quarantine keyspace, its normalized image and public
+// thumbnail are deleted and a rejected report, which includes no labels
+// or audio, is published. Each step can be repeated, so a redelivered
+// event completes an interrupted rejection.
+func (gws *ServicefulService) rejectContent(ctx context.Context,
+	bucket string,
+	uploadID string,
+	normalizedKey string) (*stageHalted, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	blobs := gws.clients(ctx).Blobs
+
+	quarantineKey := gws.quarantineKey(uploadID)
+	_, quarantinedErr := blobs.Head(ctx, bucket, quarantineKey)
+	if IsBlobNotFound(quarantinedErr) {
+		validation, validationErr := gws.getImageValidation(ctx,
+			bucket,
+			fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceValidations, uploadID))
+		if validationErr != nil {
+			return nil, validationErr
+		}
+		quarantineErr := gws.quarantineUpload(ctx, bucket, validation.Key, uploadID)
+		if quarantineErr != nil {
+			return nil, quarantineErr
+		}
+	} else if quarantinedErr != nil {
+		return nil, quarantinedErr
+	}
+	for _, eachKey := range []string{gws.thumbnailKey(uploadID), normalizedKey} {
+		deleteErr := blobs.Delete(ctx, bucket, eachKey)
+		if deleteErr != nil {
+			return nil, deleteErr
+		}
+	}
+	uploadMetadata, uploadMetadataErr := gws.getUploadMetadata(ctx, bucket, uploadID)
+	if uploadMetadataErr != nil {
+		return nil, uploadMetadataErr
+	}
+	summary := summaryInfo{
+		Status: summaryStatusRejected,
+		Upload: uploadMetadata.redacted(),
+		Rejection: &contentRejection{
+			Reason: moderationRejectionReason,
+		},
+	}
+	putOptions := &PutOptions{
+		Tags: map[string]string{
+			tagNameAccess: tagAccessPublic,
+		},
+	}
+	putErr := gws.putJSONObject(ctx,
+		bucket,
+		fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceConsolidatedStatus, uploadID),
+		&summary,
+		putOptions)
+	if putErr != nil {
+		return nil, putErr
+	}
+	gws.modifyJobStatus(ctx, bucket, uploadID, func(jobStatus *JobStatus, now time.Time) {
+		if jobStatus.State != JobStateRejected {
+			jobStatus.transition(JobStateRejected, now)
+		}
+	})
+	logger.WithField("UploadID", uploadID).Warn("Upload rejected by content moderation")
+	return &stageHalted{Key: quarantineKey}, nil
+}
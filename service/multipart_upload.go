@@ -0,0 +1,371 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	sparta "github.com/mweagle/Sparta"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
+	spartaEvents "github.com/mweagle/Sparta/aws/events"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// S3 part numbers are 1-10000
+	maxMultipartPartNumber = 10000
+	// maxPresignedParts is the number of part URLs returned per request
+	maxPresignedParts = 100
+)
+
+// MultipartPart is an uploaded part of a multipart upload
+type MultipartPart struct {
+	PartNumber int64  `json:"part_number"`
+	ETag       string `json:"etag"`
+	Size       int64  `json:"size,omitempty"`
+}
+
+// MultipartBody is the typed body of the multipart upload requests
+type MultipartBody struct {
+	MultipartUploadID string          `json:"multipart_upload_id"`
+	PartNumbers       []int64         `json:"part_numbers,omitempty"`
+	Parts             []MultipartPart `json:"parts,omitempty"`
+}
+
+// MultipartRequest is the typed input to multipartUploadLambda
+type MultipartRequest struct {
+	spartaEvents.APIGatewayEnvelope
+	Body MultipartBody `json:"body"`
+}
+
+type multipartResponse struct {
+	UploadID          string `json:"upload_id"`
+	MultipartUploadID string `json:"multipart_upload_id,omitempty"`
+	ResultsURL        string `json:"results_url,omitempty"`
+	// PartURLs are the presigned UploadPart URLs, keyed by part number
+	PartURLs map[string]string `json:"part_urls,omitempty"`
+	// Parts are the parts S3 has received, so that an interrupted upload
+	// can be resumed
+	Parts []MultipartPart `json:"parts,omitempty"`
+	ETag  string          `json:"etag,omitempty"`
+}
+
+// listMultipartParts returns the parts S3 has received, sorted by part
+// number
+func (gws *ServicefulService) listMultipartParts(ctx context.Context,
+	bucketName string,
+	objectPath string,
+	multipartUploadID string) ([]MultipartPart, error) {
+	parts := make([]MultipartPart, 0)
+	listInput := &s3.ListPartsInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(objectPath),
+		UploadId: aws.String(multipartUploadID),
+	}
+	listErr := gws.clients(ctx).S3.ListPartsPagesWithContext(ctx,
+		listInput,
+		func(page *s3.ListPartsOutput, lastPage bool) bool {
+			for _, eachPart := range page.Parts {
+				parts = append(parts, MultipartPart{
+					PartNumber: aws.Int64Value(eachPart.PartNumber),
+					ETag:       strings.Trim(aws.StringValue(eachPart.ETag), "\""),
+					Size:       aws.Int64Value(eachPart.Size),
+				})
+			}
+			return true
+		})
+	if listErr != nil {
+		return nil, listErr
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].PartNumber < parts[j].PartNumber
+	})
+	return parts, nil
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Manage multipart uploads of large images:
+
+	POST   /multipart               start an upload
+	POST   /multipart/{id}/parts    presign UploadPart URLs
+	GET    /multipart/{id}          list the uploaded parts
+	POST   /multipart/{id}/complete complete the upload
+	DELETE /multipart/{id}          abort the upload
+*/
+func (gws *ServicefulService) multipartUploadLambda(ctx context.Context,
+	apigRequest MultipartRequest) (*multipartResponse, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	bucketName, bucketNameErr := gws.bucketName()
+	if bucketNameErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+			bucketNameErr)
+	}
+	s3Svc := gws.clients(ctx).S3
+	resourcePath := apigRequest.Context.ResourcePath
+
+	// Start a new upload
+	if resourcePath == "/multipart" {
+		contentType, contentTypeOK := uploadContentType(apigRequest.QueryParams["content_type"],
+			gws.config.Uploads.MultipartContentTypes)
+		if !contentTypeOK {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("content_type must be one of: %s",
+					strings.Join(gws.config.Uploads.MultipartContentTypes, ", ")))
+		}
+		uploadID, uploadIDErr := gws.uploadIDs.NewID()
+		if uploadIDErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+				uploadIDErr)
+		}
+		uploadMetadata, uploadMetadataErr := newUploadMetadata(uploadID,
+			apigRequest.QueryParams)
+		if uploadMetadataErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				uploadMetadataErr.Error())
+		}
+		if uploadMetadata.Size > gws.config.Uploads.MultipartMaxSizeBytes {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("size must be at most %d bytes", gws.config.Uploads.MultipartMaxSizeBytes))
+		}
+		subject, subjectErr := gws.requestSubject(ctx, apigRequest.Headers)
+		if subjectErr != nil {
+			return nil, subjectErr
+		}
+		uploadMetadata.Subject = subject
+		uploadObjectMetadata := subjectMetadata(subject)
+		createOutput, createErr := s3Svc.CreateMultipartUploadWithContext(ctx,
+			&s3.CreateMultipartUploadInput{
+				Bucket:      aws.String(bucketName),
+				Key:         aws.String(gws.uploadKey(uploadID)),
+				ContentType: aws.String(contentType),
+				Metadata:    aws.StringMap(uploadObjectMetadata),
+			})
+		if createErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+				createErr)
+		}
+		putErr := gws.putJSONObject(ctx,
+			bucketName,
+			gws.uploadMetadataKey(uploadID),
+			uploadMetadata,
+			&PutOptions{Metadata: uploadObjectMetadata})
+		if putErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+				putErr)
+		}
+		gws.updateJobStatus(ctx,
+			bucketName,
+			uploadID,
+			JobStateAwaitingUpload)
+		logger.WithFields(logrus.Fields{
+			"UploadID":          uploadID,
+			"MultipartUploadID": aws.StringValue(createOutput.UploadId),
+		}).Info("Multipart upload started")
+		return &multipartResponse{
+			UploadID:          uploadID,
+			MultipartUploadID: aws.StringValue(createOutput.UploadId),
+			ResultsURL:        gws.resultsURL(bucketName, uploadID),
+		}, nil
+	}
+
+	// Everything else operates on an existing upload
+	uploadID := apigRequest.PathParams["id"]
+	if !uploadIDPattern.MatchString(uploadID) {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			fmt.Sprintf("Invalid upload ID: %s", uploadID))
+	}
+	multipartUploadID := apigRequest.Body.MultipartUploadID
+	if multipartUploadID == "" {
+		multipartUploadID = apigRequest.QueryParams["multipart_upload_id"]
+	}
+	if multipartUploadID == "" {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			"multipart_upload_id is required")
+	}
+	objectPath := gws.uploadKey(uploadID)
+	response := &multipartResponse{
+		UploadID:          uploadID,
+		MultipartUploadID: multipartUploadID,
+	}
+
+	switch {
+	case strings.HasSuffix(resourcePath, "/parts"):
+		partNumbers := apigRequest.Body.PartNumbers
+		if len(partNumbers) == 0 || len(partNumbers) > maxPresignedParts {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("part_numbers must include 1-%d parts", maxPresignedParts))
+		}
+		expiry, expiryErr := gws.presignExpiry(apigRequest.QueryParams)
+		if expiryErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				expiryErr.Error())
+		}
+		response.PartURLs = make(map[string]string)
+		for _, eachPartNumber := range partNumbers {
+			if eachPartNumber < 1 || eachPartNumber > maxMultipartPartNumber {
+				return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+					fmt.Sprintf("part_numbers must be 1-%d: %d", maxMultipartPartNumber, eachPartNumber))
+			}
+			partRequest, _ := s3Svc.UploadPartRequest(&s3.UploadPartInput{
+				Bucket:     aws.String(bucketName),
+				Key:        aws.String(objectPath),
+				UploadId:   aws.String(multipartUploadID),
+				PartNumber: aws.Int64(eachPartNumber),
+			})
+			partURL, partURLErr := partRequest.Presign(expiry)
+			if partURLErr != nil {
+				return nil, spartaAPIGateway.NewErrorResponse(http.StatusInternalServerError,
+					partURLErr)
+			}
+			response.PartURLs[strconv.FormatInt(eachPartNumber, 10)] = partURL
+		}
+
+	case strings.HasSuffix(resourcePath, "/complete"):
+		uploadedParts, uploadedPartsErr := gws.listMultipartParts(ctx,
+			bucketName,
+			objectPath,
+			multipartUploadID)
+		if uploadedPartsErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				uploadedPartsErr)
+		}
+		var totalSize int64
+		for _, eachPart := range uploadedParts {
+			totalSize += eachPart.Size
+		}
+		if totalSize > gws.config.Uploads.MultipartMaxSizeBytes {
+			s3Svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(bucketName),
+				Key:      aws.String(objectPath),
+				UploadId: aws.String(multipartUploadID),
+			})
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				fmt.Sprintf("Upload exceeds %d bytes and was aborted",
+					gws.config.Uploads.MultipartMaxSizeBytes))
+		}
+		// Default to every uploaded part, which is what a resumed client wants
+		completedParts := apigRequest.Body.Parts
+		if len(completedParts) == 0 {
+			completedParts = uploadedParts
+		}
+		completeInput := &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(bucketName),
+			Key:             aws.String(objectPath),
+			UploadId:        aws.String(multipartUploadID),
+			MultipartUpload: &s3.CompletedMultipartUpload{},
+		}
+		for _, eachPart := range completedParts {
+			completeInput.MultipartUpload.Parts = append(completeInput.MultipartUpload.Parts,
+				&s3.CompletedPart{
+					PartNumber: aws.Int64(eachPart.PartNumber),
+					ETag:       aws.String(eachPart.ETag),
+				})
+		}
+		completeOutput, completeErr := s3Svc.CompleteMultipartUploadWithContext(ctx, completeInput)
+		if completeErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				completeErr)
+		}
+		response.ETag = strings.Trim(aws.StringValue(completeOutput.ETag), "\"")
+		response.ResultsURL = gws.resultsURL(bucketName, uploadID)
+
+	case apigRequest.Method == http.MethodDelete:
+		_, abortErr := s3Svc.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(bucketName),
+			Key:      aws.String(objectPath),
+			UploadId: aws.String(multipartUploadID),
+		})
+		if abortErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				abortErr)
+		}
+		gws.updateJobStatus(ctx, bucketName, uploadID, JobStateFailed)
+
+	default:
+		uploadedParts, uploadedPartsErr := gws.listMultipartParts(ctx,
+			bucketName,
+			objectPath,
+			multipartUploadID)
+		if uploadedPartsErr != nil {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+				uploadedPartsErr)
+		}
+		response.Parts = uploadedParts
+	}
+	logger.WithFields(logrus.Fields{
+		"UploadID": uploadID,
+		"Method":   apigRequest.Method,
+		"Path":     resourcePath,
+	}).Info("Multipart upload request")
+	return response, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+
+// newMultipartUploadLambda defines a Lambda function that manages
+// multipart uploads
+func (gws *ServicefulService) newMultipartUploadLambda(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("MultipartUploadProvider",
+		gws.multipartUploadLambda,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.RoleDefinition.Privileges = append(gws.bucketGetPutPrivileges(),
+		gws.bucketMultipartPrivilege())
+	lambdaFn.Options.TracingConfig = &gocf.LambdaFunctionTracingConfig{
+		Mode: gocf.String("Active"),
+	}
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+	if api != nil {
+		routes := []struct {
+			path   string
+			method string
+		}{
+			{"/multipart", http.MethodPost},
+			{"/multipart/{id}", http.MethodGet},
+			{"/multipart/{id}", http.MethodDelete},
+			{"/multipart/{id}/parts", http.MethodPost},
+			{"/multipart/{id}/complete", http.MethodPost},
+		}
+		resources := make(map[string]*sparta.Resource)
+		for _, eachRoute := range routes {
+			apiGatewayResource, exists := resources[eachRoute.path]
+			if !exists {
+				apiGatewayResource, _ = api.NewResource(eachRoute.path, lambdaFn)
+				resources[eachRoute.path] = apiGatewayResource
+			}
+			apiMethod, apiMethodErr := gws.newAPIMethod(apiGatewayResource,
+				eachRoute.method,
+				http.StatusOK,
+				http.StatusBadRequest,
+				http.StatusInternalServerError)
+			if nil != apiMethodErr {
+				panic(fmt.Sprintf("Failed to create %s %s resource: %s",
+					eachRoute.method,
+					eachRoute.path,
+					apiMethodErr.Error()))
+			}
+			if eachRoute.path == "/multipart" {
+				for _, eachParam := range []string{"content_type", "filename", "size", "title"} {
+					apiMethod.Parameters["method.request.querystring."+eachParam] = false
+				}
+			} else {
+				apiMethod.Parameters["method.request.path.id"] = true
+				apiMethod.Parameters["method.request.querystring.multipart_upload_id"] = false
+				apiMethod.Parameters["method.request.querystring.expires_in"] = false
+			}
+			apiMethod.SupportedRequestContentTypes = []string{"application/json"}
+		}
+	}
+	return lambdaFn
+}
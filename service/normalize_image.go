@@ -0,0 +1,357 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	exifTagOrientation = 0x0112
+	jpegMarkerSOS      = 0xDA
+	jpegMarkerEOI      = 0xD9
+	jpegMarkerAPP1     = 0xE1
+)
+
+// exifOrientation returns the EXIF orientation (1-8) of a JPEG, or 1 if
+// there isn't one. Decoders ignore the tag, so phone photos that are
+// stored sideways would otherwise be analyzed sideways.
+func exifOrientation(data []byte) int {
+	offset := 2
+	for offset+4 <= len(data) && data[offset] == 0xFF {
+		marker := data[offset+1]
+		if marker == jpegMarkerSOS || marker == jpegMarkerEOI {
+			break
+		}
+		segmentLength := int(binary.BigEndian.Uint16(data[offset+2:]))
+		segmentEnd := offset + 2 + segmentLength
+		if segmentLength < 2 || segmentEnd > len(data) {
+			break
+		}
+		segment := data[offset+4 : segmentEnd]
+		if marker == jpegMarkerAPP1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset = segmentEnd
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation tag from the first IFD of the
+// TIFF structure embedded in the EXIF segment
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var byteOrder binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		byteOrder = binary.LittleEndian
+	case "MM":
+		byteOrder = binary.BigEndian
+	default:
+		return 1
+	}
+	ifdOffset := int(byteOrder.Uint32(tiff[4:]))
+	if ifdOffset < 8 || ifdOffset+2 > len(tiff) {
+		return 1
+	}
+	entryCount := int(byteOrder.Uint16(tiff[ifdOffset:]))
+	for i := 0; i < entryCount; i++ {
+		entry := ifdOffset + 2 + i*12
+		if entry+12 > len(tiff) {
+			break
+		}
+		if byteOrder.Uint16(tiff[entry:]) == exifTagOrientation {
+			orientation := int(byteOrder.Uint16(tiff[entry+8:]))
+			if orientation >= 1 && orientation <= 8 {
+				return orientation
+			}
+			break
+		}
+	}
+	return 1
+}
+
+// flatten returns the image as RGBA, composited onto white so that
+// transparent PNGs don't turn black when they're encoded as JPEG
+func flatten(src image.Image) *image.RGBA {
+	bounds := src.Bounds()
+	flattened := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), src, bounds.Min, draw.Over)
+	return flattened
+}
+
+// orient returns the image transformed so that it displays upright for
+// the given EXIF orientation
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+	width := src.Bounds().Dx()
+	height := src.Bounds().Dy()
+	// Orientations 5-8 swap the width and height
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			var srcX, srcY int
+			switch orientation {
+			case 2:
+				srcX, srcY = width-1-x, y
+			case 3:
+				srcX, srcY = width-1-x, height-1-y
+			case 4:
+				srcX, srcY = x, height-1-y
+			case 5:
+				srcX, srcY = y, x
+			case 6:
+				srcX, srcY = y, height-1-x
+			case 7:
+				srcX, srcY = width-1-y, height-1-x
+			case 8:
+				srcX, srcY = width-1-y, x
+			}
+			srcOffset := src.PixOffset(srcX, srcY)
+			dstOffset := dst.PixOffset(x, y)
+			copy(dst.Pix[dstOffset:dstOffset+4], src.Pix[srcOffset:srcOffset+4])
+		}
+	}
+	return dst
+}
+
+// fitDimensions returns the dimensions scaled to fit within maxDimension,
+// preserving the aspect ratio. Images are never enlarged.
+func fitDimensions(width int, height int, maxDimension int) (int, int) {
+	if width <= maxDimension && height <= maxDimension {
+		return width, height
+	}
+	if width >= height {
+		return maxDimension, maxInt(1, height*maxDimension/width)
+	}
+	return maxInt(1, width*maxDimension/height), maxDimension
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// downsample resizes the image by averaging the source pixels that cover
+// each destination pixel
+func downsample(src *image.RGBA, width int, height int) *image.RGBA {
+	srcWidth := src.Bounds().Dx()
+	srcHeight := src.Bounds().Dy()
+	if width == srcWidth && height == srcHeight {
+		return src
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		srcY0 := y * srcHeight / height
+		srcY1 := maxInt((y+1)*srcHeight/height, srcY0+1)
+		for x := 0; x < width; x++ {
+			srcX0 := x * srcWidth / width
+			srcX1 := maxInt((x+1)*srcWidth/width, srcX0+1)
+			var sum [4]int
+			for sy := srcY0; sy < srcY1; sy++ {
+				offset := src.PixOffset(srcX0, sy)
+				for sx := srcX0; sx < srcX1; sx++ {
+					for channel := 0; channel < 4; channel++ {
+						sum[channel] += int(src.Pix[offset+channel])
+					}
+					offset += 4
+				}
+			}
+			count := (srcY1 - srcY0) * (srcX1 - srcX0)
+			dstOffset := dst.PixOffset(x, y)
+			for channel := 0; channel < 4; channel++ {
+				dst.Pix[dstOffset+channel] = uint8(sum[channel] / count)
+			}
+		}
+	}
+	return dst
+}
+
+func encodeJPEG(img image.Image, quality int) ([]byte, error) {
+	var output bytes.Buffer
+	encodeErr := jpeg.Encode(&output, img, &jpeg.Options{Quality: quality})
+	if encodeErr != nil {
+		return nil, errors.Wrapf(encodeErr, "Failed to encode JPEG")
+	}
+	return output.Bytes(), nil
+}
+
+// normalizedImage is an upright JPEG rendition of an upload and its
+// thumbnail
+type normalizedImage struct {
+	image     []byte
+	thumbnail []byte
+}
+
+// normalizeImage converts the upload to an upright JPEG that fits within
+// the configured dimension, together with its thumbnail
+func normalizeImage(data []byte, settings *NormalizationSettings) (*normalizedImage, error) {
+	decoded, _, decodeErr := image.Decode(bytes.NewReader(data))
+	if decodeErr != nil {
+		return nil, rejectImage("The image is corrupt and couldn't be read")
+	}
+	upright := orient(flatten(decoded), exifOrientation(data))
+	bounds := upright.Bounds()
+
+	width, height := fitDimensions(bounds.Dx(), bounds.Dy(), settings.MaxDimensionPixels)
+	normalized := downsample(upright, width, height)
+	imageData, imageDataErr := encodeJPEG(normalized, settings.JPEGQuality)
+	if imageDataErr != nil {
+		return nil, imageDataErr
+	}
+	width, height = fitDimensions(width, height, settings.ThumbnailDimensionPixels)
+	thumbnailData, thumbnailDataErr := encodeJPEG(downsample(normalized, width, height),
+		settings.JPEGQuality)
+	if thumbnailDataErr != nil {
+		return nil, thumbnailDataErr
+	}
+	return &normalizedImage{
+		image:     imageData,
+		thumbnail: thumbnailData,
+	}, nil
+}
+
+func (gws *ServicefulService) thumbnailKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceThumbnails, uploadID)
+}
+
+// thumbnailURL returns the public URL of the upload's thumbnail
+func (gws *ServicefulService) thumbnailURL(bucketName string, uploadID string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s",
+		bucketName,
+		gws.thumbnailKey(uploadID))
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Listen for validated uploads and write an upright, size limited JPEG for
+Rekognition together with a public thumbnail
+*/
+func (gws *ServicefulService) onS3PutNormalizeImage(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	handler := func(ctx context.Context,
+		event awsLamdaEvents.S3EventRecord) (interface{}, error) {
+		bucketName := event.S3.Bucket.Name
+		uploadID := gws.baseKeyname(event.S3.Object.Key)
+		keyPath := fmt.Sprintf("%s/%s",
+			gws.connections.S3KeyspaceNormalized,
+			uploadID)
+		if gws.isFresh(ctx, event, keyPath) {
+			return &stageSkipped{Key: keyPath}, nil
+		}
+		validation, validationErr := gws.getImageValidation(ctx,
+			bucketName,
+			event.S3.Object.Key)
+		if validationErr != nil {
+			return nil, validationErr
+		}
+		uploadData, uploadDataErr := gws.getObject(ctx, bucketName, validation.Key)
+		if uploadDataErr != nil {
+			return nil, uploadDataErr
+		}
+		normalized, normalizedErr := normalizeImage(uploadData, &gws.config.Normalization)
+		if normalizedErr != nil {
+			return nil, normalizedErr
+		}
+		blobs := gws.clients(ctx).Blobs
+		// The thumbnail is written first so that it exists by the time the
+		// consolidated report refers to it
+		putErr := blobs.Put(ctx,
+			bucketName,
+			gws.thumbnailKey(uploadID),
+			normalized.thumbnail,
+			&PutOptions{
+				ContentType: "image/jpeg",
+				Tags: map[string]string{
+					tagNameAccess: tagAccessPublic,
+				},
+				Metadata: sourceMetadata(event),
+			})
+		if putErr != nil {
+			return nil, errors.Wrapf(putErr, "Failed to put thumbnail")
+		}
+		putErr = blobs.Put(ctx,
+			bucketName,
+			keyPath,
+			normalized.image,
+			&PutOptions{
+				ContentType: "image/jpeg",
+				Metadata:    sourceMetadata(event),
+			})
+		if putErr != nil {
+			return nil, errors.Wrapf(putErr, "Failed to put normalized image")
+		}
+		logger.WithFields(logrus.Fields{
+			"Key":           keyPath,
+			"Size":          len(normalized.image),
+			"ThumbnailSize": len(normalized.thumbnail),
+		}).Info("Put Item")
+		return nil, nil
+	}
+	handleResult, handleErr := gws.handleS3Records(ctx,
+		s3Event,
+		gws.withJobStatus("NormalizeImage", JobStateNormalized, handler))
+	logger.WithField("Results", handleResult).Info("S3 event results")
+	return handleErr
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Create
+func (gws *ServicefulService) newOnS3PutNormalizeImage(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("NormalizeImage",
+		gws.onS3PutNormalizeImage,
+		sparta.IAMRoleDefinition{})
+	// Decoding full size photos needs the memory, and the CPU that comes
+	// with it
+	lambdaFn.Options = &sparta.LambdaFunctionOptions{
+		Description: "Write an upright JPEG and thumbnail of the upload",
+		MemorySize:  1024,
+		Timeout:     30,
+		TracingConfig: &gocf.LambdaFunctionTracingConfig{
+			Mode: gocf.String("Active"),
+		},
+	}
+	// IAM Role privileges
+	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges()
+
+	// Dependency
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+
+	// Event Triggers
+	gws.subscribeS3Prefix(lambdaFn,
+		"NormalizeImage",
+		gws.connections.S3KeyspaceValidations,
+		gws.onS3PutNormalizeImage,
+		gws.connections.S3KeyspaceNormalized,
+		gws.connections.S3KeyspaceThumbnails)
+
+	return lambdaFn
+}
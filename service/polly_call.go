@@ -4,18 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"os"
-	"path/filepath"
+	"html"
+	"io/ioutil"
 	"time"
 
 	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/polly"
 	"github.com/aws/aws-sdk-go/service/rekognition"
-	"github.com/aws/aws-sdk-go/service/s3"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
 	gocf "github.com/mweagle/go-cloudformation"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -28,11 +25,45 @@ It appears that your image includes the text quote <break time="1s"/>
 <prosody pitch="x-high"> %s </prosody> endquote <break time="1s"/> with a confidence of %.2f percent.
 </speak>`
 	pollySSMLLabelTemplate = `<speak>
-It appears that this image includes <amazon:breath/><break time="1s"/><emphasis>
+It appears that %s includes <amazon:breath/><break time="1s"/><emphasis>
  %s</emphasis><break time="1s"/> with a confidence of %.2f percent.
 </speak>`
 )
 
+// pollyVoiceID returns the voice set in Parameter Store, or the default
+func pollyVoiceID(clients *Clients) string {
+	pollyVoice, _ := clients.Parameters.GetExpiringString("/SpartaPollyWorkflow/VoiceId",
+		30*time.Second)
+	if pollyVoice == "" {
+		pollyVoice = defaultPollyVoice
+	}
+	return pollyVoice
+}
+
+// synthesizeSpeech returns the mp3 narration of the text or SSML
+func synthesizeSpeech(ctx context.Context,
+	pollySvc PollyAPI,
+	pollyVoice string,
+	synthesizeText string,
+	textType string) ([]byte, error) {
+	pollyInput := polly.SynthesizeSpeechInput{
+		Text:         aws.String(synthesizeText),
+		TextType:     aws.String(textType),
+		OutputFormat: aws.String("mp3"),
+		VoiceId:      aws.String(pollyVoice),
+	}
+	pollyOutput, pollyOutputErr := pollySvc.SynthesizeSpeechWithContext(ctx, &pollyInput)
+	if pollyOutputErr != nil {
+		return nil, pollyOutputErr
+	}
+	defer pollyOutput.AudioStream.Close()
+	audioData, audioDataErr := ioutil.ReadAll(pollyOutput.AudioStream)
+	if audioDataErr != nil {
+		return nil, errors.Wrapf(audioDataErr, "Failed to read audio stream")
+	}
+	return audioData, nil
+}
+
 /*
 ================================================================================
 ╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
@@ -43,19 +74,21 @@ Listen for PutObject events and submit the image to Rekognition
 */
 func (gws *ServicefulService) onS3PutCallPolly(ctx context.Context, s3Event awsLamdaEvents.S3Event) error {
 	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	awsSession := spartaAWS.NewSession(logger)
-	s3Svc := s3.New(awsSession)
-	pollySvc := polly.New(awsSession)
-	pollyVoice, _ := gws.cacheClient.GetExpiringString("/SpartaPollyWorkflow/VoiceId",
-		30*time.Second)
-	if pollyVoice == "" {
-		pollyVoice = defaultPollyVoice
-	}
+	clients := gws.clients(ctx)
+	pollyVoice := pollyVoiceID(clients)
 	// Process all the events...
 	handler := func(ctx context.Context, event awsLamdaEvents.S3EventRecord) (interface{}, error) {
+		// So we only want the last part of the input key
+		baseName := gws.baseKeyname(event.S3.Object.Key)
+		keyPath := fmt.Sprintf("%s/%s",
+			gws.connections.S3KeyspacePollyArtifacts,
+			baseName)
+		if gws.isFresh(ctx, event, keyPath) {
+			return &stageSkipped{Key: keyPath}, nil
+		}
 
 		// Get the JSON output from Rekognition
-		rekognitionData, rekognitionDataErr := gws.getS3Object(ctx, event.S3.Bucket.Name, event.S3.Object.Key)
+		rekognitionData, rekognitionDataErr := gws.getObject(ctx, event.S3.Bucket.Name, event.S3.Object.Key)
 		if rekognitionDataErr != nil {
 			return nil, rekognitionDataErr
 		}
@@ -64,66 +97,55 @@ func (gws *ServicefulService) onS3PutCallPolly(ctx context.Context, s3Event awsL
 		if unmarshalErr != nil {
 			return nil, unmarshalErr
 		}
+		// Refer to the upload by its title, if we know it
+		uploadMetadata, uploadMetadataErr := gws.getUploadMetadata(ctx,
+			event.S3.Bucket.Name,
+			baseName)
+		if uploadMetadataErr != nil {
+			return nil, uploadMetadataErr
+		}
+		subject := uploadMetadata.subject()
 		textType := "text"
-		synthesizeText := "I'm afraid I didn't find anything in your image"
-		currentScore := float64(0.0)
-		for _, eachLabel := range rekognitionResponse.Labels {
-			if *eachLabel.Confidence >= currentScore {
-				synthesizeText = fmt.Sprintf(pollySSMLLabelTemplate,
-					*eachLabel.Name,
-					*eachLabel.Confidence)
-				currentScore = *eachLabel.Confidence
-				textType = "ssml"
-			}
+		synthesizeText := fmt.Sprintf("I'm afraid I didn't find anything in %s", subject)
+		// Narrate the most confident of the ranked labels. Ranking collapses
+		// ancestors into their descendants, so the generic labels are gone.
+		rankedLabels := gws.rankLabels(&rekognitionResponse)
+		if len(rankedLabels) != 0 {
+			synthesizeText = fmt.Sprintf(pollySSMLLabelTemplate,
+				html.EscapeString(subject),
+				html.EscapeString(rankedLabels[0].Name),
+				rankedLabels[0].Confidence)
+			textType = "ssml"
 		}
 		// Super send it to polly
-		pollyInput := polly.SynthesizeSpeechInput{
-			Text:         aws.String(synthesizeText),
-			TextType:     aws.String(textType),
-			OutputFormat: aws.String("mp3"),
-			VoiceId:      aws.String(pollyVoice),
-		}
-		pollyOutput, pollyOutputErr := pollySvc.SynthesizeSpeech(&pollyInput)
-		if pollyOutputErr != nil {
-			return nil, pollyOutputErr
+		audioData, audioDataErr := synthesizeSpeech(ctx,
+			clients.Polly,
+			pollyVoice,
+			synthesizeText,
+			textType)
+		if audioDataErr != nil {
+			return nil, audioDataErr
 		}
-		// Winning, write it back to the location...
-		// So we only want the last part of the input key
-		baseName := gws.baseKeyname(event.S3.Object.Key)
-
-		// Copy the response to a /tmp file
-		outputFilePath := filepath.Join("/tmp", baseName)
-		outputFileHandle, outputFileHandleErr := os.Create(outputFilePath)
-		if outputFileHandleErr != nil {
-			return nil, outputFileHandleErr
-		}
-		defer outputFileHandle.Close()
-		defer os.Remove(outputFilePath)
-		_, copyErr := io.Copy(outputFileHandle, pollyOutput.AudioStream)
-		if copyErr != nil {
-			return nil, nil
-		}
-		outputFileHandle.Seek(0, 0)
 
 		// Save it to the other location
-		putObjectInput := &s3.PutObjectInput{
-			Body:   outputFileHandle,
-			Bucket: aws.String(event.S3.Bucket.Name),
-			Key: aws.String(fmt.Sprintf("%s/%s",
-				gws.connections.S3KeyspacePollyArtifacts,
-				baseName)),
-			ContentType: aws.String("audio/mpeg3"),
+		putOptions := &PutOptions{
+			ContentType: "audio/mpeg3",
+			Metadata:    sourceMetadata(event),
 		}
-		defer pollyOutput.AudioStream.Close()
-
-		putResult, putResultErr := s3Svc.PutObject(putObjectInput)
-		if putResultErr != nil {
-			return nil, errors.Wrapf(putResultErr, "Failed to put mp3 response: %#v", putObjectInput)
+		putErr := clients.Blobs.Put(ctx,
+			event.S3.Bucket.Name,
+			keyPath,
+			audioData,
+			putOptions)
+		if putErr != nil {
+			return nil, errors.Wrapf(putErr, "Failed to put mp3 response: %s", keyPath)
 		}
-		logger.WithField("Result", *putResult).Info("Put Item")
+		logger.WithField("Key", keyPath).Info("Put Item")
 		return nil, nil
 	}
-	handleResult, handleErr := gws.handleS3Records(ctx, s3Event, handler)
+	handleResult, handleErr := gws.handleS3Records(ctx,
+		s3Event,
+		gws.withJobStatus("PollyRelay", JobStateAudioSynthesized, handler))
 	logger.WithField("Results", handleResult).Info("S3 event results")
 	return handleErr
 }
@@ -147,8 +169,11 @@ func (gws *ServicefulService) newOnS3PutCallPolly(api *sparta.API) *sparta.Lambd
 	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges("polly:SynthesizeSpeech")
 
 	// Event Triggers
-	lambdaFn.Permissions = append(lambdaFn.Permissions,
-		gws.s3NotificationPrefixBasedPermission(gws.connections.S3KeyspaceRekognitionArtifacts))
+	gws.subscribeS3Prefix(lambdaFn,
+		"PollyRelay",
+		gws.rekognitionKeyspace(rekognitionAnalysisLabels),
+		gws.onS3PutCallPolly,
+		gws.connections.S3KeyspacePollyArtifacts)
 
 	// Dependency
 	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+const (
+	postPolicyAlgorithm = "AWS4-HMAC-SHA256"
+	postPolicyDate      = "20060102"
+	postPolicyTimestamp = "20060102T150405Z"
+)
+
+// presignedPost is the URL and form fields for a browser based POST
+// upload. The file must be the last field in the form.
+type presignedPost struct {
+	URL    string
+	Fields map[string]string
+}
+
+// postPolicyConstraints are the conditions the upload must satisfy
+type postPolicyConstraints struct {
+	contentType  string
+	minSizeBytes int64
+	maxSizeBytes int64
+	// checksum is the optional SHA-256 digest S3 verifies the body against
+	checksum *UploadChecksum
+	// metadata is the user metadata the upload must include
+	metadata map[string]string
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// presignPost returns a SigV4 signed POST policy for the key. The
+// credentials, region and endpoint are taken from the S3 client, so the
+// policy works with any S3 compatible endpoint the client targets.
+func presignPost(s3Svc S3API,
+	bucket string,
+	key string,
+	expiry time.Duration,
+	constraints *postPolicyConstraints) (*presignedPost, error) {
+	// Building an unsent request resolves the client's endpoint,
+	// addressing style and credentials
+	putRequest, _ := s3Svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	buildErr := putRequest.Build()
+	if buildErr != nil {
+		return nil, errors.Wrapf(buildErr, "Failed to resolve upload endpoint")
+	}
+	creds, credsErr := putRequest.Config.Credentials.Get()
+	if credsErr != nil {
+		return nil, errors.Wrapf(credsErr, "Failed to get signing credentials")
+	}
+	region := aws.StringValue(putRequest.Config.Region)
+	postURL := *putRequest.HTTPRequest.URL
+	postURL.Path = strings.TrimSuffix(postURL.Path, key)
+	postURL.RawPath = ""
+	postURL.RawQuery = ""
+
+	now := time.Now().UTC()
+	credential := fmt.Sprintf("%s/%s/%s/s3/aws4_request",
+		creds.AccessKeyID,
+		now.Format(postPolicyDate),
+		region)
+	fields := map[string]string{
+		"key":              key,
+		"Content-Type":     constraints.contentType,
+		"x-amz-algorithm":  postPolicyAlgorithm,
+		"x-amz-credential": credential,
+		"x-amz-date":       now.Format(postPolicyTimestamp),
+	}
+	if creds.SessionToken != "" {
+		fields["x-amz-security-token"] = creds.SessionToken
+	}
+	if constraints.checksum != nil {
+		fields["x-amz-checksum-algorithm"] = constraints.checksum.Algorithm
+		fields["x-amz-checksum-sha256"] = constraints.checksum.base64Value()
+	}
+	for eachName, eachValue := range constraints.metadata {
+		fields["x-amz-meta-"+eachName] = eachValue
+	}
+	conditions := []interface{}{
+		map[string]string{"bucket": bucket},
+		[]interface{}{"content-length-range", constraints.minSizeBytes, constraints.maxSizeBytes},
+	}
+	for eachName, eachValue := range fields {
+		conditions = append(conditions, []interface{}{"eq", "$" + eachName, eachValue})
+	}
+	policy := map[string]interface{}{
+		"expiration": now.Add(expiry).Format(time.RFC3339),
+		"conditions": conditions,
+	}
+	policyJSON, policyJSONErr := json.Marshal(policy)
+	if policyJSONErr != nil {
+		return nil, errors.Wrapf(policyJSONErr, "Failed to marshal POST policy")
+	}
+	encodedPolicy := base64.StdEncoding.EncodeToString(policyJSON)
+
+	signingKey := hmacSHA256([]byte("AWS4"+creds.SecretAccessKey), now.Format(postPolicyDate))
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	fields["policy"] = encodedPolicy
+	fields["x-amz-signature"] = hex.EncodeToString(hmacSHA256(signingKey, encodedPolicy))
+
+	return &presignedPost{
+		URL:    postURL.String(),
+		Fields: fields,
+	}, nil
+}
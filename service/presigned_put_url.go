@@ -4,21 +4,226 @@ import (
 	"context"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	awsLambdaContext "github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
 	spartaEvents "github.com/mweagle/Sparta/aws/events"
 	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	presignModePut  = "put"
+	presignModePost = "post"
+)
+
 type presignedResponse struct {
-	PresignedURL string `json:"put_object_url"`
-	ResultsURL   string `json:"results_url"`
+	UploadID     string `json:"upload_id"`
+	PresignedURL string `json:"put_object_url,omitempty"`
+	// PresignedHeaders are the signed headers the PUT must include
+	PresignedHeaders map[string]string `json:"put_object_headers,omitempty"`
+	ResultsURL       string            `json:"results_url"`
+	// PostURL and PostFields are returned for the post mode. The fields
+	// must be sent as multipart/form-data, followed by the file.
+	PostURL    string            `json:"post_url,omitempty"`
+	PostFields map[string]string `json:"post_fields,omitempty"`
+}
+
+// uploadContentType returns the requested content type if it's one of
+// the accepted types
+func uploadContentType(requested string, acceptedTypes []string) (string, bool) {
+	for _, eachType := range acceptedTypes {
+		if strings.EqualFold(eachType, requested) {
+			return eachType, true
+		}
+	}
+	return "", false
+}
+
+// uploadKey returns the key the upload is stored under
+func (gws *ServicefulService) uploadKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceUploads, uploadID)
+}
+
+// resultsURL returns the public URL of the upload's consolidated report
+func (gws *ServicefulService) resultsURL(bucketName string, uploadID string) string {
+	return fmt.Sprintf("https://%s.s3.amazonaws.com/%s/%s",
+		bucketName,
+		gws.connections.S3KeyspaceConsolidatedStatus,
+		uploadID)
+}
+
+// uploadRequest is a validated request for a presigned upload
+type uploadRequest struct {
+	uploadID    string
+	mode        string
+	contentType string
+	expiry      time.Duration
+	metadata    *UploadMetadata
+}
+
+// checksum returns the client declared checksum, if any
+func (request *uploadRequest) checksum() *UploadChecksum {
+	if request.metadata == nil {
+		return nil
+	}
+	return request.metadata.Checksum
+}
+
+// subject returns the authenticated user that requested the upload, if any
+func (request *uploadRequest) subject() string {
+	if request.metadata == nil {
+		return ""
+	}
+	return request.metadata.Subject
+}
+
+// attribute records the authenticated user that requested the upload
+func (request *uploadRequest) attribute(subject string) {
+	if subject == "" {
+		return
+	}
+	if request.metadata == nil {
+		request.metadata = &UploadMetadata{
+			UploadID: request.uploadID,
+			Created:  time.Now().UTC(),
+		}
+	}
+	request.metadata.Subject = subject
+}
+
+// newUploadRequest validates the upload parameters. Errors describe
+// invalid client input.
+func (gws *ServicefulService) newUploadRequest(uploadID string,
+	params map[string]string) (*uploadRequest, error) {
+	mode := params["mode"]
+	if mode == "" {
+		mode = presignModePut
+	}
+	if mode != presignModePut && mode != presignModePost {
+		return nil, errors.Errorf("Unsupported mode: %s", mode)
+	}
+	contentType, contentTypeOK := uploadContentType(params["content_type"],
+		gws.config.Uploads.ContentTypes)
+	if mode == presignModePost && !contentTypeOK {
+		return nil, errors.Errorf("content_type must be one of: %s",
+			strings.Join(gws.config.Uploads.ContentTypes, ", "))
+	}
+	uploadMetadata, uploadMetadataErr := newUploadMetadata(uploadID, params)
+	if uploadMetadataErr != nil {
+		return nil, uploadMetadataErr
+	}
+	expiry, expiryErr := gws.presignExpiry(params)
+	if expiryErr != nil {
+		return nil, expiryErr
+	}
+	request := &uploadRequest{
+		uploadID:    uploadID,
+		mode:        mode,
+		contentType: contentType,
+		expiry:      expiry,
+		metadata:    uploadMetadata,
+	}
+	// POST policies can only require the x-amz-checksum fields
+	checksum := request.checksum()
+	if mode == presignModePost && checksum != nil && checksum.Algorithm != ChecksumSHA256 {
+		return nil, errors.New("The post mode only supports sha256 checksums")
+	}
+	return request, nil
+}
+
+// presign returns the presigned URL or POST policy for the upload
+func (gws *ServicefulService) presign(ctx context.Context,
+	bucketName string,
+	request *uploadRequest) (*presignedResponse, error) {
+	objectPath := gws.uploadKey(request.uploadID)
+	checksum := request.checksum()
+	uploadObjectMetadata := subjectMetadata(request.subject())
+	response := &presignedResponse{
+		UploadID: request.uploadID,
+	}
+	if request.mode == presignModePost {
+		constraints := &postPolicyConstraints{
+			contentType:  request.contentType,
+			minSizeBytes: gws.config.Uploads.MinSizeBytes,
+			maxSizeBytes: gws.config.Uploads.MaxSizeBytes,
+			checksum:     checksum,
+			metadata:     uploadObjectMetadata,
+		}
+		post, postErr := presignPost(gws.clients(ctx).S3,
+			bucketName,
+			objectPath,
+			request.expiry,
+			constraints)
+		if postErr != nil {
+			return nil, postErr
+		}
+		response.PostURL = post.URL
+		response.PostFields = post.Fields
+	} else {
+		putObjectInput := &s3.PutObjectInput{
+			Bucket: aws.String(bucketName),
+			Key:    aws.String(objectPath),
+		}
+		if len(uploadObjectMetadata) != 0 {
+			putObjectInput.Metadata = aws.StringMap(uploadObjectMetadata)
+		}
+		if checksum != nil && checksum.Algorithm == ChecksumMD5 {
+			putObjectInput.ContentMD5 = aws.String(checksum.base64Value())
+		}
+		presignedReq, _ := gws.clients(ctx).S3.PutObjectRequest(putObjectInput)
+		// A signed payload hash makes S3 verify the body's SHA-256
+		if checksum != nil && checksum.Algorithm == ChecksumSHA256 {
+			presignedReq.HTTPRequest.Header.Set("X-Amz-Content-Sha256", checksum.Value)
+		}
+		url, signedHeaders, err := presignedReq.PresignRequest(request.expiry)
+		if nil != err {
+			return nil, err
+		}
+		response.PresignedURL = url
+		response.PresignedHeaders = make(map[string]string)
+		for eachHeader := range signedHeaders {
+			// The host header is implied by the URL
+			if !strings.EqualFold(eachHeader, "Host") {
+				response.PresignedHeaders[eachHeader] = signedHeaders.Get(eachHeader)
+			}
+		}
+	}
+	response.ResultsURL = gws.resultsURL(bucketName, request.uploadID)
+	return response, nil
+}
+
+// presignUpload presigns the upload, saves its metadata and records that
+// it's awaiting the upload
+func (gws *ServicefulService) presignUpload(ctx context.Context,
+	bucketName string,
+	request *uploadRequest) (*presignedResponse, error) {
+	response, responseErr := gws.presign(ctx, bucketName, request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	uploadObjectMetadata := subjectMetadata(request.subject())
+	if request.metadata != nil {
+		putErr := gws.putJSONObject(ctx,
+			bucketName,
+			gws.uploadMetadataKey(request.uploadID),
+			request.metadata,
+			&PutOptions{Metadata: uploadObjectMetadata})
+		if putErr != nil {
+			return nil, putErr
+		}
+	}
+	gws.updateJobStatus(ctx,
+		bucketName,
+		request.uploadID,
+		JobStateAwaitingUpload)
+	return response, nil
 }
 
 /*
@@ -27,49 +232,112 @@ type presignedResponse struct {
 ║  ╠═╣║║║╠╩╗ ║║╠═╣
 ╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
 ================================================================================
-Create a presigned URL
+Create a presigned URL. The optional mode=post query parameter returns a
+presigned POST policy, which constrains the upload's size and requires the
+content_type query parameter to be one of the accepted image types. The
+optional filename, content_type, size and title parameters are saved as
+the upload's metadata, along with the authenticated subject when the JWT
+authorizer is enabled. The optional sha256 or md5 digest is included in
+the signature, and expires_in requests a non-default lifetime. Requests
+that repeat an Idempotency-Key header return the original upload, signed
+again so that its URL hasn't expired. Clients that exceed their quota
+receive a 429 with Retry-After.
 */
 func (gws *ServicefulService) s3GetPresignedURLLambda(ctx context.Context,
-	apigRequest spartaEvents.APIGatewayRequest) (*presignedResponse, error) {
+	apigRequest spartaEvents.APIGatewayRequest) (interface{}, error) {
 	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
 	lambdaContext, _ := awsLambdaContext.FromContext(ctx)
 
-	discover, discoveryInfoErr := sparta.Discover()
-	if discoveryInfoErr != nil {
-		return nil, discoveryInfoErr
+	exceeded := gws.checkRateLimit(ctx,
+		"presigned",
+		gws.config.RateLimits.PresignedPerMinute,
+		gws.config.RateLimits.PresignedPerDay,
+		&apigRequest.Context,
+		1)
+	if exceeded != nil {
+		return rateLimitedResponse(exceeded), nil
 	}
 
-	s3Resource := discover.Resources[gws.connections.S3UploadBucketResourceName]
+	uploadID, uploadIDErr := gws.uploadIDs.NewID()
+	if uploadIDErr != nil {
+		return nil, uploadIDErr
+	}
+	request, requestErr := gws.newUploadRequest(uploadID, apigRequest.QueryParams)
+	if requestErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			requestErr.Error())
+	}
+	subject, subjectErr := gws.requestSubject(ctx, apigRequest.Headers)
+	if subjectErr != nil {
+		return nil, subjectErr
+	}
+	request.attribute(subject)
+	clientKey, clientKeyErr := idempotencyKey(apigRequest.Headers)
+	if clientKeyErr != nil {
+		return nil, spartaAPIGateway.NewErrorResponse(http.StatusBadRequest,
+			clientKeyErr.Error())
+	}
+	// Users can't replay each other's keys
+	if clientKey != "" && subject != "" {
+		clientKey = subject + "\n" + clientKey
+	}
+
+	bucketName, bucketNameErr := gws.bucketName()
+	if bucketNameErr != nil {
+		return nil, bucketNameErr
+	}
+
+	fingerprint := requestFingerprint(apigRequest.QueryParams)
+	if clientKey != "" {
+		previousResponse, previousResponseErr := gws.getIdempotentResponse(ctx,
+			bucketName,
+			clientKey,
+			fingerprint)
+		if previousResponseErr == errIdempotencyKeyReused {
+			return nil, spartaAPIGateway.NewErrorResponse(http.StatusConflict,
+				previousResponseErr.Error())
+		} else if previousResponseErr != nil {
+			return nil, previousResponseErr
+		}
+		if previousResponse != nil {
+			logger.WithFields(logrus.Fields{
+				"RequestID": lambdaContext.AwsRequestID,
+				"UploadID":  previousResponse.UploadID,
+			}).Info("Returning upload for repeated Idempotency-Key")
+			// The fingerprint matched, so the parameters are the same as the
+			// original request's
+			previousRequest, previousRequestErr := gws.newUploadRequest(previousResponse.UploadID,
+				apigRequest.QueryParams)
+			if previousRequestErr != nil {
+				return nil, previousRequestErr
+			}
+			previousRequest.attribute(subject)
+			return gws.presign(ctx, bucketName, previousRequest)
+		}
+	}
 
 	logger.WithFields(logrus.Fields{
-		"RequestID":           lambdaContext.AwsRequestID,
-		"S3Ref":               s3Resource.ResourceRef,
-		"S3ResourcePoperties": s3Resource.Properties,
+		"RequestID": lambdaContext.AwsRequestID,
+		"UploadID":  uploadID,
+		"Subject":   subject,
+		"S3Ref":     bucketName,
 	}).Info("Request received")
 
-	objectPath := fmt.Sprintf("%s/%s",
-		gws.connections.S3KeyspaceUploads,
-		lambdaContext.AwsRequestID)
-	putObjectInput := &s3.PutObjectInput{
-		Bucket: aws.String(s3Resource.ResourceRef),
-		Key:    aws.String(objectPath),
-	}
-	awsSession := spartaAWS.NewSession(logger)
-	s3svc := s3.New(awsSession)
-	presignedReq, _ := s3svc.PutObjectRequest(putObjectInput)
-	url, err := presignedReq.Presign(5 * time.Minute)
-	if nil != err {
-		return nil, err
-	}
-	resultsURL := fmt.Sprintf("https://%s.s3.amazonaws.com/%s/%s",
-		s3Resource.ResourceRef,
-		gws.connections.S3KeyspaceConsolidatedStatus,
-		lambdaContext.AwsRequestID)
-
-	return &presignedResponse{
-		PresignedURL: url,
-		ResultsURL:   resultsURL,
-	}, nil
+	response, responseErr := gws.presignUpload(ctx, bucketName, request)
+	if responseErr != nil {
+		return nil, responseErr
+	}
+	if clientKey != "" {
+		putErr := gws.putIdempotentResponse(ctx,
+			bucketName,
+			clientKey,
+			fingerprint,
+			response)
+		if putErr != nil {
+			return nil, putErr
+		}
+	}
+	return response, nil
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -82,22 +350,36 @@ func (gws *ServicefulService) newS3PresignedPutItemLambda(api *sparta.API) *spar
 		gws.s3GetPresignedURLLambda,
 		sparta.IAMRoleDefinition{})
 	// IAM
-	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges()
+	lambdaFn.RoleDefinition.Privileges = append(gws.bucketGetPutPrivileges(),
+		gws.rateLimitPrivilege())
 	// X-Ray
 	lambdaFn.Options.TracingConfig = &gocf.LambdaFunctionTracingConfig{
 		Mode: gocf.String("Active"),
 	}
-	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName,
+		gws.connections.RateLimitTableResourceName}
 	if api != nil {
 		apiGatewayResource, _ := api.NewResource("/presigned", lambdaFn)
 
-		// We only return http.StatusOK
-		apiMethod, apiMethodErr := apiGatewayResource.NewMethod("GET",
+		apiMethod, apiMethodErr := gws.newAPIMethod(apiGatewayResource,
+			"GET",
 			http.StatusOK,
+			http.StatusBadRequest,
+			http.StatusConflict,
+			http.StatusTooManyRequests,
 			http.StatusInternalServerError)
 		if nil != apiMethodErr {
 			panic("Failed to create /presigned resource: " + apiMethodErr.Error())
 		}
+		apiMethod.Parameters["method.request.querystring.mode"] = false
+		apiMethod.Parameters["method.request.querystring.content_type"] = false
+		apiMethod.Parameters["method.request.querystring.filename"] = false
+		apiMethod.Parameters["method.request.querystring.size"] = false
+		apiMethod.Parameters["method.request.querystring.title"] = false
+		apiMethod.Parameters["method.request.querystring.sha256"] = false
+		apiMethod.Parameters["method.request.querystring.md5"] = false
+		apiMethod.Parameters["method.request.querystring.expires_in"] = false
+		apiMethod.Parameters["method.request.header.Idempotency-Key"] = false
 		// The lambda resource only supports application/json Unmarshallable
 		// requests.
 		apiMethod.SupportedRequestContentTypes = []string{"application/json"}
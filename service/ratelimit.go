@@ -0,0 +1,183 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+	spartaAPIGateway "github.com/mweagle/Sparta/aws/apigateway"
+	spartaEvents "github.com/mweagle/Sparta/aws/events"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// RateLimitStore holds the request counters of the rate limited
+// endpoints. Implementations are provided for DynamoDB and memory.
+type RateLimitStore interface {
+	// Increment adds delta to the counter, creating it if necessary, and
+	// returns the new value. The counter may be discarded after expires.
+	Increment(ctx context.Context,
+		table string,
+		key string,
+		delta int64,
+		expires time.Time) (int64, error)
+}
+
+// Compile time checks that the implementations satisfy RateLimitStore
+var (
+	_ RateLimitStore = (*dynamoDBRateLimitStore)(nil)
+	_ RateLimitStore = (*MemoryRateLimitStore)(nil)
+)
+
+// rateLimitWindow is a fixed quota period
+type rateLimitWindow struct {
+	name     string
+	duration time.Duration
+}
+
+var (
+	rateLimitMinute = &rateLimitWindow{name: "minute", duration: time.Minute}
+	rateLimitDay    = &rateLimitWindow{name: "day", duration: 24 * time.Hour}
+)
+
+// rateLimitExceeded is returned when a client has used its quota
+type rateLimitExceeded struct {
+	window     *rateLimitWindow
+	limit      int
+	retryAfter time.Duration
+}
+
+func (exceeded *rateLimitExceeded) Error() string {
+	return fmt.Sprintf("Rate limit of %d requests per %s exceeded",
+		exceeded.limit,
+		exceeded.window.name)
+}
+
+// retryAfterSeconds returns the Retry-After value, rounded up so that a
+// client that waits exactly that long is admitted
+func (exceeded *rateLimitExceeded) retryAfterSeconds() int {
+	return int(math.Ceil(exceeded.retryAfter.Seconds()))
+}
+
+// rateLimitClient identifies the caller. The API key is preferred, since
+// many clients may share a source IP. It's hashed so that the key isn't
+// stored.
+func rateLimitClient(requestContext *spartaEvents.APIGatewayContext) string {
+	apiKey := requestContext.Identity.APIKey
+	if apiKey != "" {
+		keyDigest := sha256.Sum256([]byte(apiKey))
+		return "key:" + hex.EncodeToString(keyDigest[:])
+	}
+	return "ip:" + requestContext.Identity.SourceIP
+}
+
+// rateLimitTableName returns the name of the table that holds the
+// counters
+func (gws *ServicefulService) rateLimitTableName() (string, error) {
+	if gws.connections.RateLimitTableName != "" {
+		return gws.connections.RateLimitTableName, nil
+	}
+	discover, discoveryInfoErr := sparta.Discover()
+	if discoveryInfoErr != nil {
+		return "", discoveryInfoErr
+	}
+	tableResource, exists := discover.Resources[gws.connections.RateLimitTableResourceName]
+	if !exists {
+		return "", errors.Errorf("Failed to discover resource: %s",
+			gws.connections.RateLimitTableResourceName)
+	}
+	return tableResource.ResourceRef, nil
+}
+
+// checkRateLimit charges cost requests to the client's per minute and
+// per day quotas for the endpoint. It returns the exceeded quota, or nil if the request is
+// admitted. The limiter fails open, so that an unavailable store doesn't
+// take the endpoint down with it.
+func (gws *ServicefulService) checkRateLimit(ctx context.Context,
+	endpoint string,
+	perMinute int,
+	perDay int,
+	requestContext *spartaEvents.APIGatewayContext,
+	cost int) *rateLimitExceeded {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	if perMinute <= 0 && perDay <= 0 {
+		return nil
+	}
+	tableName, tableNameErr := gws.rateLimitTableName()
+	if tableNameErr != nil {
+		logger.WithField("Error", tableNameErr).Warn("Rate limiting is unavailable")
+		return nil
+	}
+	client := rateLimitClient(requestContext)
+	quotas := []struct {
+		window *rateLimitWindow
+		limit  int
+	}{
+		{rateLimitMinute, perMinute},
+		{rateLimitDay, perDay},
+	}
+	for _, eachQuota := range quotas {
+		if eachQuota.limit <= 0 {
+			continue
+		}
+		now := time.Now().UTC()
+		windowStart := now.Truncate(eachQuota.window.duration)
+		windowEnd := windowStart.Add(eachQuota.window.duration)
+		counterKey := fmt.Sprintf("%s#%s#%s#%d",
+			endpoint,
+			client,
+			eachQuota.window.name,
+			windowStart.Unix())
+		count, countErr := gws.clients(ctx).RateLimits.Increment(ctx,
+			tableName,
+			counterKey,
+			int64(cost),
+			windowEnd)
+		if countErr != nil {
+			logger.WithField("Error", countErr).Warn("Rate limiting is unavailable")
+			return nil
+		}
+		if count > int64(eachQuota.limit) {
+			logger.WithFields(logrus.Fields{
+				"Endpoint": endpoint,
+				"Client":   client,
+				"Window":   eachQuota.window.name,
+				"Count":    count,
+			}).Warn("Rate limit exceeded")
+			return &rateLimitExceeded{
+				window:     eachQuota.window,
+				limit:      eachQuota.limit,
+				retryAfter: windowEnd.Sub(now),
+			}
+		}
+	}
+	return nil
+}
+
+// rateLimitPrivilege allows the function to update the rate limit
+// counters
+func (gws *ServicefulService) rateLimitPrivilege() sparta.IAMRolePrivilege {
+	return sparta.IAMRolePrivilege{
+		Actions:  []string{"dynamodb:UpdateItem"},
+		Resource: gocf.GetAtt(gws.connections.RateLimitTableResourceName, "Arn"),
+	}
+}
+
+// rateLimitedResponse returns the 429 response for the exceeded quota
+func rateLimitedResponse(exceeded *rateLimitExceeded) *spartaAPIGateway.Response {
+	return spartaAPIGateway.NewResponse(http.StatusTooManyRequests,
+		map[string]string{
+			"error": exceeded.Error(),
+		},
+		map[string]string{
+			"Retry-After": strconv.Itoa(exceeded.retryAfterSeconds()),
+		})
+}
@@ -0,0 +1,77 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/pkg/errors"
+)
+
+const (
+	// rateLimitKeyAttribute is the rate limit table's partition key
+	rateLimitKeyAttribute   = "counter"
+	rateLimitCountAttribute = "count"
+	// rateLimitExpiresAttribute is the table's TTL attribute
+	rateLimitExpiresAttribute = "expires_at"
+)
+
+// dynamoDBRateLimitStore is the RateLimitStore backed by a DynamoDB table.
+// Counters are atomically incremented, so concurrent function instances
+// share the quota.
+type dynamoDBRateLimitStore struct {
+	dynamoDBSvc DynamoDBAPI
+}
+
+// NewDynamoDBRateLimitStore returns a RateLimitStore that uses the given
+// DynamoDB client
+func NewDynamoDBRateLimitStore(dynamoDBSvc DynamoDBAPI) RateLimitStore {
+	return &dynamoDBRateLimitStore{
+		dynamoDBSvc: dynamoDBSvc,
+	}
+}
+
+// Increment satisfies RateLimitStore
+func (store *dynamoDBRateLimitStore) Increment(ctx context.Context,
+	table string,
+	key string,
+	delta int64,
+	expires time.Time) (int64, error) {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			rateLimitKeyAttribute: &dynamodb.AttributeValue{
+				S: aws.String(key),
+			},
+		},
+		UpdateExpression: aws.String("ADD #count :delta SET #expires = if_not_exists(#expires, :expires)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count":   aws.String(rateLimitCountAttribute),
+			"#expires": aws.String(rateLimitExpiresAttribute),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":delta": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(delta, 10)),
+			},
+			":expires": &dynamodb.AttributeValue{
+				N: aws.String(strconv.FormatInt(expires.Unix(), 10)),
+			},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueUpdatedNew),
+	}
+	output, outputErr := store.dynamoDBSvc.UpdateItemWithContext(ctx, input)
+	if outputErr != nil {
+		return 0, errors.Wrapf(outputErr, "Failed to increment counter: %s", key)
+	}
+	countValue, exists := output.Attributes[rateLimitCountAttribute]
+	if !exists || countValue.N == nil {
+		return 0, errors.Errorf("Counter update didn't return a count: %s", key)
+	}
+	count, countErr := strconv.ParseInt(aws.StringValue(countValue.N), 10, 64)
+	if countErr != nil {
+		return 0, errors.Wrapf(countErr, "Failed to parse counter: %s", key)
+	}
+	return count, nil
+}
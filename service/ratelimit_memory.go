@@ -0,0 +1,56 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type memoryCounter struct {
+	count   int64
+	expires time.Time
+}
+
+// MemoryRateLimitStore is a RateLimitStore that keeps the counters in
+// memory. The counters aren't shared between processes, so it's only
+// suitable for local use.
+type MemoryRateLimitStore struct {
+	mu       sync.Mutex
+	counters map[string]*memoryCounter
+}
+
+// NewMemoryRateLimitStore returns an empty MemoryRateLimitStore
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{
+		counters: make(map[string]*memoryCounter),
+	}
+}
+
+// Increment satisfies RateLimitStore
+func (store *MemoryRateLimitStore) Increment(ctx context.Context,
+	table string,
+	key string,
+	delta int64,
+	expires time.Time) (int64, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	now := time.Now()
+	// Discard the expired counters, so that the map doesn't grow without
+	// bound
+	for eachKey, eachCounter := range store.counters {
+		if now.After(eachCounter.expires) {
+			delete(store.counters, eachKey)
+		}
+	}
+	counterKey := table + "/" + key
+	counter, exists := store.counters[counterKey]
+	if !exists {
+		counter = &memoryCounter{
+			expires: expires,
+		}
+		store.counters[counterKey] = counter
+	}
+	counter.count += delta
+	return counter.count, nil
+}
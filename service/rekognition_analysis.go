@@ -0,0 +1,157 @@
+package service
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+)
+
+const (
+	rekognitionAnalysisLabels      = "labels"
+	rekognitionAnalysisText        = "text"
+	rekognitionAnalysisModeration  = "moderation"
+	rekognitionAnalysisFaces       = "faces"
+	rekognitionAnalysisCelebrities = "celebrities"
+)
+
+// rekognitionAnalysis is a Rekognition API the RekognitionRelay can submit
+// normalized images to. Each analysis writes its response to its own
+// keyspace under the rekognition artifacts keyspace.
+type rekognitionAnalysis struct {
+	name string
+	// action is the IAM action the analysis requires
+	action string
+	detect func(ctx context.Context,
+		clients *Clients,
+		image *rekognition.Image) (interface{}, error)
+	// summaryField returns the consolidated report field the artifact
+	// is unmarshalled into
+	summaryField func(summary *summaryInfo) interface{}
+}
+
+// rekognitionAnalyses are the supported analyses, in the order they're
+// run. Moderation is first, so that the moderation gate rejects uploads
+// before they're analyzed further. Labels are last, since the labels
+// artifact triggers the rest of the pipeline, which expects the other
+// artifacts to exist.
+var rekognitionAnalyses = []*rekognitionAnalysis{
+	&rekognitionAnalysis{
+		name:   rekognitionAnalysisModeration,
+		action: "rekognition:DetectModerationLabels",
+		detect: func(ctx context.Context,
+			clients *Clients,
+			image *rekognition.Image) (interface{}, error) {
+			return clients.Rekognition.DetectModerationLabelsWithContext(ctx,
+				&rekognition.DetectModerationLabelsInput{Image: image})
+		},
+		summaryField: func(summary *summaryInfo) interface{} {
+			summary.Moderation = &rekognition.DetectModerationLabelsOutput{}
+			return summary.Moderation
+		},
+	},
+	&rekognitionAnalysis{
+		name:   rekognitionAnalysisText,
+		action: "rekognition:DetectText",
+		detect: func(ctx context.Context,
+			clients *Clients,
+			image *rekognition.Image) (interface{}, error) {
+			return clients.Rekognition.DetectTextWithContext(ctx,
+				&rekognition.DetectTextInput{Image: image})
+		},
+		summaryField: func(summary *summaryInfo) interface{} {
+			summary.Text = &rekognition.DetectTextOutput{}
+			return summary.Text
+		},
+	},
+	&rekognitionAnalysis{
+		name:   rekognitionAnalysisFaces,
+		action: "rekognition:DetectFaces",
+		detect: func(ctx context.Context,
+			clients *Clients,
+			image *rekognition.Image) (interface{}, error) {
+			// Include the estimated age, emotions and other attributes
+			return clients.Rekognition.DetectFacesWithContext(ctx,
+				&rekognition.DetectFacesInput{
+					Image:      image,
+					Attributes: []*string{aws.String(rekognition.AttributeAll)},
+				})
+		},
+		summaryField: func(summary *summaryInfo) interface{} {
+			summary.Faces = &rekognition.DetectFacesOutput{}
+			return summary.Faces
+		},
+	},
+	&rekognitionAnalysis{
+		name:   rekognitionAnalysisCelebrities,
+		action: "rekognition:RecognizeCelebrities",
+		detect: func(ctx context.Context,
+			clients *Clients,
+			image *rekognition.Image) (interface{}, error) {
+			return clients.Rekognition.RecognizeCelebritiesWithContext(ctx,
+				&rekognition.RecognizeCelebritiesInput{Image: image})
+		},
+		summaryField: func(summary *summaryInfo) interface{} {
+			summary.Celebrities = &rekognition.RecognizeCelebritiesOutput{}
+			return summary.Celebrities
+		},
+	},
+	&rekognitionAnalysis{
+		name:   rekognitionAnalysisLabels,
+		action: "rekognition:DetectLabels",
+		detect: func(ctx context.Context,
+			clients *Clients,
+			image *rekognition.Image) (interface{}, error) {
+			// The parameters are tunable in Parameter Store
+			parameters := newLabelParameters(ctx, clients.Parameters)
+			output, outputErr := clients.Rekognition.DetectLabelsWithContext(ctx,
+				parameters.detectLabelsInput(image))
+			if outputErr != nil {
+				return nil, outputErr
+			}
+			output.Labels = parameters.filter(output.Labels)
+			return output, nil
+		},
+		summaryField: func(summary *summaryInfo) interface{} {
+			summary.Rekognition = &rekognition.DetectLabelsOutput{}
+			return summary.Rekognition
+		},
+	},
+}
+
+// rekognitionAnalysisNames returns the names of the supported analyses
+func rekognitionAnalysisNames() []string {
+	names := make([]string, 0, len(rekognitionAnalyses))
+	for _, eachAnalysis := range rekognitionAnalyses {
+		names = append(names, eachAnalysis.name)
+	}
+	return names
+}
+
+// enabledRekognitionAnalyses returns the configured analyses, in the
+// order they're run. The moderation gate enables the moderation analysis.
+func (gws *ServicefulService) enabledRekognitionAnalyses() []*rekognitionAnalysis {
+	enabled := make([]*rekognitionAnalysis, 0, len(rekognitionAnalyses))
+	for _, eachAnalysis := range rekognitionAnalyses {
+		if eachAnalysis.name == rekognitionAnalysisModeration && gws.moderationEnabled() {
+			enabled = append(enabled, eachAnalysis)
+			continue
+		}
+		for _, eachName := range gws.config.Rekognition.Analyses {
+			if eachName == eachAnalysis.name {
+				enabled = append(enabled, eachAnalysis)
+				break
+			}
+		}
+	}
+	return enabled
+}
+
+// rekognitionKeyspace returns the keyspace the analysis' artifacts are
+// written to
+func (gws *ServicefulService) rekognitionKeyspace(analysis string) string {
+	return fmt.Sprintf("%s/%s",
+		gws.connections.S3KeyspaceRekognitionArtifacts,
+		analysis)
+}
@@ -8,7 +8,6 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/rekognition"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
 	gocf "github.com/mweagle/go-cloudformation"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
@@ -20,50 +19,108 @@ import (
 ║  ╠═╣║║║╠╩╗ ║║╠═╣
 ╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
 ================================================================================
-Listen for PutObject events and submit the image to Rekognition
+Listen for normalized images and submit them to each of the enabled
+Rekognition analyses. When the moderation gate is enabled, uploads whose
+moderation labels exceed the thresholds are rejected before the labels
+that trigger the narration are detected.
 */
 func (gws *ServicefulService) onS3PutUploadEvent(ctx context.Context,
 	s3Event awsLamdaEvents.S3Event) error {
 
 	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	awsSession := spartaAWS.NewSession(logger)
-	rekognitionSvc := rekognition.New(awsSession)
+	clients := gws.clients(ctx)
 
 	handler := func(ctx context.Context,
 		event awsLamdaEvents.S3EventRecord) (interface{}, error) {
-		input := &rekognition.DetectLabelsInput{
-			Image: &rekognition.Image{
-				S3Object: &rekognition.S3Object{
-					Bucket: aws.String(event.S3.Bucket.Name),
-					Name:   aws.String(event.S3.Object.Key),
-				},
+		// So we only want the last part of the input key
+		baseName := gws.baseKeyname(event.S3.Object.Key)
+		image := &rekognition.Image{
+			S3Object: &rekognition.S3Object{
+				Bucket: aws.String(event.S3.Bucket.Name),
+				Name:   aws.String(event.S3.Object.Key),
 			},
 		}
-		result, resultErr := rekognitionSvc.DetectLabels(input)
-		if resultErr != nil {
-			return nil, errors.Wrapf(resultErr, "Failed to detect text in image: %#v", input.Image.S3Object)
+		// A redelivered event for an upload that was already rejected
+		if gws.moderationEnabled() {
+			_, quarantinedErr := clients.Blobs.Head(ctx,
+				event.S3.Bucket.Name,
+				gws.quarantineKey(baseName))
+			if quarantinedErr == nil {
+				return gws.haltUpload(ctx, event, baseName)
+			} else if !IsBlobNotFound(quarantinedErr) {
+				return nil, quarantinedErr
+			}
 		}
-		// So we only want the last part of the input key
-		baseName := gws.baseKeyname(event.S3.Object.Key)
-		keyPath := fmt.Sprintf("%s/%s",
-			gws.connections.S3KeyspaceRekognitionArtifacts,
-			baseName)
-		putObjectResult := gws.putJSONObjectToS3(ctx,
-			event.S3.Bucket.Name,
-			keyPath,
-			result,
-			nil)
-		if putObjectResult != nil {
-			return nil, errors.Wrapf(putObjectResult, "Failed to put JSON response: %#v", keyPath)
+		analyses := gws.enabledRekognitionAnalyses()
+		skipped := 0
+		var keyPath string
+		for _, eachAnalysis := range analyses {
+			keyPath = fmt.Sprintf("%s/%s",
+				gws.rekognitionKeyspace(eachAnalysis.name),
+				baseName)
+			if gws.isFresh(ctx, event, keyPath) {
+				skipped++
+				continue
+			}
+			result, resultErr := eachAnalysis.detect(ctx, clients, image)
+			if resultErr != nil {
+				return nil, errors.Wrapf(resultErr, "Failed to detect %s in image: %#v",
+					eachAnalysis.name,
+					image.S3Object)
+			}
+			putObjectResult := gws.putJSONObject(ctx,
+				event.S3.Bucket.Name,
+				keyPath,
+				result,
+				&PutOptions{Metadata: sourceMetadata(event)})
+			if putObjectResult != nil {
+				return nil, errors.Wrapf(putObjectResult, "Failed to put JSON response: %#v", keyPath)
+			}
+			logger.WithFields(logrus.Fields{
+				"Analysis": eachAnalysis.name,
+				"Key":      keyPath,
+			}).Info("Put Item")
+
+			// Stop before the image is analyzed further or narrated
+			moderation, isModeration := result.(*rekognition.DetectModerationLabelsOutput)
+			if isModeration && gws.moderationEnabled() {
+				flagged := gws.flaggedModerationLabels(moderation)
+				if len(flagged) != 0 {
+					logger.WithFields(logrus.Fields{
+						"UploadID": baseName,
+						"Labels":   flagged,
+					}).Warn("Moderation labels exceed thresholds")
+					return gws.haltUpload(ctx, event, baseName)
+				}
+			}
+		}
+		// The labels artifact is the last one written
+		if skipped == len(analyses) {
+			return &stageSkipped{Key: keyPath}, nil
 		}
-		logger.WithField("Result", *result).Info("Put Item")
 		return nil, nil
 	}
-	handleResult, handleErr := gws.handleS3Records(ctx, s3Event, handler)
+	handleResult, handleErr := gws.handleS3Records(ctx,
+		s3Event,
+		gws.withJobStatus("RekognitionRelay", JobStateLabelsDetected, handler))
 	logger.WithField("Results", handleResult).Info("S3 event results")
 	return handleErr
 }
 
+// haltUpload rejects the flagged upload
+func (gws *ServicefulService) haltUpload(ctx context.Context,
+	event awsLamdaEvents.S3EventRecord,
+	uploadID string) (interface{}, error) {
+	halted, haltedErr := gws.rejectContent(ctx,
+		event.S3.Bucket.Name,
+		uploadID,
+		event.S3.Object.Key)
+	if haltedErr != nil {
+		return nil, haltedErr
+	}
+	return halted, nil
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 // Create
 func (gws *ServicefulService) newOnPutCallRekognition(api *sparta.API) *sparta.LambdaAWSInfo {
@@ -72,22 +129,40 @@ func (gws *ServicefulService) newOnPutCallRekognition(api *sparta.API) *sparta.L
 		gws.onS3PutUploadEvent,
 		sparta.IAMRoleDefinition{})
 	lambdaFn.Options = &sparta.LambdaFunctionOptions{
-		Description: "Wait for the DetectText call to finish",
+		Description: "Submit normalized images to the enabled Rekognition analyses",
 		MemorySize:  128,
-		Timeout:     10,
+		Timeout:     30,
 		TracingConfig: &gocf.LambdaFunctionTracingConfig{
 			Mode: gocf.String("Active"),
 		},
 	}
 	// IAM Role privileges
-	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges("rekognition:DetectLabels")
+	analyses := gws.enabledRekognitionAnalyses()
+	analysisActions := make([]string, 0, len(analyses))
+	analysisKeyspaces := make([]string, 0, len(analyses))
+	for _, eachAnalysis := range analyses {
+		analysisActions = append(analysisActions, eachAnalysis.action)
+		analysisKeyspaces = append(analysisKeyspaces,
+			gws.rekognitionKeyspace(eachAnalysis.name))
+	}
+	lambdaFn.RoleDefinition.Privileges = gws.bucketGetPutPrivileges(analysisActions...)
+	// Rejected uploads are quarantined
+	if gws.moderationEnabled() {
+		lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+			gws.bucketDeletePrivilege())
+	}
 
 	// Dependency
 	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
 
 	// Event Triggers
-	lambdaFn.Permissions = append(lambdaFn.Permissions,
-		gws.s3NotificationPrefixBasedPermission(gws.connections.S3KeyspaceUploads))
+	gws.subscribeS3Prefix(lambdaFn,
+		"RekognitionRelay",
+		gws.connections.S3KeyspaceNormalized,
+		gws.onS3PutUploadEvent,
+		append(analysisKeyspaces,
+			gws.connections.S3KeyspaceQuarantine,
+			gws.connections.S3KeyspaceConsolidatedStatus)...)
 
 	return lambdaFn
 }
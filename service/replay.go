@@ -0,0 +1,317 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ReplayOptions filter the dead letters that are replayed
+type ReplayOptions struct {
+	// Stages limits the replay to the named stages. Empty means all stages.
+	Stages []string
+	// Since and Until bound the S3 event time. Zero values are unbounded.
+	Since time.Time
+	Until time.Time
+	// DryRun logs the matching events without replaying them
+	DryRun bool
+	// Keep leaves replayed dead letters in the source
+	Keep bool
+}
+
+// ReplaySummary reports the outcome of a replay
+type ReplaySummary struct {
+	Replayed int
+	Skipped  int
+	Failed   int
+}
+
+// replayInvoker delivers the event to the stage
+type replayInvoker func(ctx context.Context,
+	stage *pipelineStage,
+	event awsLamdaEvents.S3Event) error
+
+// Replayer redelivers dead lettered S3 events to the stage whose trigger
+// prefix matches each record's key
+type Replayer struct {
+	gws     *ServicefulService
+	source  DeadLetterSource
+	options ReplayOptions
+	invoke  replayInvoker
+}
+
+func newReplayer(gws *ServicefulService,
+	source DeadLetterSource,
+	options ReplayOptions,
+	invoke replayInvoker) *Replayer {
+	// Creating the functions registers the S3 triggered stages
+	gws.lambdaFunctions(nil)
+	return &Replayer{
+		gws:     gws,
+		source:  source,
+		options: options,
+		invoke:  invoke,
+	}
+}
+
+// NewReplayer returns a Replayer that runs the stage handlers in process.
+// The optional clients value supplies the AWS service clients, as with New.
+func NewReplayer(config *Config,
+	clients *Clients,
+	source DeadLetterSource,
+	options ReplayOptions) *Replayer {
+	return newReplayer(newServicefulService(config, clients),
+		source,
+		options,
+		invokeInProcess)
+}
+
+// Replayer returns a Replayer that runs the stage handlers against the
+// local pipeline's bucket
+func (lp *LocalPipeline) Replayer(source DeadLetterSource, options ReplayOptions) *Replayer {
+	return newReplayer(lp.gws, source, options, invokeInProcess)
+}
+
+func invokeInProcess(ctx context.Context,
+	stage *pipelineStage,
+	event awsLamdaEvents.S3Event) error {
+	return stage.handler(ctx, event)
+}
+
+// LambdaAPI is the subset of the Lambda client the remote replay
+// depends on
+type LambdaAPI interface {
+	InvokeWithContext(ctx aws.Context,
+		input *lambda.InvokeInput,
+		opts ...request.Option) (*lambda.InvokeOutput, error)
+}
+
+// CloudFormationAPI is the subset of the CloudFormation client used to
+// resolve the provisioned resources
+type CloudFormationAPI interface {
+	DescribeStackResourceWithContext(ctx aws.Context,
+		input *cloudformation.DescribeStackResourceInput,
+		opts ...request.Option) (*cloudformation.DescribeStackResourceOutput, error)
+}
+
+// stackResourceID returns the physical ID of the stack resource
+func stackResourceID(ctx context.Context,
+	cfSvc CloudFormationAPI,
+	stackName string,
+	logicalResourceName string) (string, error) {
+	describeOutput, describeErr := cfSvc.DescribeStackResourceWithContext(ctx,
+		&cloudformation.DescribeStackResourceInput{
+			StackName:         aws.String(stackName),
+			LogicalResourceId: aws.String(logicalResourceName),
+		})
+	if describeErr != nil {
+		return "", errors.Wrapf(describeErr,
+			"Failed to describe %s resource: %s",
+			stackName,
+			logicalResourceName)
+	}
+	return aws.StringValue(describeOutput.StackResourceDetail.PhysicalResourceId), nil
+}
+
+// NewStackDeadLetterSource returns the DeadLetterSource for the dead
+// letter queue provisioned in the stack
+func NewStackDeadLetterSource(ctx context.Context,
+	config *Config,
+	awsSession *session.Session,
+	stackName string) (DeadLetterSource, error) {
+	// The physical ID of an SQS queue is its URL
+	queueURL, queueURLErr := stackResourceID(ctx,
+		cloudformation.New(awsSession),
+		stackName,
+		config.Connections.DeadLetterQueueResourceName)
+	if queueURLErr != nil {
+		return nil, queueURLErr
+	}
+	return NewSQSDeadLetterSource(sqs.New(awsSession), queueURL), nil
+}
+
+// forcedEvent returns a copy of the event whose records are reprocessed
+// even if their artifacts are current
+func forcedEvent(event awsLamdaEvents.S3Event) awsLamdaEvents.S3Event {
+	forced := awsLamdaEvents.S3Event{
+		Records: make([]awsLamdaEvents.S3EventRecord, 0, len(event.Records)),
+	}
+	for _, eachRecord := range event.Records {
+		responseElements := map[string]string{
+			forceResponseElement: "true",
+		}
+		for eachKey, eachValue := range eachRecord.ResponseElements {
+			responseElements[eachKey] = eachValue
+		}
+		eachRecord.ResponseElements = responseElements
+		forced.Records = append(forced.Records, eachRecord)
+	}
+	return forced
+}
+
+// NewRemoteReplayer returns a Replayer that asynchronously invokes the
+// stage functions provisioned in the stack. When pipeline.force is set,
+// the events are marked so that the functions reprocess them.
+func NewRemoteReplayer(config *Config,
+	awsSession *session.Session,
+	stackName string,
+	source DeadLetterSource,
+	options ReplayOptions) *Replayer {
+	cfSvc := cloudformation.New(awsSession)
+	lambdaSvc := lambda.New(awsSession)
+	functionNames := make(map[string]string)
+
+	invoke := func(ctx context.Context,
+		stage *pipelineStage,
+		event awsLamdaEvents.S3Event) error {
+		functionName, exists := functionNames[stage.name]
+		if !exists {
+			physicalID, physicalIDErr := stackResourceID(ctx,
+				cfSvc,
+				stackName,
+				stage.lambdaFn.LogicalResourceName())
+			if physicalIDErr != nil {
+				return physicalIDErr
+			}
+			functionName = physicalID
+			functionNames[stage.name] = functionName
+		}
+		if config.Pipeline.Force {
+			event = forcedEvent(event)
+		}
+		payload, payloadErr := json.Marshal(event)
+		if payloadErr != nil {
+			return errors.Wrapf(payloadErr, "Failed to marshal S3 event")
+		}
+		_, invokeErr := lambdaSvc.InvokeWithContext(ctx, &lambda.InvokeInput{
+			FunctionName:   aws.String(functionName),
+			InvocationType: aws.String(lambda.InvocationTypeEvent),
+			Payload:        payload,
+		})
+		if invokeErr != nil {
+			return errors.Wrapf(invokeErr, "Failed to invoke %s", functionName)
+		}
+		return nil
+	}
+	return newReplayer(newServicefulService(config, nil), source, options, invoke)
+}
+
+// matches returns true if the record passes the stage and time filters
+func (replayer *Replayer) matches(stage *pipelineStage,
+	record awsLamdaEvents.S3EventRecord) bool {
+	if len(replayer.options.Stages) != 0 {
+		stageMatch := false
+		for _, eachStageName := range replayer.options.Stages {
+			stageMatch = stageMatch || eachStageName == stage.name
+		}
+		if !stageMatch {
+			return false
+		}
+	}
+	if !replayer.options.Since.IsZero() && record.EventTime.Before(replayer.options.Since) {
+		return false
+	}
+	if !replayer.options.Until.IsZero() && record.EventTime.After(replayer.options.Until) {
+		return false
+	}
+	return true
+}
+
+// Run replays every matching dead letter until the source is drained. A
+// dead letter is deleted once all of its records are replayed. Dead
+// letters that can't be parsed or replayed are counted as failed and
+// left in the source.
+func (replayer *Replayer) Run(ctx context.Context, logger *logrus.Logger) (*ReplaySummary, error) {
+	ctx = context.WithValue(ctx, sparta.ContextKeyLogger, logger)
+	summary := &ReplaySummary{}
+	for {
+		deadLetters, receiveErr := replayer.source.Receive(ctx)
+		if receiveErr != nil {
+			return summary, receiveErr
+		}
+		if len(deadLetters) == 0 {
+			return summary, nil
+		}
+		for _, eachDeadLetter := range deadLetters {
+			replayed, replayErr := replayer.replay(ctx, logger, eachDeadLetter)
+			if replayErr != nil {
+				summary.Failed++
+				logger.WithFields(logrus.Fields{
+					"ID":    eachDeadLetter.ID,
+					"Error": replayErr,
+				}).Error("Failed to replay dead letter")
+				continue
+			}
+			if !replayed {
+				summary.Skipped++
+				continue
+			}
+			summary.Replayed++
+			if replayer.options.DryRun || replayer.options.Keep {
+				continue
+			}
+			deleteErr := replayer.source.Delete(ctx, eachDeadLetter)
+			if deleteErr != nil {
+				return summary, deleteErr
+			}
+		}
+	}
+}
+
+// replay delivers the dead letter's records to their stages. It returns
+// false if any record was filtered out, in which case the dead letter is
+// retained.
+func (replayer *Replayer) replay(ctx context.Context,
+	logger *logrus.Logger,
+	deadLetter *DeadLetter) (bool, error) {
+	if deadLetter.invalid != nil {
+		return false, deadLetter.invalid
+	}
+	stageEvents := make(map[*pipelineStage]*awsLamdaEvents.S3Event)
+	stageOrder := make([]*pipelineStage, 0)
+	for _, eachRecord := range deadLetter.Event.Records {
+		stage := replayer.gws.stageForKey(eachRecord.S3.Object.Key)
+		if stage == nil {
+			return false, errors.Errorf("No stage is triggered by key: %s",
+				eachRecord.S3.Object.Key)
+		}
+		if !replayer.matches(stage, eachRecord) {
+			return false, nil
+		}
+		if _, exists := stageEvents[stage]; !exists {
+			stageEvents[stage] = &awsLamdaEvents.S3Event{}
+			stageOrder = append(stageOrder, stage)
+		}
+		stageEvents[stage].Records = append(stageEvents[stage].Records, eachRecord)
+	}
+	if len(stageOrder) == 0 {
+		return false, nil
+	}
+	for _, eachStage := range stageOrder {
+		logger.WithFields(logrus.Fields{
+			"ID":      deadLetter.ID,
+			"Stage":   eachStage.name,
+			"Records": len(stageEvents[eachStage].Records),
+			"DryRun":  replayer.options.DryRun,
+		}).Info("Replaying dead letter")
+		if replayer.options.DryRun {
+			continue
+		}
+		invokeErr := replayer.invoke(ctx, eachStage, *stageEvents[eachStage])
+		if invokeErr != nil {
+			return false, errors.Wrapf(invokeErr, "%s failed", eachStage.name)
+		}
+	}
+	return true, nil
+}
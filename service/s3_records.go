@@ -0,0 +1,151 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"time"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/sirupsen/logrus"
+)
+
+// RecordPanic is the error reported when a record handler panics
+type RecordPanic struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (rp *RecordPanic) Error() string {
+	return fmt.Sprintf("Record handler panicked: %v", rp.Value)
+}
+
+// RecordError is the failure of a single S3 event record
+type RecordError struct {
+	Bucket string
+	Key    string
+	Err    error
+}
+
+func (re *RecordError) Error() string {
+	return fmt.Sprintf("%s: %s", re.Key, re.Err)
+}
+
+// Cause returns the underlying error so that errors.Cause can unwrap it
+func (re *RecordError) Cause() error {
+	return re.Err
+}
+
+// RecordErrors is returned when one or more records of an S3 event
+// couldn't be processed
+type RecordErrors struct {
+	Total  int
+	Errors []*RecordError
+}
+
+func (re *RecordErrors) Error() string {
+	messages := make([]string, 0)
+	for _, eachError := range re.Errors {
+		messages = append(messages, eachError.Error())
+	}
+	return fmt.Sprintf("Failed to process %d of %d records:\n\t%s",
+		len(re.Errors),
+		re.Total,
+		strings.Join(messages, "\n\t"))
+}
+
+// callRecordHandler invokes the handler, converting a panic into a
+// RecordPanic error
+func callRecordHandler(ctx context.Context,
+	handler recordHandler,
+	event awsLamdaEvents.S3EventRecord) (ret interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			ret = nil
+			err = &RecordPanic{
+				Value: r,
+				Stack: debug.Stack(),
+			}
+		}
+	}()
+	return handler(ctx, event)
+}
+
+// recordContext returns the context for a single record. Its deadline
+// leaves pipeline.deadlineMarginMillis of the Lambda's remaining time to
+// report the outcome.
+func (gws *ServicefulService) recordContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	deadline, hasDeadline := ctx.Deadline()
+	if !hasDeadline {
+		return context.WithCancel(ctx)
+	}
+	margin := time.Duration(gws.config.Pipeline.DeadlineMarginMillis) * time.Millisecond
+	return context.WithDeadline(ctx, deadline.Add(-margin))
+}
+
+// handleS3Records runs the handler for every record in the event, with
+// at most pipeline.maxConcurrentRecords running at once. A panic or
+// error in one record doesn't affect the others; failures are returned
+// as a RecordErrors value.
+func (gws *ServicefulService) handleS3Records(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event,
+	handler recordHandler) (interface{}, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	recordErrors := make([]*RecordError, len(s3Event.Records))
+	workers := make(chan struct{}, gws.config.Pipeline.MaxConcurrentRecords)
+	var wg sync.WaitGroup
+	for eachIndex, eachRecord := range s3Event.Records {
+		wg.Add(1)
+		workers <- struct{}{}
+		go func(index int, event awsLamdaEvents.S3EventRecord) {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			recordCtx, cancel := gws.recordContext(ctx)
+			defer cancel()
+
+			// Records that are still waiting when the deadline passes are
+			// failed rather than started
+			err := recordCtx.Err()
+			if err == nil {
+				_, err = callRecordHandler(recordCtx, handler, event)
+			}
+			if err == nil {
+				return
+			}
+			recordErrors[index] = &RecordError{
+				Bucket: event.S3.Bucket.Name,
+				Key:    event.S3.Object.Key,
+				Err:    err,
+			}
+			entry := logger.WithFields(logrus.Fields{
+				"Key":   event.S3.Object.Key,
+				"Error": err,
+			})
+			if recordPanic, isPanic := err.(*RecordPanic); isPanic {
+				entry = entry.WithField("Stack", string(recordPanic.Stack))
+			}
+			entry.Error("Failed to process record")
+		}(eachIndex, eachRecord)
+	}
+	wg.Wait()
+
+	failures := &RecordErrors{
+		Total:  len(s3Event.Records),
+		Errors: make([]*RecordError, 0),
+	}
+	for _, eachError := range recordErrors {
+		if eachError != nil {
+			failures.Errors = append(failures.Errors, eachError)
+		}
+	}
+	if len(failures.Errors) != 0 {
+		return nil, failures
+	}
+	return fmt.Sprintf("Processed %d events", len(s3Event.Records)), nil
+}
@@ -1,16 +1,10 @@
 package service
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
-	"fmt"
-	"io/ioutil"
-	"net/url"
 	"path"
 	"strings"
-	"sync"
-	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -18,11 +12,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
 	sparta "github.com/mweagle/Sparta"
-	spartaAWS "github.com/mweagle/Sparta/aws"
 	spartaCF "github.com/mweagle/Sparta/aws/cloudformation"
 	iamBuilder "github.com/mweagle/Sparta/aws/iam/builder"
 	gocf "github.com/mweagle/go-cloudformation"
-	ssmcache "github.com/mweagle/ssm-cache"
 	"github.com/pkg/errors"
 )
 
@@ -34,25 +26,95 @@ const (
 // Connections is the type that defines the connections between
 // the functions
 type Connections struct {
-	S3UploadBucketResourceName     string
-	S3KeyspaceUploads              string
-	S3KeyspaceRekognitionArtifacts string
-	S3KeyspacePollyArtifacts       string
-	S3KeyspaceComprehendArtifacts  string
-	S3KeyspaceConsolidatedStatus   string
+	S3UploadBucketResourceName     string `json:"bucketResourceName" env:"GEEKWIRE_BUCKET_RESOURCE_NAME"`
+	S3KeyspaceUploads              string `json:"uploads" env:"GEEKWIRE_KEYSPACE_UPLOADS"`
+	S3KeyspaceRekognitionArtifacts string `json:"rekognitionArtifacts" env:"GEEKWIRE_KEYSPACE_REKOGNITION_ARTIFACTS"`
+	S3KeyspacePollyArtifacts       string `json:"pollyArtifacts" env:"GEEKWIRE_KEYSPACE_POLLY_ARTIFACTS"`
+	S3KeyspaceComprehendArtifacts  string `json:"comprehendArtifacts" env:"GEEKWIRE_KEYSPACE_COMPREHEND_ARTIFACTS"`
+	S3KeyspaceConsolidatedStatus   string `json:"consolidated" env:"GEEKWIRE_KEYSPACE_CONSOLIDATED"`
+	S3KeyspaceJobStatus            string `json:"status" env:"GEEKWIRE_KEYSPACE_STATUS"`
+	S3KeyspaceUploadMetadata       string `json:"uploadMetadata" env:"GEEKWIRE_KEYSPACE_UPLOAD_METADATA"`
+	S3KeyspaceIdempotencyKeys      string `json:"idempotencyKeys" env:"GEEKWIRE_KEYSPACE_IDEMPOTENCY_KEYS"`
+	S3KeyspaceBatches              string `json:"batches" env:"GEEKWIRE_KEYSPACE_BATCHES"`
+	S3KeyspaceBatchConsolidated    string `json:"batchConsolidated" env:"GEEKWIRE_KEYSPACE_BATCH_CONSOLIDATED"`
+	S3KeyspaceValidations          string `json:"validations" env:"GEEKWIRE_KEYSPACE_VALIDATIONS"`
+	S3KeyspaceQuarantine           string `json:"quarantine" env:"GEEKWIRE_KEYSPACE_QUARANTINE"`
+	S3KeyspaceNormalized           string `json:"normalized" env:"GEEKWIRE_KEYSPACE_NORMALIZED"`
+	S3KeyspaceThumbnails           string `json:"thumbnails" env:"GEEKWIRE_KEYSPACE_THUMBNAILS"`
+	S3KeyspaceAnnotated            string `json:"annotated" env:"GEEKWIRE_KEYSPACE_ANNOTATED"`
+	// DeadLetterQueueResourceName is the SQS queue that receives the
+	// events the S3 triggered functions failed to process
+	DeadLetterQueueResourceName string `json:"deadLetterQueueResourceName" env:"GEEKWIRE_DEAD_LETTER_QUEUE_RESOURCE_NAME"`
+	// RateLimitTableResourceName is the DynamoDB table that holds the
+	// rate limit counters
+	RateLimitTableResourceName string `json:"rateLimitTableResourceName" env:"GEEKWIRE_RATE_LIMIT_TABLE_RESOURCE_NAME"`
+	// S3BucketName is the optional literal bucket name. When empty the
+	// bucket is resolved at runtime via sparta.Discover()
+	S3BucketName string `json:"bucketName,omitempty" env:"GEEKWIRE_BUCKET_NAME"`
+	// RateLimitTableName is the optional literal table name. When empty
+	// the table is resolved at runtime via sparta.Discover()
+	RateLimitTableName string `json:"rateLimitTableName,omitempty" env:"GEEKWIRE_RATE_LIMIT_TABLE_NAME"`
 }
 type recordHandler func(ctx context.Context, event awsLamdaEvents.S3EventRecord) (interface{}, error)
 
-type s3Result struct {
-	err error
-	ret interface{}
+// s3EventHandler is the signature of the lambda functions that are
+// triggered by S3 notifications
+type s3EventHandler func(ctx context.Context, s3Event awsLamdaEvents.S3Event) error
+
+// pipelineStage is a lambda function triggered by objects created
+// under a keyspace prefix, which writes objects to the output keyspaces
+type pipelineStage struct {
+	name           string
+	triggerPrefix  string
+	outputPrefixes []string
+	handler        s3EventHandler
+	lambdaFn       *sparta.LambdaAWSInfo
+}
+
+// keyFilterPrefix returns the S3 prefix filter for the keyspace. The
+// trailing separator keeps a keyspace from matching its siblings (eg:
+// "uploads" and "uploads-status").
+func keyFilterPrefix(keyspace string) string {
+	return keyspace + "/"
+}
+
+// triggeredBy returns true if objects created at keyPath trigger the stage
+func (stage *pipelineStage) triggeredBy(keyPath string) bool {
+	return strings.HasPrefix(keyPath, keyFilterPrefix(stage.triggerPrefix))
 }
 
 // ServicefulService represents the lambda microservice of multiple
 // functions cooperating to support a workflow
 type ServicefulService struct {
+	config      *Config
 	connections *Connections
-	cacheClient ssmcache.Client
+	awsClients  lazyClients
+	uploadIDs   *uploadIDGenerator
+	jwtVerifier *jwtVerifier
+	stages      []*pipelineStage
+}
+
+// clients returns the AWS service clients this service uses
+func (gws *ServicefulService) clients(ctx context.Context) *Clients {
+	return gws.awsClients.get(ctx)
+}
+
+// bucketName returns the name of the upload bucket, preferring the
+// literal name in the Connections over the discovered one
+func (gws *ServicefulService) bucketName() (string, error) {
+	if gws.connections.S3BucketName != "" {
+		return gws.connections.S3BucketName, nil
+	}
+	discover, discoveryInfoErr := sparta.Discover()
+	if discoveryInfoErr != nil {
+		return "", discoveryInfoErr
+	}
+	s3Resource, exists := discover.Resources[gws.connections.S3UploadBucketResourceName]
+	if !exists {
+		return "", errors.Errorf("Failed to discover resource: %s",
+			gws.connections.S3UploadBucketResourceName)
+	}
+	return s3Resource.ResourceRef, nil
 }
 
 func (gws *ServicefulService) baseKeyname(s3Keypath string) string {
@@ -61,114 +123,41 @@ func (gws *ServicefulService) baseKeyname(s3Keypath string) string {
 	return strings.TrimSuffix(baseName, path.Ext(baseName))
 }
 
-// getS3Object is a utility function to fet
-func (gws *ServicefulService) getS3Object(ctx context.Context,
+// getObject is a utility function to fetch the contents of an object
+// from the BlobStore
+func (gws *ServicefulService) getObject(ctx context.Context,
 	bucket string,
 	keyPath string) ([]byte, error) {
-
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	awsSession := spartaAWS.NewSession(logger)
-	s3Svc := s3.New(awsSession)
-
-	getObjectInput := &s3.GetObjectInput{
-		Bucket: aws.String(bucket),
-		Key:    aws.String(keyPath),
-	}
-
-	// Get the JSON output from Rekognition
-	getResult, getResultErr := s3Svc.GetObject(getObjectInput)
-	if getResultErr != nil {
-		return nil, errors.Wrapf(getResultErr, "Failed to get object")
-	}
-	defer getResult.Body.Close()
-	allData, allDataErr := ioutil.ReadAll(getResult.Body)
-	if allDataErr != nil {
-		return nil, errors.Wrapf(allDataErr, "Failed to read all data")
-	}
-	return allData, nil
+	return gws.clients(ctx).Blobs.Get(ctx, bucket, keyPath)
 }
 
-func (gws *ServicefulService) putJSONObjectToS3(ctx context.Context,
+// putJSONObject marshals the data to JSON and stores it in the BlobStore.
+// The optional options supply the tags and metadata.
+func (gws *ServicefulService) putJSONObject(ctx context.Context,
 	bucket string,
 	keyPath string,
 	data interface{},
-	tags map[string]string) error {
+	options *PutOptions) error {
 	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-	awsSession := spartaAWS.NewSession(logger)
-	s3Svc := s3.New(awsSession)
 
 	jsonData, jsonDataErr := json.Marshal(data)
 	if jsonDataErr != nil {
 		return errors.Wrapf(jsonDataErr,
-			"Failed to marshal object to JSON for S3 storage")
-	}
-
-	// Put the item there...
-	putObjectInput := &s3.PutObjectInput{
-		Body:        aws.ReadSeekCloser(bytes.NewReader(jsonData)),
-		Bucket:      aws.String(bucket),
-		Key:         aws.String(keyPath),
-		ContentType: aws.String("application/json"),
+			"Failed to marshal object to JSON for storage")
 	}
-	encodedTags := url.Values{}
-	for eachKey, eachValue := range tags {
-		encodedTags.Set(eachKey, eachValue)
+	putOptions := &PutOptions{}
+	if options != nil {
+		*putOptions = *options
 	}
-	if len(tags) != 0 {
-		putObjectInput.Tagging = aws.String(encodedTags.Encode())
+	putOptions.ContentType = "application/json"
+	putErr := gws.clients(ctx).Blobs.Put(ctx, bucket, keyPath, jsonData, putOptions)
+	if putErr != nil {
+		return errors.Wrapf(putErr, "Failed to put JSON response: %s", keyPath)
 	}
-	putResult, putResultErr := s3Svc.PutObject(putObjectInput)
-	if putResultErr != nil {
-		return errors.Wrapf(putResultErr, "Failed to put JSON response: %#v", putObjectInput)
-	}
-	logger.WithField("Result", *putResult).Debug("Put Item")
+	logger.WithField("Key", keyPath).Debug("Put Item")
 	return nil
 }
 
-// s3PubSubPrivileges is a shared function that returns the privileges necessary
-// to use the S3 bucket as a pubsub creator
-func (gws *ServicefulService) handleS3Records(ctx context.Context,
-	s3Event awsLamdaEvents.S3Event,
-	handler recordHandler) (interface{}, error) {
-	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
-
-	var wg sync.WaitGroup
-	chanResults := make(chan s3Result, len(s3Event.Records))
-	for _, eachRecord := range s3Event.Records {
-		wg.Add(1)
-		go func(event awsLamdaEvents.S3EventRecord) {
-			ret, err := handler(ctx, event)
-			handlerResult := s3Result{
-				err: err,
-				ret: ret,
-			}
-			wg.Done()
-			logger.WithField("RESULT", fmt.Sprintf("%#v", handlerResult)).Info("Task complete")
-			chanResults <- handlerResult
-		}(eachRecord)
-	}
-	logger.Info("Waiting")
-	wg.Wait()
-	logger.Info("Done waiting")
-	close(chanResults)
-	// Accumulate all the results
-	handlerErrors := make([]error, 0)
-	handled := 0
-	for eachEvent := range chanResults {
-		if eachEvent.err != nil {
-			handlerErrors = append(handlerErrors, eachEvent.err)
-		} else {
-			handled++
-		}
-	}
-	logger.Info("Done reading results")
-
-	if len(handlerErrors) != 0 {
-		return nil, errors.Errorf("Failed to process: %#v", handlerErrors)
-	}
-	return fmt.Sprintf("Processed %d events", handled), nil
-}
-
 // s3NotificationPrefixFilter is a DRY spec for setting up a notification configuration
 // filter
 func (gws *ServicefulService) s3NotificationPrefixBasedPermission(keyPathPrefix string) sparta.S3Permission {
@@ -182,7 +171,7 @@ func (gws *ServicefulService) s3NotificationPrefixBasedPermission(keyPathPrefix
 				FilterRules: []*s3.FilterRule{
 					&s3.FilterRule{
 						Name:  aws.String("prefix"),
-						Value: aws.String(keyPathPrefix),
+						Value: aws.String(keyFilterPrefix(keyPathPrefix)),
 					},
 				},
 			},
@@ -190,6 +179,60 @@ func (gws *ServicefulService) s3NotificationPrefixBasedPermission(keyPathPrefix
 	}
 }
 
+// subscribeS3Prefix registers the lambda function for ObjectCreated
+// notifications under keyPathPrefix and records the stage, together with
+// the keyspaces it writes to, so that the pipeline can be analyzed and
+// driven outside of AWS. Events the function fails to process are sent
+// to the dead letter queue. Call it after the function's privileges are
+// assigned.
+func (gws *ServicefulService) subscribeS3Prefix(lambdaFn *sparta.LambdaAWSInfo,
+	stageName string,
+	keyPathPrefix string,
+	handler s3EventHandler,
+	outputPrefixes ...string) {
+	// Every stage records its progress in the job status keyspace.
+	// Stages report terminal failures in the consolidated keyspace, except
+	// for the one it triggers, which would trigger itself.
+	implicitOutputs := []string{gws.connections.S3KeyspaceJobStatus}
+	if keyPathPrefix != gws.connections.S3KeyspaceConsolidatedStatus {
+		implicitOutputs = append(implicitOutputs, gws.connections.S3KeyspaceConsolidatedStatus)
+	}
+	for _, eachImplicitOutput := range implicitOutputs {
+		listed := false
+		for _, eachOutput := range outputPrefixes {
+			listed = listed || eachOutput == eachImplicitOutput
+		}
+		if !listed {
+			outputPrefixes = append(outputPrefixes, eachImplicitOutput)
+		}
+	}
+	lambdaFn.Permissions = append(lambdaFn.Permissions,
+		gws.s3NotificationPrefixBasedPermission(keyPathPrefix))
+	lambdaFn.DeadLetterConfigArn = gocf.GetAtt(gws.connections.DeadLetterQueueResourceName, "Arn")
+	lambdaFn.RoleDefinition.Privileges = append(lambdaFn.RoleDefinition.Privileges,
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"sqs:SendMessage"},
+			Resource: gocf.GetAtt(gws.connections.DeadLetterQueueResourceName, "Arn"),
+		})
+	gws.stages = append(gws.stages, &pipelineStage{
+		name:           stageName,
+		triggerPrefix:  keyPathPrefix,
+		outputPrefixes: outputPrefixes,
+		handler:        handler,
+		lambdaFn:       lambdaFn,
+	})
+}
+
+// stageForKey returns the stage triggered by objects created at keyPath
+func (gws *ServicefulService) stageForKey(keyPath string) *pipelineStage {
+	for _, eachStage := range gws.stages {
+		if eachStage.triggeredBy(keyPath) {
+			return eachStage
+		}
+	}
+	return nil
+}
+
 // s3PubSubPrivileges is a shared function that returns the privileges necessary
 // to use the S3 bucket as a pubsub creator. resourceUnscopedActions is an
 // optional set of actions to allow that don't use resource-based
@@ -199,9 +242,14 @@ func (gws *ServicefulService) bucketGetPutPrivileges(resourceUnscopedActions ...
 		sparta.IAMRolePrivilege{
 			Actions: []string{"s3:GetObject",
 				"s3:PutObject",
-				"s3:PutObjectTagging"},
+				"s3:PutObjectTagging",
+				"s3:GetObjectTagging"},
 			Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(gws.connections.S3UploadBucketResourceName)),
 		},
+		sparta.IAMRolePrivilege{
+			Actions:  []string{"s3:ListBucket"},
+			Resource: spartaCF.S3ArnForBucket(gocf.Ref(gws.connections.S3UploadBucketResourceName)),
+		},
 		iamBuilder.Allow("ssm:GetParameter", "ssm:GetParametersByPath").
 			ForResource().
 			Literal("arn:aws:ssm:").
@@ -220,18 +268,118 @@ func (gws *ServicefulService) bucketGetPutPrivileges(resourceUnscopedActions ...
 	return privileges
 }
 
+// bucketDeletePrivilege allows the functions that quarantine uploads to
+// delete them
+func (gws *ServicefulService) bucketDeletePrivilege() sparta.IAMRolePrivilege {
+	return sparta.IAMRolePrivilege{
+		Actions:  []string{"s3:DeleteObject"},
+		Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(gws.connections.S3UploadBucketResourceName)),
+	}
+}
+
+// bucketMultipartPrivilege allows the multipart upload function to list
+// and abort uploads. Creating, uploading and completing parts only
+// require s3:PutObject.
+func (gws *ServicefulService) bucketMultipartPrivilege() sparta.IAMRolePrivilege {
+	return sparta.IAMRolePrivilege{
+		Actions: []string{"s3:AbortMultipartUpload",
+			"s3:ListMultipartUploadParts"},
+		Resource: spartaCF.S3AllKeysArnForBucket(gocf.Ref(gws.connections.S3UploadBucketResourceName)),
+	}
+}
+
 // New returns a service that stitches multiple lambdas into
-// a single workflow...
-func New(connections *Connections, api *sparta.API) []*sparta.LambdaAWSInfo {
-	gws := &ServicefulService{
-		connections: connections,
-		cacheClient: ssmcache.NewClient(5 * time.Minute),
+// a single workflow. The optional clients value supplies the AWS service
+// clients; when nil, clients are created from the Lambda execution
+// environment on first use.
+func New(config *Config,
+	api *sparta.API,
+	clients *Clients) []*sparta.LambdaAWSInfo {
+	return newServicefulService(config, clients).lambdaFunctions(api)
+}
+
+func newServicefulService(config *Config, clients *Clients) *ServicefulService {
+	return &ServicefulService{
+		config:      config,
+		connections: &config.Connections,
+		awsClients: lazyClients{
+			clients: clients,
+		},
+		uploadIDs:   newUploadIDGenerator(),
+		jwtVerifier: newJWTVerifier(&config.Auth),
+	}
+}
+
+// lambdaConfigSections are the configuration sections each function
+// reads, keyed by function name
+var lambdaConfigSections = map[string][]string{
+	"JWTAuthorizer":           []string{"auth"},
+	"PresignedURLProvider":    []string{"uploads", "rateLimits", "auth"},
+	"ValidateImage":           []string{"pipeline", "validation"},
+	"NormalizeImage":          []string{"pipeline", "normalization"},
+	"RekognitionRelay":        []string{"pipeline", "rekognition", "moderation"},
+	"PollyRelay":              []string{"pipeline", "labels"},
+	"GenerateSummary":         []string{"pipeline", "uploads", "rekognition", "moderation", "labels", "annotation"},
+	"FeedbackDetectSentiment": []string{"rateLimits", "auth"},
+	"JobStatusProvider":       nil,
+	"MultipartUploadProvider": []string{"uploads", "auth"},
+	"BatchUploadProvider":     []string{"uploads", "rateLimits", "auth"},
+	"BatchAggregator":         []string{"pipeline", "labels"},
+}
+
+// publishConfig adds the connections and the configuration sections the
+// function reads to its environment, so that the runtime values match
+// the provisioned ones. Lambda limits the environment to 4KB, so
+// functions only receive the sections they read.
+func (gws *ServicefulService) publishConfig(functionName string,
+	lambdaFn *sparta.LambdaAWSInfo) *sparta.LambdaAWSInfo {
+	sections, sectionsExist := lambdaConfigSections[functionName]
+	if !sectionsExist {
+		panic("No configuration sections for function: " + functionName)
+	}
+	if lambdaFn.Options == nil {
+		lambdaFn.Options = &sparta.LambdaFunctionOptions{}
+	}
+	if lambdaFn.Options.Environment == nil {
+		lambdaFn.Options.Environment = make(map[string]*gocf.StringExpr)
 	}
+	for eachKey, eachValue := range gws.config.Environment(sections...) {
+		lambdaFn.Options.Environment[eachKey] = gocf.String(eachValue)
+	}
+	return lambdaFn
+}
+
+// lambdaFunctions returns the set of functions that define the
+// service
+func (gws *ServicefulService) lambdaFunctions(api *sparta.API) []*sparta.LambdaAWSInfo {
+	gws.stages = nil
+	// Each function is published the configuration sections it reads
 	var lambdaFunctions []*sparta.LambdaAWSInfo
-	lambdaFunctions = append(lambdaFunctions, gws.newS3PresignedPutItemLambda(api))
-	lambdaFunctions = append(lambdaFunctions, gws.newOnPutCallRekognition(api))
-	lambdaFunctions = append(lambdaFunctions, gws.newOnS3PutCallPolly(api))
-	lambdaFunctions = append(lambdaFunctions, gws.newOnS3PutGenerateSummary(api))
-	lambdaFunctions = append(lambdaFunctions, gws.newOnFeedbackDetectSentiment(api))
+	if gws.authEnabled() {
+		lambdaFunctions = append(lambdaFunctions,
+			gws.publishConfig("JWTAuthorizer", gws.newJWTAuthorizerLambda(api)))
+	}
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("PresignedURLProvider", gws.newS3PresignedPutItemLambda(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("ValidateImage", gws.newOnS3PutValidateImage(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("NormalizeImage", gws.newOnS3PutNormalizeImage(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("RekognitionRelay", gws.newOnPutCallRekognition(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("PollyRelay", gws.newOnS3PutCallPolly(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("GenerateSummary", gws.newOnS3PutGenerateSummary(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("FeedbackDetectSentiment", gws.newOnFeedbackDetectSentiment(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("JobStatusProvider", gws.newJobStatusLambda(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("MultipartUploadProvider", gws.newMultipartUploadLambda(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("BatchUploadProvider", gws.newBatchUploadLambda(api)))
+	lambdaFunctions = append(lambdaFunctions,
+		gws.publishConfig("BatchAggregator", gws.newOnConsolidatedAggregateBatch(api)))
 	return lambdaFunctions
 }
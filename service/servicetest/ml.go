@@ -0,0 +1,202 @@
+package servicetest
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/comprehend"
+	"github.com/aws/aws-sdk-go/service/polly"
+	"github.com/aws/aws-sdk-go/service/rekognition"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Rekognition is a fake implementation of service.RekognitionAPI. It
+// returns Output (or Err) for every DetectLabels request and records the
+// inputs. The other analyses return their optional outputs, or empty
+// responses, and also fail with Err.
+type Rekognition struct {
+	mu     sync.Mutex
+	Output *rekognition.DetectLabelsOutput
+	Err    error
+	Inputs []*rekognition.DetectLabelsInput
+
+	TextOutput        *rekognition.DetectTextOutput
+	ModerationOutput  *rekognition.DetectModerationLabelsOutput
+	FacesOutput       *rekognition.DetectFacesOutput
+	CelebritiesOutput *rekognition.RecognizeCelebritiesOutput
+	// Images are the images submitted to the other analyses
+	Images []*rekognition.Image
+}
+
+// DetectLabelsWithContext satisfies service.RekognitionAPI
+func (fake *Rekognition) DetectLabelsWithContext(ctx aws.Context,
+	input *rekognition.DetectLabelsInput,
+	opts ...request.Option) (*rekognition.DetectLabelsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Inputs = append(fake.Inputs, input)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.Output == nil {
+		return &rekognition.DetectLabelsOutput{}, nil
+	}
+	return fake.Output, nil
+}
+
+// DetectTextWithContext satisfies service.RekognitionAPI
+func (fake *Rekognition) DetectTextWithContext(ctx aws.Context,
+	input *rekognition.DetectTextInput,
+	opts ...request.Option) (*rekognition.DetectTextOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Images = append(fake.Images, input.Image)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.TextOutput == nil {
+		return &rekognition.DetectTextOutput{}, nil
+	}
+	return fake.TextOutput, nil
+}
+
+// DetectModerationLabelsWithContext satisfies service.RekognitionAPI
+func (fake *Rekognition) DetectModerationLabelsWithContext(ctx aws.Context,
+	input *rekognition.DetectModerationLabelsInput,
+	opts ...request.Option) (*rekognition.DetectModerationLabelsOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Images = append(fake.Images, input.Image)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.ModerationOutput == nil {
+		return &rekognition.DetectModerationLabelsOutput{}, nil
+	}
+	return fake.ModerationOutput, nil
+}
+
+// DetectFacesWithContext satisfies service.RekognitionAPI
+func (fake *Rekognition) DetectFacesWithContext(ctx aws.Context,
+	input *rekognition.DetectFacesInput,
+	opts ...request.Option) (*rekognition.DetectFacesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Images = append(fake.Images, input.Image)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.FacesOutput == nil {
+		return &rekognition.DetectFacesOutput{}, nil
+	}
+	return fake.FacesOutput, nil
+}
+
+// RecognizeCelebritiesWithContext satisfies service.RekognitionAPI
+func (fake *Rekognition) RecognizeCelebritiesWithContext(ctx aws.Context,
+	input *rekognition.RecognizeCelebritiesInput,
+	opts ...request.Option) (*rekognition.RecognizeCelebritiesOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Images = append(fake.Images, input.Image)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.CelebritiesOutput == nil {
+		return &rekognition.RecognizeCelebritiesOutput{}, nil
+	}
+	return fake.CelebritiesOutput, nil
+}
+
+// Polly is a fake implementation of service.PollyAPI. It returns
+// Audio (or Err) for every request and records the inputs.
+type Polly struct {
+	mu     sync.Mutex
+	Audio  []byte
+	Err    error
+	Inputs []*polly.SynthesizeSpeechInput
+}
+
+// SynthesizeSpeechWithContext satisfies service.PollyAPI
+func (fake *Polly) SynthesizeSpeechWithContext(ctx aws.Context,
+	input *polly.SynthesizeSpeechInput,
+	opts ...request.Option) (*polly.SynthesizeSpeechOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Inputs = append(fake.Inputs, input)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	return &polly.SynthesizeSpeechOutput{
+		AudioStream:       ioutil.NopCloser(bytes.NewReader(fake.Audio)),
+		ContentType:       aws.String("audio/mpeg"),
+		RequestCharacters: aws.Int64(int64(len(aws.StringValue(input.Text)))),
+	}, nil
+}
+
+// Comprehend is a fake implementation of service.ComprehendAPI. It
+// returns Output (or Err) for every request and records the inputs.
+type Comprehend struct {
+	mu     sync.Mutex
+	Output *comprehend.DetectSentimentOutput
+	Err    error
+	Inputs []*comprehend.DetectSentimentInput
+}
+
+// DetectSentimentWithContext satisfies service.ComprehendAPI
+func (fake *Comprehend) DetectSentimentWithContext(ctx aws.Context,
+	input *comprehend.DetectSentimentInput,
+	opts ...request.Option) (*comprehend.DetectSentimentOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.Inputs = append(fake.Inputs, input)
+	if fake.Err != nil {
+		return nil, fake.Err
+	}
+	if fake.Output == nil {
+		return &comprehend.DetectSentimentOutput{
+			Sentiment: aws.String(comprehend.SentimentTypeNeutral),
+		}, nil
+	}
+	return fake.Output, nil
+}
+
+// Parameters is a fake implementation of service.ParameterStore
+type Parameters struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+// NewParameters returns an empty parameter store
+func NewParameters() *Parameters {
+	return &Parameters{
+		values: make(map[string]string),
+	}
+}
+
+// Set assigns the value for the given parameter key
+func (fake *Parameters) Set(key string, value string) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.values[key] = value
+}
+
+// GetExpiringString satisfies service.ParameterStore. Missing keys
+// return the ParameterNotFound error, as the SSM cache does.
+func (fake *Parameters) GetExpiringString(key string, expiry time.Duration) (string, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	value, exists := fake.values[key]
+	if !exists {
+		return "", awserr.New(ssm.ErrCodeParameterNotFound,
+			fmt.Sprintf("Parameter %s not found", key),
+			nil)
+	}
+	return value, nil
+}
@@ -0,0 +1,388 @@
+package servicetest
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Object is an object stored in the fake S3 service
+type Object struct {
+	Body         []byte
+	ContentType  string
+	Tags         map[string]string
+	Metadata     map[string]string
+	LastModified time.Time
+}
+
+// ETag returns the quoted MD5 digest of the object body, as S3 does for
+// single part uploads
+func (obj *Object) ETag() string {
+	digest := md5.Sum(obj.Body)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(digest[:]))
+}
+
+// MultipartUpload is an in progress multipart upload in the fake S3
+// service
+type MultipartUpload struct {
+	Bucket      string
+	Key         string
+	ContentType string
+	Parts       map[int64][]byte
+}
+
+// S3 is an in-memory implementation of service.S3API
+type S3 struct {
+	mu         sync.Mutex
+	objects    map[string]*Object
+	multiparts map[string]*MultipartUpload
+	signer     *s3.S3
+}
+
+// NewS3 returns an empty in-memory S3 service
+func NewS3() *S3 {
+	// The signer is only used to produce presigned URLs, which doesn't
+	// require network access
+	signerSession := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Credentials: credentials.NewStaticCredentials("servicetest", "servicetest", ""),
+	}))
+	return &S3{
+		objects:    make(map[string]*Object),
+		multiparts: make(map[string]*MultipartUpload),
+		signer:     s3.New(signerSession),
+	}
+}
+
+func objectKey(bucket string, key string) string {
+	return fmt.Sprintf("%s/%s", bucket, key)
+}
+
+// Put stores the data under the given bucket and key
+func (fake *S3) Put(bucket string, key string, data []byte) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	fake.objects[objectKey(bucket, key)] = &Object{
+		Body:         data,
+		LastModified: time.Now(),
+	}
+}
+
+// PutPart stores the data as a part of the multipart upload, as a client
+// using a presigned UploadPart URL would. It returns false if the upload
+// doesn't exist.
+func (fake *S3) PutPart(uploadID string, partNumber int64, data []byte) bool {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	upload, exists := fake.multiparts[uploadID]
+	if exists {
+		upload.Parts[partNumber] = data
+	}
+	return exists
+}
+
+// Multipart returns the in progress multipart upload
+func (fake *S3) Multipart(uploadID string) (*MultipartUpload, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	upload, exists := fake.multiparts[uploadID]
+	return upload, exists
+}
+
+// Object returns the object stored under the given bucket and key
+func (fake *S3) Object(bucket string, key string) (*Object, bool) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	obj, exists := fake.objects[objectKey(bucket, key)]
+	return obj, exists
+}
+
+// Keys returns the sorted set of keys in the bucket
+func (fake *S3) Keys(bucket string) []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	keys := make([]string, 0)
+	prefix := objectKey(bucket, "")
+	for eachKey := range fake.objects {
+		if strings.HasPrefix(eachKey, prefix) {
+			keys = append(keys, strings.TrimPrefix(eachKey, prefix))
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetObjectWithContext satisfies service.S3API
+func (fake *S3) GetObjectWithContext(ctx aws.Context,
+	input *s3.GetObjectInput,
+	opts ...request.Option) (*s3.GetObjectOutput, error) {
+	obj, exists := fake.Object(aws.StringValue(input.Bucket),
+		aws.StringValue(input.Key))
+	if !exists {
+		return nil, notFound(s3.ErrCodeNoSuchKey, "The specified key does not exist.")
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(obj.Body)),
+		ContentLength: aws.Int64(int64(len(obj.Body))),
+		ContentType:   aws.String(obj.ContentType),
+		ETag:          aws.String(obj.ETag()),
+		LastModified:  aws.Time(obj.LastModified),
+	}, nil
+}
+
+// PutObjectWithContext satisfies service.S3API
+func (fake *S3) PutObjectWithContext(ctx aws.Context,
+	input *s3.PutObjectInput,
+	opts ...request.Option) (*s3.PutObjectOutput, error) {
+	obj := &Object{
+		ContentType:  aws.StringValue(input.ContentType),
+		Tags:         make(map[string]string),
+		Metadata:     aws.StringValueMap(input.Metadata),
+		LastModified: time.Now(),
+	}
+	if input.Body != nil {
+		body, bodyErr := ioutil.ReadAll(input.Body)
+		if bodyErr != nil {
+			return nil, bodyErr
+		}
+		obj.Body = body
+	}
+	if input.Tagging != nil {
+		tags, tagsErr := url.ParseQuery(*input.Tagging)
+		if tagsErr != nil {
+			return nil, tagsErr
+		}
+		for eachKey := range tags {
+			obj.Tags[eachKey] = tags.Get(eachKey)
+		}
+	}
+	fake.mu.Lock()
+	fake.objects[objectKey(aws.StringValue(input.Bucket), aws.StringValue(input.Key))] = obj
+	fake.mu.Unlock()
+	return &s3.PutObjectOutput{
+		ETag: aws.String(obj.ETag()),
+	}, nil
+}
+
+// PutObjectRequest satisfies service.S3API. The returned request can be
+// presigned but is never sent.
+func (fake *S3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	return fake.signer.PutObjectRequest(input)
+}
+
+// HeadObjectWithContext satisfies service.S3API
+func (fake *S3) HeadObjectWithContext(ctx aws.Context,
+	input *s3.HeadObjectInput,
+	opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	obj, exists := fake.Object(aws.StringValue(input.Bucket),
+		aws.StringValue(input.Key))
+	if !exists {
+		return nil, notFound("NotFound", "Not Found")
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(obj.Body))),
+		ContentType:   aws.String(obj.ContentType),
+		ETag:          aws.String(obj.ETag()),
+		LastModified:  aws.Time(obj.LastModified),
+		Metadata:      aws.StringMap(obj.Metadata),
+	}, nil
+}
+
+// ListObjectsV2PagesWithContext satisfies service.S3API. All matching
+// keys are returned in a single page.
+func (fake *S3) ListObjectsV2PagesWithContext(ctx aws.Context,
+	input *s3.ListObjectsV2Input,
+	fn func(*s3.ListObjectsV2Output, bool) bool,
+	opts ...request.Option) error {
+	bucket := aws.StringValue(input.Bucket)
+	prefix := aws.StringValue(input.Prefix)
+	page := &s3.ListObjectsV2Output{
+		Name:   input.Bucket,
+		Prefix: input.Prefix,
+	}
+	for _, eachKey := range fake.Keys(bucket) {
+		if !strings.HasPrefix(eachKey, prefix) {
+			continue
+		}
+		obj, exists := fake.Object(bucket, eachKey)
+		if !exists {
+			continue
+		}
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:          aws.String(eachKey),
+			Size:         aws.Int64(int64(len(obj.Body))),
+			ETag:         aws.String(obj.ETag()),
+			LastModified: aws.Time(obj.LastModified),
+		})
+	}
+	page.KeyCount = aws.Int64(int64(len(page.Contents)))
+	fn(page, true)
+	return nil
+}
+
+// DeleteObjectWithContext satisfies service.S3API
+func (fake *S3) DeleteObjectWithContext(ctx aws.Context,
+	input *s3.DeleteObjectInput,
+	opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	delete(fake.objects, objectKey(aws.StringValue(input.Bucket), aws.StringValue(input.Key)))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+// CopyObjectWithContext satisfies service.S3API. The metadata and tags
+// are always copied.
+func (fake *S3) CopyObjectWithContext(ctx aws.Context,
+	input *s3.CopyObjectInput,
+	opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	copySource, copySourceErr := url.PathUnescape(aws.StringValue(input.CopySource))
+	if copySourceErr != nil {
+		return nil, copySourceErr
+	}
+	sourceParts := strings.SplitN(strings.TrimPrefix(copySource, "/"), "/", 2)
+	if len(sourceParts) != 2 {
+		return nil, awserr.New("InvalidArgument", "Invalid copy source", nil)
+	}
+	obj, exists := fake.Object(sourceParts[0], sourceParts[1])
+	if !exists {
+		return nil, notFound(s3.ErrCodeNoSuchKey, "The specified key does not exist.")
+	}
+	objCopy := *obj
+	objCopy.LastModified = time.Now()
+	fake.mu.Lock()
+	fake.objects[objectKey(aws.StringValue(input.Bucket), aws.StringValue(input.Key))] = &objCopy
+	fake.mu.Unlock()
+	return &s3.CopyObjectOutput{
+		CopyObjectResult: &s3.CopyObjectResult{
+			ETag:         aws.String(objCopy.ETag()),
+			LastModified: aws.Time(objCopy.LastModified),
+		},
+	}, nil
+}
+
+// CreateMultipartUploadWithContext satisfies service.S3API
+func (fake *S3) CreateMultipartUploadWithContext(ctx aws.Context,
+	input *s3.CreateMultipartUploadInput,
+	opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	uploadID := fmt.Sprintf("multipart-%d", len(fake.multiparts)+1)
+	fake.multiparts[uploadID] = &MultipartUpload{
+		Bucket:      aws.StringValue(input.Bucket),
+		Key:         aws.StringValue(input.Key),
+		ContentType: aws.StringValue(input.ContentType),
+		Parts:       make(map[int64][]byte),
+	}
+	return &s3.CreateMultipartUploadOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: aws.String(uploadID),
+	}, nil
+}
+
+// UploadPartRequest satisfies service.S3API. The returned request can be
+// presigned but is never sent; use PutPart to simulate the upload.
+func (fake *S3) UploadPartRequest(input *s3.UploadPartInput) (*request.Request, *s3.UploadPartOutput) {
+	return fake.signer.UploadPartRequest(input)
+}
+
+func partETag(data []byte) string {
+	digest := md5.Sum(data)
+	return fmt.Sprintf("\"%s\"", hex.EncodeToString(digest[:]))
+}
+
+// ListPartsPagesWithContext satisfies service.S3API. All parts are
+// returned in a single page.
+func (fake *S3) ListPartsPagesWithContext(ctx aws.Context,
+	input *s3.ListPartsInput,
+	fn func(*s3.ListPartsOutput, bool) bool,
+	opts ...request.Option) error {
+	upload, exists := fake.Multipart(aws.StringValue(input.UploadId))
+	if !exists {
+		return notFound(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.")
+	}
+	fake.mu.Lock()
+	page := &s3.ListPartsOutput{
+		Bucket:   input.Bucket,
+		Key:      input.Key,
+		UploadId: input.UploadId,
+	}
+	for eachNumber, eachData := range upload.Parts {
+		page.Parts = append(page.Parts, &s3.Part{
+			PartNumber: aws.Int64(eachNumber),
+			ETag:       aws.String(partETag(eachData)),
+			Size:       aws.Int64(int64(len(eachData))),
+		})
+	}
+	fake.mu.Unlock()
+	sort.Slice(page.Parts, func(i, j int) bool {
+		return *page.Parts[i].PartNumber < *page.Parts[j].PartNumber
+	})
+	fn(page, true)
+	return nil
+}
+
+// CompleteMultipartUploadWithContext satisfies service.S3API
+func (fake *S3) CompleteMultipartUploadWithContext(ctx aws.Context,
+	input *s3.CompleteMultipartUploadInput,
+	opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	uploadID := aws.StringValue(input.UploadId)
+	upload, exists := fake.multiparts[uploadID]
+	if !exists {
+		return nil, notFound(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.")
+	}
+	var body bytes.Buffer
+	if input.MultipartUpload != nil {
+		for _, eachPart := range input.MultipartUpload.Parts {
+			data, partExists := upload.Parts[aws.Int64Value(eachPart.PartNumber)]
+			if !partExists ||
+				strings.Trim(partETag(data), "\"") != strings.Trim(aws.StringValue(eachPart.ETag), "\"") {
+				return nil, awserr.New("InvalidPart", "One or more of the specified parts could not be found.", nil)
+			}
+			body.Write(data)
+		}
+	}
+	obj := &Object{
+		Body:         body.Bytes(),
+		ContentType:  upload.ContentType,
+		Tags:         make(map[string]string),
+		LastModified: time.Now(),
+	}
+	fake.objects[objectKey(upload.Bucket, upload.Key)] = obj
+	delete(fake.multiparts, uploadID)
+	return &s3.CompleteMultipartUploadOutput{
+		Bucket: aws.String(upload.Bucket),
+		Key:    aws.String(upload.Key),
+		ETag:   aws.String(obj.ETag()),
+	}, nil
+}
+
+// AbortMultipartUploadWithContext satisfies service.S3API
+func (fake *S3) AbortMultipartUploadWithContext(ctx aws.Context,
+	input *s3.AbortMultipartUploadInput,
+	opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	uploadID := aws.StringValue(input.UploadId)
+	if _, exists := fake.multiparts[uploadID]; !exists {
+		return nil, notFound(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.")
+	}
+	delete(fake.multiparts, uploadID)
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
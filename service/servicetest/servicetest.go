@@ -0,0 +1,90 @@
+// Package servicetest provides in-memory implementations of the AWS
+// client interfaces consumed by the service package, so that the lambda
+// handlers can be exercised without AWS credentials.
+package servicetest
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/mweagle/SpartaGeekwire/service"
+	"github.com/sirupsen/logrus"
+)
+
+// Compile time checks that the fakes satisfy the service interfaces
+var (
+	_ service.S3API          = (*S3)(nil)
+	_ service.RekognitionAPI = (*Rekognition)(nil)
+	_ service.PollyAPI       = (*Polly)(nil)
+	_ service.ComprehendAPI  = (*Comprehend)(nil)
+	_ service.ParameterStore = (*Parameters)(nil)
+)
+
+// BucketName is the bucket name used by NewConfig
+const BucketName = "servicetest-bucket"
+
+// RateLimitTableName is the rate limit table name used by NewConfig
+const RateLimitTableName = "servicetest-rate-limits"
+
+// Fakes is the complete set of fake clients
+type Fakes struct {
+	S3          *S3
+	Blobs       *service.MemoryBlobStore
+	Rekognition *Rekognition
+	Polly       *Polly
+	Comprehend  *Comprehend
+	Parameters  *Parameters
+	RateLimits  *service.MemoryRateLimitStore
+}
+
+// NewFakes returns a new set of empty fakes
+func NewFakes() *Fakes {
+	return &Fakes{
+		S3:          NewS3(),
+		Blobs:       service.NewMemoryBlobStore(),
+		Rekognition: &Rekognition{},
+		Polly:       &Polly{},
+		Comprehend:  &Comprehend{},
+		Parameters:  NewParameters(),
+		RateLimits:  service.NewMemoryRateLimitStore(),
+	}
+}
+
+// Clients returns a service.Clients value backed by the fakes. Set
+// Blobs to nil to store objects in the fake S3 service instead.
+func (fakes *Fakes) Clients() *service.Clients {
+	return &service.Clients{
+		S3:          fakes.S3,
+		Blobs:       fakes.Blobs,
+		Rekognition: fakes.Rekognition,
+		Polly:       fakes.Polly,
+		Comprehend:  fakes.Comprehend,
+		Parameters:  fakes.Parameters,
+		RateLimits:  fakes.RateLimits,
+	}
+}
+
+// NewConfig returns the default configuration with literal bucket and
+// table names, so that no sparta.Discover() call is made
+func NewConfig() *service.Config {
+	config := service.DefaultConfig()
+	config.Connections.S3BucketName = BucketName
+	config.Connections.RateLimitTableName = RateLimitTableName
+	return config
+}
+
+// Context returns a context that includes the logger the handlers
+// expect to find
+func Context(logger *logrus.Logger) context.Context {
+	if logger == nil {
+		logger = logrus.New()
+	}
+	return context.WithValue(context.Background(), sparta.ContextKeyLogger, logger)
+}
+
+// notFound returns an error that matches the one the AWS SDK produces
+// for a missing key
+func notFound(code string, message string) error {
+	return awserr.New(code, message, nil)
+}
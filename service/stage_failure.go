@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	summaryStatusComplete = "complete"
+	summaryStatusFailed   = "failed"
+)
+
+// stageFailure is the structured description of a stage error that's
+// published in the consolidated report. The report is public, so the
+// message is either fixed or an image rejection's reason, and the error
+// itself is only logged.
+type stageFailure struct {
+	Stage      string `json:"stage"`
+	ErrorClass string `json:"error_class"`
+	Message    string `json:"message"`
+	Retryable  bool   `json:"retryable"`
+	Attempts   int    `json:"attempts"`
+}
+
+// stageFailureMessage returns the user facing description of the error.
+// Image rejections explain why the upload was rejected.
+func stageFailureMessage(errorClass string, stageErr error) string {
+	switch errorClass {
+	case "InvalidImage":
+		if rejection, isRejection := errors.Cause(stageErr).(*ImageRejection); isRejection {
+			return rejection.Reason
+		}
+		return "The upload isn't an image that can be analyzed"
+	case "Timeout":
+		return "The upload took too long to process"
+	}
+	return "The upload couldn't be processed"
+}
+
+// classifyStageError returns the error class and whether a subsequent
+// attempt could succeed
+func classifyStageError(stageErr error) (string, bool) {
+	rootErr := errors.Cause(stageErr)
+	if _, isPanic := rootErr.(*RecordPanic); isPanic {
+		return "Panic", false
+	}
+	if _, isRejection := rootErr.(*ImageRejection); isRejection {
+		return "InvalidImage", false
+	}
+	if rootErr == ErrBlobNotFound {
+		return "NotFound", false
+	}
+	if rootErr == context.DeadlineExceeded {
+		return "Timeout", true
+	}
+	awsErr, isAWSErr := rootErr.(awserr.Error)
+	if isAWSErr {
+		// The SDK reports an expired record deadline as a canceled request
+		if awsErr.Code() == request.CanceledErrorCode {
+			return "Timeout", true
+		}
+		if request.IsErrorThrottle(awsErr) {
+			return awsErr.Code(), true
+		}
+		return awsErr.Code(), request.IsErrorRetryable(awsErr)
+	}
+	switch rootErr.(type) {
+	case *json.SyntaxError, *json.UnmarshalTypeError:
+		return "InvalidArtifact", false
+	}
+	return "InternalError", true
+}
+
+func newStageFailure(stageName string, stageErr error) *stageFailure {
+	errorClass, retryable := classifyStageError(stageErr)
+	return &stageFailure{
+		Stage:      stageName,
+		ErrorClass: errorClass,
+		Message:    stageFailureMessage(errorClass, stageErr),
+		Retryable:  retryable,
+	}
+}
+
+// recordStepFailure records the failure of an optional step in the job
+// status warnings, replacing the step's previous failure. A nil error
+// clears the step's failure, so that a successful retry isn't reported
+// as failed.
+func (gws *ServicefulService) recordStepFailure(ctx context.Context,
+	bucket string,
+	uploadID string,
+	stepName string,
+	stepErr error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	if stepErr == nil {
+		// Avoid rewriting the status when there's nothing to clear
+		jobStatus, jobStatusErr := gws.getJobStatus(ctx, bucket, uploadID)
+		if jobStatusErr != nil || jobStatus.warning(stepName) == nil {
+			return
+		}
+	}
+	var failure *stageFailure
+	if stepErr != nil {
+		failure = newStageFailure(stepName, stepErr)
+	}
+	gws.modifyJobStatus(ctx, bucket, uploadID, func(jobStatus *JobStatus, now time.Time) {
+		warnings := make([]*JobError, 0, len(jobStatus.Warnings))
+		for _, eachWarning := range jobStatus.Warnings {
+			if eachWarning.Stage != stepName {
+				warnings = append(warnings, eachWarning)
+			}
+		}
+		if failure != nil {
+			jobStatus.Attempts[stepName]++
+			failure.Attempts = jobStatus.Attempts[stepName]
+			warnings = append(warnings, &JobError{
+				Stage:      stepName,
+				ErrorClass: failure.ErrorClass,
+				Message:    failure.Message,
+				Retryable:  failure.Retryable,
+				Attempt:    failure.Attempts,
+			})
+		}
+		jobStatus.Warnings = warnings
+	})
+	if failure != nil {
+		logger.WithFields(logrus.Fields{
+			"UploadID": uploadID,
+			"Step":     stepName,
+			"Class":    failure.ErrorClass,
+			"Attempt":  failure.Attempts,
+			"Error":    stepErr.Error(),
+		}).Warn("Optional step failed")
+	}
+}
+
+// onStageFailure records the failed attempt. Once the error can't be
+// retried, or Lambda has exhausted its retries, the failure is terminal:
+// the job moves to JobStateFailed and a failure report is written where
+// clients poll for the consolidated report.
+func (gws *ServicefulService) onStageFailure(ctx context.Context,
+	bucket string,
+	uploadID string,
+	stageName string,
+	stageErr error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	failure := newStageFailure(stageName, stageErr)
+
+	terminal := !failure.Retryable
+	gws.modifyJobStatus(ctx, bucket, uploadID, func(jobStatus *JobStatus, now time.Time) {
+		jobStatus.Attempts[stageName]++
+		failure.Attempts = jobStatus.Attempts[stageName]
+		terminal = terminal || failure.Attempts >= gws.config.Pipeline.MaxAttempts
+		jobStatus.Error = &JobError{
+			Stage:      stageName,
+			ErrorClass: failure.ErrorClass,
+			Message:    failure.Message,
+			Retryable:  failure.Retryable,
+			Attempt:    failure.Attempts,
+		}
+		if terminal {
+			jobStatus.transition(JobStateFailed, now)
+		}
+	})
+	logger.WithFields(logrus.Fields{
+		"UploadID": uploadID,
+		"Stage":    stageName,
+		"Class":    failure.ErrorClass,
+		"Attempt":  failure.Attempts,
+		"Terminal": terminal,
+		"Error":    stageErr.Error(),
+	}).Warn("Stage failed")
+	if !terminal {
+		return
+	}
+	summary := summaryInfo{
+		Status:  summaryStatusFailed,
+		Failure: failure,
+	}
+	outputKey := fmt.Sprintf("%s/%s",
+		gws.connections.S3KeyspaceConsolidatedStatus,
+		uploadID)
+	putOptions := &PutOptions{
+		Tags: map[string]string{
+			tagNameAccess: tagAccessPublic,
+		},
+	}
+	putErr := gws.putJSONObject(ctx, bucket, outputKey, &summary, putOptions)
+	if putErr != nil {
+		logger.WithField("Error", putErr).Error("Failed to write failure report")
+	}
+}
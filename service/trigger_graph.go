@@ -0,0 +1,264 @@
+package service
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// triggerEdge is a keyspace write by one stage that triggers another
+type triggerEdge struct {
+	from         *pipelineStage
+	to           *pipelineStage
+	outputPrefix string
+}
+
+// triggerGraph is the set of S3 triggered stages connected by the
+// keyspaces they write to
+type triggerGraph struct {
+	stages []*pipelineStage
+	edges  []*triggerEdge
+}
+
+// prefixesOverlap returns true if a key can start with both prefixes
+func prefixesOverlap(prefix string, otherPrefix string) bool {
+	return strings.HasPrefix(prefix, otherPrefix) ||
+		strings.HasPrefix(otherPrefix, prefix)
+}
+
+// outputTriggers returns true if objects written under the output
+// keyspace match the trigger prefix. Stages write keys of the form
+// <keyspace>/<name>, and S3 prefix filters are plain string prefixes.
+func outputTriggers(outputPrefix string, triggerPrefix string) bool {
+	return prefixesOverlap(keyFilterPrefix(outputPrefix),
+		keyFilterPrefix(triggerPrefix))
+}
+
+// newTriggerGraph assembles the graph and returns an error that lists
+// every overlapping trigger, accidental prefix match and cycle
+func newTriggerGraph(stages []*pipelineStage) (*triggerGraph, error) {
+	graph := &triggerGraph{
+		stages: stages,
+		edges:  make([]*triggerEdge, 0),
+	}
+	problems := make([]string, 0)
+
+	// S3 rejects notification configurations whose prefixes overlap, and
+	// an object matching both would be processed twice
+	for i, eachStage := range stages {
+		for _, eachOther := range stages[i+1:] {
+			if prefixesOverlap(keyFilterPrefix(eachStage.triggerPrefix),
+				keyFilterPrefix(eachOther.triggerPrefix)) {
+				problems = append(problems,
+					fmt.Sprintf("%s trigger prefix %q overlaps %s trigger prefix %q",
+						eachStage.name,
+						eachStage.triggerPrefix,
+						eachOther.name,
+						eachOther.triggerPrefix))
+			}
+		}
+	}
+	for _, eachStage := range stages {
+		for _, eachOutput := range eachStage.outputPrefixes {
+			for _, eachTarget := range stages {
+				if !outputTriggers(eachOutput, eachTarget.triggerPrefix) {
+					continue
+				}
+				// Only an exact keyspace match is intentional. Anything else
+				// (eg: "uploads/thumbs" matching "uploads") is a keyspace that
+				// happens to overlap.
+				if eachOutput != eachTarget.triggerPrefix {
+					problems = append(problems,
+						fmt.Sprintf("%s output keyspace %q ambiguously matches %s trigger prefix %q",
+							eachStage.name,
+							eachOutput,
+							eachTarget.name,
+							eachTarget.triggerPrefix))
+				}
+				graph.edges = append(graph.edges, &triggerEdge{
+					from:         eachStage,
+					to:           eachTarget,
+					outputPrefix: eachOutput,
+				})
+			}
+		}
+	}
+	for _, eachCycle := range graph.cycles() {
+		problems = append(problems,
+			fmt.Sprintf("Recursive trigger loop: %s", strings.Join(eachCycle, " -> ")))
+	}
+	if len(problems) != 0 {
+		return graph, errors.Errorf("Invalid pipeline trigger graph:\n\t%s",
+			strings.Join(problems, "\n\t"))
+	}
+	return graph, nil
+}
+
+// cycles returns the stage names of each cycle found by a depth first
+// search of the graph
+func (graph *triggerGraph) cycles() [][]string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[*pipelineStage]int)
+	path := make([]*pipelineStage, 0)
+	cycles := make([][]string, 0)
+
+	var visit func(stage *pipelineStage)
+	visit = func(stage *pipelineStage) {
+		state[stage] = visiting
+		path = append(path, stage)
+		for _, eachEdge := range graph.edges {
+			if eachEdge.from != stage {
+				continue
+			}
+			switch state[eachEdge.to] {
+			case visiting:
+				cycle := make([]string, 0)
+				inCycle := false
+				for _, eachPathStage := range path {
+					inCycle = inCycle || eachPathStage == eachEdge.to
+					if inCycle {
+						cycle = append(cycle, eachPathStage.name)
+					}
+				}
+				cycles = append(cycles, append(cycle, eachEdge.to.name))
+			case unvisited:
+				visit(eachEdge.to)
+			}
+		}
+		path = path[:len(path)-1]
+		state[stage] = visited
+	}
+	for _, eachStage := range graph.stages {
+		if state[eachStage] == unvisited {
+			visit(eachStage)
+		}
+	}
+	return cycles
+}
+
+var diagramNodeID = regexp.MustCompile("[^A-Za-z0-9]")
+
+func keyspaceNodeID(keyspace string) string {
+	return "ks_" + diagramNodeID.ReplaceAllString(keyspace, "_")
+}
+
+// keyspaces returns the trigger and output keyspaces in stage order
+func (graph *triggerGraph) keyspaces() []string {
+	keyspaces := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, eachStage := range graph.stages {
+		for _, eachKeyspace := range append([]string{eachStage.triggerPrefix},
+			eachStage.outputPrefixes...) {
+			if !seen[eachKeyspace] {
+				seen[eachKeyspace] = true
+				keyspaces = append(keyspaces, eachKeyspace)
+			}
+		}
+	}
+	return keyspaces
+}
+
+// mermaid returns the flowchart representation of the pipeline
+func (graph *triggerGraph) mermaid() string {
+	var output bytes.Buffer
+	output.WriteString("graph LR\n")
+	for _, eachKeyspace := range graph.keyspaces() {
+		fmt.Fprintf(&output, "  %s[(\"%s/\")]\n", keyspaceNodeID(eachKeyspace), eachKeyspace)
+	}
+	for _, eachStage := range graph.stages {
+		fmt.Fprintf(&output, "  %s[\"%s\"]\n", eachStage.name, eachStage.name)
+		fmt.Fprintf(&output, "  %s -- ObjectCreated --> %s\n",
+			keyspaceNodeID(eachStage.triggerPrefix),
+			eachStage.name)
+		for _, eachOutput := range eachStage.outputPrefixes {
+			fmt.Fprintf(&output, "  %s --> %s\n", eachStage.name, keyspaceNodeID(eachOutput))
+		}
+	}
+	return output.String()
+}
+
+// dot returns the Graphviz representation of the pipeline
+func (graph *triggerGraph) dot() string {
+	var output bytes.Buffer
+	output.WriteString("digraph pipeline {\n  rankdir=LR;\n")
+	for _, eachKeyspace := range graph.keyspaces() {
+		fmt.Fprintf(&output, "  %s [label=\"%s/\", shape=cylinder];\n",
+			keyspaceNodeID(eachKeyspace),
+			eachKeyspace)
+	}
+	for _, eachStage := range graph.stages {
+		fmt.Fprintf(&output, "  %s [label=\"%s\", shape=box];\n", eachStage.name, eachStage.name)
+		fmt.Fprintf(&output, "  %s -> %s [label=\"ObjectCreated\"];\n",
+			keyspaceNodeID(eachStage.triggerPrefix),
+			eachStage.name)
+		for _, eachOutput := range eachStage.outputPrefixes {
+			fmt.Fprintf(&output, "  %s -> %s;\n", eachStage.name, keyspaceNodeID(eachOutput))
+		}
+	}
+	output.WriteString("}\n")
+	return output.String()
+}
+
+// pipelineTriggerGraph returns the trigger graph of the stages defined
+// by the configuration
+func pipelineTriggerGraph(config *Config) (*triggerGraph, error) {
+	gws := newServicefulService(config, nil)
+	gws.lambdaFunctions(nil)
+	return newTriggerGraph(gws.stages)
+}
+
+// TriggerGraphDecorator returns a service decorator that rejects pipelines
+// whose S3 notifications could recursively trigger each other. It also
+// writes Mermaid and DOT diagrams of the pipeline to the Sparta scratch
+// directory.
+func TriggerGraphDecorator(config *Config) sparta.ServiceDecoratorHookFunc {
+	return func(context map[string]interface{},
+		serviceName string,
+		cfTemplate *gocf.Template,
+		S3Bucket string,
+		buildID string,
+		awsSession *session.Session,
+		noop bool,
+		logger *logrus.Logger) error {
+
+		graph, graphErr := pipelineTriggerGraph(config)
+		if graphErr != nil {
+			return graphErr
+		}
+		mkdirErr := os.MkdirAll(sparta.ScratchDirectory, os.ModePerm)
+		if mkdirErr != nil {
+			return mkdirErr
+		}
+		diagrams := map[string]string{
+			fmt.Sprintf("%s-pipeline.mmd", serviceName): graph.mermaid(),
+			fmt.Sprintf("%s-pipeline.dot", serviceName): graph.dot(),
+		}
+		for eachName, eachDiagram := range diagrams {
+			outputPath := filepath.Join(sparta.ScratchDirectory, eachName)
+			writeErr := ioutil.WriteFile(outputPath, []byte(eachDiagram), 0644)
+			if writeErr != nil {
+				return errors.Wrapf(writeErr, "Failed to write pipeline diagram")
+			}
+			logger.WithField("Path", outputPath).Info("Pipeline diagram")
+		}
+		logger.WithFields(logrus.Fields{
+			"Stages": len(graph.stages),
+			"Edges":  len(graph.edges),
+		}).Info("Pipeline trigger graph verified")
+		return nil
+	}
+}
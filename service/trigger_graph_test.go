@@ -0,0 +1,59 @@
+package service_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mweagle/SpartaGeekwire/service"
+	"github.com/mweagle/SpartaGeekwire/service/servicetest"
+)
+
+func TestTriggerGraph(t *testing.T) {
+	testCases := []struct {
+		name      string
+		configure func(config *service.Config)
+		wantErr   string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name: "status keyspace sharing the uploads prefix",
+			configure: func(config *service.Config) {
+				config.Connections.S3KeyspaceJobStatus = config.Connections.S3KeyspaceUploads + "-status"
+			},
+		},
+		{
+			name: "status keyspace inside the uploads keyspace",
+			configure: func(config *service.Config) {
+				config.Connections.S3KeyspaceJobStatus = config.Connections.S3KeyspaceUploads + "/status"
+			},
+			wantErr: "Recursive trigger loop: ValidateImage -> ValidateImage",
+		},
+		{
+			name: "status keyspace is a trigger",
+			configure: func(config *service.Config) {
+				config.Connections.S3KeyspaceJobStatus = config.Connections.S3KeyspacePollyArtifacts
+			},
+			wantErr: "Recursive trigger loop: GenerateSummary -> GenerateSummary",
+		},
+	}
+	for _, eachTestCase := range testCases {
+		t.Run(eachTestCase.name, func(t *testing.T) {
+			config := servicetest.NewConfig()
+			if eachTestCase.configure != nil {
+				eachTestCase.configure(config)
+			}
+			graphErr := service.CheckTriggerGraph(config)
+			if eachTestCase.wantErr == "" {
+				if graphErr != nil {
+					t.Fatalf("Unexpected error: %s", graphErr)
+				}
+				return
+			}
+			if graphErr == nil || !strings.Contains(graphErr.Error(), eachTestCase.wantErr) {
+				t.Fatalf("Expected %q, got: %v", eachTestCase.wantErr, graphErr)
+			}
+		})
+	}
+}
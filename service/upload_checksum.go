@@ -0,0 +1,155 @@
+package service
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	sparta "github.com/mweagle/Sparta"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Checksum algorithms a client can declare for an upload
+const (
+	ChecksumSHA256 = "SHA256"
+	ChecksumMD5    = "MD5"
+)
+
+// UploadChecksum is the client declared digest of an upload. The digest
+// is part of the presigned signature, so S3 rejects bodies that don't
+// match it.
+type UploadChecksum struct {
+	Algorithm string `json:"algorithm"`
+	// Value is the hex encoded digest
+	Value string `json:"value"`
+	// Verified is set once a stage has checked the stored object
+	Verified bool `json:"verified,omitempty"`
+}
+
+func (checksum *UploadChecksum) digest() []byte {
+	digest, _ := hex.DecodeString(checksum.Value)
+	return digest
+}
+
+// base64Value returns the digest in the encoding S3 headers use
+func (checksum *UploadChecksum) base64Value() string {
+	return base64.StdEncoding.EncodeToString(checksum.digest())
+}
+
+func (checksum *UploadChecksum) newHash() hash.Hash {
+	if checksum.Algorithm == ChecksumMD5 {
+		return md5.New()
+	}
+	return sha256.New()
+}
+
+// parseDigest accepts a hex or base64 encoded digest of the given length
+func parseDigest(value string, size int) ([]byte, bool) {
+	digest, hexErr := hex.DecodeString(value)
+	if hexErr == nil && len(digest) == size {
+		return digest, true
+	}
+	digest, base64Err := base64.StdEncoding.DecodeString(value)
+	if base64Err == nil && len(digest) == size {
+		return digest, true
+	}
+	return nil, false
+}
+
+// newUploadChecksum returns the checksum declared by the sha256 or md5
+// query parameter, or nil if neither was supplied
+func newUploadChecksum(queryParams map[string]string) (*UploadChecksum, error) {
+	sha256Value := strings.TrimSpace(queryParams["sha256"])
+	md5Value := strings.TrimSpace(queryParams["md5"])
+	switch {
+	case sha256Value != "" && md5Value != "":
+		return nil, errors.New("Only one of sha256 or md5 may be supplied")
+	case sha256Value != "":
+		digest, digestOK := parseDigest(sha256Value, sha256.Size)
+		if !digestOK {
+			return nil, errors.Errorf("sha256 must be a hex or base64 encoded SHA-256 digest: %s", sha256Value)
+		}
+		return &UploadChecksum{
+			Algorithm: ChecksumSHA256,
+			Value:     hex.EncodeToString(digest),
+		}, nil
+	case md5Value != "":
+		digest, digestOK := parseDigest(md5Value, md5.Size)
+		if !digestOK {
+			return nil, errors.Errorf("md5 must be a hex or base64 encoded MD5 digest: %s", md5Value)
+		}
+		return &UploadChecksum{
+			Algorithm: ChecksumMD5,
+			Value:     hex.EncodeToString(digest),
+		}, nil
+	}
+	return nil, nil
+}
+
+// presignExpiry returns the lifetime requested by the optional
+// expires_in query parameter, which can't exceed the configured maximum
+func (gws *ServicefulService) presignExpiry(queryParams map[string]string) (time.Duration, error) {
+	expirySeconds := gws.config.Uploads.PresignExpirySeconds
+	if queryParams["expires_in"] != "" {
+		requested, requestedErr := strconv.Atoi(queryParams["expires_in"])
+		if requestedErr != nil ||
+			requested < 1 ||
+			requested > gws.config.Uploads.MaxPresignExpirySeconds {
+			return 0, errors.Errorf("expires_in must be 1-%d seconds: %s",
+				gws.config.Uploads.MaxPresignExpirySeconds,
+				queryParams["expires_in"])
+		}
+		expirySeconds = requested
+	}
+	return time.Duration(expirySeconds) * time.Second, nil
+}
+
+// verifyUploadChecksum checks the stored upload against the declared
+// checksum. Single part uploads have an MD5 ETag, which avoids reading
+// the object. Otherwise it's streamed through the hash.
+func (gws *ServicefulService) verifyUploadChecksum(ctx context.Context,
+	bucket string,
+	uploadID string,
+	declared *UploadChecksum) (*UploadChecksum, error) {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+	checksum := *declared
+	blobs := gws.clients(ctx).Blobs
+	uploadKey := gws.uploadKey(uploadID)
+
+	if checksum.Algorithm == ChecksumMD5 {
+		uploadInfo, uploadInfoErr := blobs.Head(ctx, bucket, uploadKey)
+		if uploadInfoErr != nil {
+			return nil, uploadInfoErr
+		}
+		if !strings.Contains(uploadInfo.ETag, "-") {
+			checksum.Verified = strings.EqualFold(uploadInfo.ETag, checksum.Value)
+			return &checksum, nil
+		}
+	}
+	uploadReader, uploadReaderErr := blobs.Open(ctx, bucket, uploadKey)
+	if uploadReaderErr != nil {
+		return nil, uploadReaderErr
+	}
+	defer uploadReader.Close()
+	digest := checksum.newHash()
+	_, copyErr := io.Copy(digest, uploadReader)
+	if copyErr != nil {
+		return nil, errors.Wrapf(copyErr, "Failed to read upload: %s", uploadID)
+	}
+	checksum.Verified = hex.EncodeToString(digest.Sum(nil)) == checksum.Value
+	if !checksum.Verified {
+		logger.WithFields(logrus.Fields{
+			"UploadID":  uploadID,
+			"Algorithm": checksum.Algorithm,
+		}).Warn("Upload doesn't match the declared checksum")
+	}
+	return &checksum, nil
+}
@@ -0,0 +1,89 @@
+package service
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// crockfordAlphabet is the Base32 alphabet ULIDs are encoded with. It
+// excludes I, L, O and U to avoid ambiguity, and sorts in byte order.
+const crockfordAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// uploadIDGenerator returns ULID formatted upload IDs: a 48 bit
+// millisecond timestamp followed by 80 random bits, encoded as 26
+// Crockford Base32 characters. IDs sort by creation time, and IDs
+// created within the same millisecond are monotonically increasing.
+type uploadIDGenerator struct {
+	mutex      sync.Mutex
+	now        func() time.Time
+	entropy    io.Reader
+	lastMillis uint64
+	lastRandom [10]byte
+}
+
+func newUploadIDGenerator() *uploadIDGenerator {
+	return &uploadIDGenerator{
+		now:     time.Now,
+		entropy: rand.Reader,
+	}
+}
+
+// incrementRandom adds one to the random component, returning false if
+// it overflowed
+func (generator *uploadIDGenerator) incrementRandom() bool {
+	for i := len(generator.lastRandom) - 1; i >= 0; i-- {
+		generator.lastRandom[i]++
+		if generator.lastRandom[i] != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// NewID returns the next upload ID
+func (generator *uploadIDGenerator) NewID() (string, error) {
+	generator.mutex.Lock()
+	defer generator.mutex.Unlock()
+
+	millis := uint64(generator.now().UnixNano() / int64(time.Millisecond))
+	if millis <= generator.lastMillis {
+		// Same millisecond (or the clock went backwards), so keep the
+		// previous timestamp and increment the random component
+		if !generator.incrementRandom() {
+			return "", errors.New("Upload ID random component overflowed")
+		}
+		millis = generator.lastMillis
+	} else {
+		_, readErr := io.ReadFull(generator.entropy, generator.lastRandom[:])
+		if readErr != nil {
+			return "", errors.Wrapf(readErr, "Failed to read upload ID entropy")
+		}
+		generator.lastMillis = millis
+	}
+
+	var id [16]byte
+	var timestamp [8]byte
+	binary.BigEndian.PutUint64(timestamp[:], millis)
+	copy(id[:6], timestamp[2:])
+	copy(id[6:], generator.lastRandom[:])
+	return encodeULID(id), nil
+}
+
+// encodeULID encodes the 128 bit ID as 26 Base32 characters. The first
+// character only carries 3 bits.
+func encodeULID(id [16]byte) string {
+	high := binary.BigEndian.Uint64(id[:8])
+	low := binary.BigEndian.Uint64(id[8:])
+	encoded := make([]byte, 26)
+	for i := len(encoded) - 1; i >= 0; i-- {
+		encoded[i] = crockfordAlphabet[low&0x1f]
+		low = (low >> 5) | (high << 59)
+		high >>= 5
+	}
+	return string(encoded)
+}
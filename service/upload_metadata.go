@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	maxUploadFilenameLength = 255
+	maxUploadTitleLength    = 200
+)
+
+// UploadMetadata is the client supplied description of an upload. It's
+// stored as a sidecar document because the upload key is only the
+// upload ID.
+type UploadMetadata struct {
+	UploadID    string    `json:"upload_id"`
+	Filename    string    `json:"filename,omitempty"`
+	ContentType string    `json:"content_type,omitempty"`
+	Size        int64     `json:"size,omitempty"`
+	Title       string    `json:"title,omitempty"`
+	Created     time.Time `json:"created"`
+	// Checksum is the optional client declared digest
+	Checksum *UploadChecksum `json:"checksum,omitempty"`
+	// BatchID is set for uploads submitted as part of a batch
+	BatchID string `json:"batch_id,omitempty"`
+	// Subject is the authenticated user that requested the upload
+	Subject string `json:"subject,omitempty"`
+}
+
+// subject returns the phrase the narration uses to refer to the upload.
+// The narration is published, so it doesn't use the filename.
+func (metadata *UploadMetadata) subject() string {
+	if metadata != nil && metadata.Title != "" {
+		return fmt.Sprintf("your photo %s", metadata.Title)
+	}
+	return "this image"
+}
+
+// redacted returns the metadata without the uploader's identity or
+// filename, which only the private sidecar keeps. The reports are public.
+func (metadata *UploadMetadata) redacted() *UploadMetadata {
+	if metadata == nil {
+		return nil
+	}
+	redacted := *metadata
+	redacted.Filename = ""
+	redacted.Subject = ""
+	return &redacted
+}
+
+// newUploadMetadata validates the optional metadata query parameters.
+// It returns nil if none were supplied.
+func newUploadMetadata(uploadID string, queryParams map[string]string) (*UploadMetadata, error) {
+	metadata := &UploadMetadata{
+		UploadID:    uploadID,
+		ContentType: queryParams["content_type"],
+		Created:     time.Now().UTC(),
+	}
+	// Only keep the final path element of the client's filename
+	filename := strings.TrimSpace(queryParams["filename"])
+	if filename != "" {
+		metadata.Filename = path.Base(strings.Replace(filename, "\\", "/", -1))
+	}
+	metadata.Title = strings.TrimSpace(queryParams["title"])
+	if utf8.RuneCountInString(metadata.Filename) > maxUploadFilenameLength {
+		return nil, errors.Errorf("filename must be at most %d characters", maxUploadFilenameLength)
+	}
+	if utf8.RuneCountInString(metadata.Title) > maxUploadTitleLength {
+		return nil, errors.Errorf("title must be at most %d characters", maxUploadTitleLength)
+	}
+	if queryParams["size"] != "" {
+		size, sizeErr := strconv.ParseInt(queryParams["size"], 10, 64)
+		if sizeErr != nil || size < 0 {
+			return nil, errors.Errorf("size must be a non-negative integer: %s", queryParams["size"])
+		}
+		metadata.Size = size
+	}
+	checksum, checksumErr := newUploadChecksum(queryParams)
+	if checksumErr != nil {
+		return nil, checksumErr
+	}
+	metadata.Checksum = checksum
+	if metadata.Filename == "" &&
+		metadata.Title == "" &&
+		metadata.ContentType == "" &&
+		metadata.Size == 0 &&
+		metadata.Checksum == nil {
+		return nil, nil
+	}
+	return metadata, nil
+}
+
+func (gws *ServicefulService) uploadMetadataKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceUploadMetadata, uploadID)
+}
+
+// getUploadMetadata returns the sidecar metadata for the upload, or nil
+// if none was supplied
+func (gws *ServicefulService) getUploadMetadata(ctx context.Context,
+	bucket string,
+	uploadID string) (*UploadMetadata, error) {
+	metadataData, metadataDataErr := gws.getObject(ctx, bucket, gws.uploadMetadataKey(uploadID))
+	if IsBlobNotFound(metadataDataErr) {
+		return nil, nil
+	} else if metadataDataErr != nil {
+		return nil, metadataDataErr
+	}
+	metadata := &UploadMetadata{}
+	unmarshalErr := json.Unmarshal(metadataData, metadata)
+	if unmarshalErr != nil {
+		return nil, errors.Wrapf(unmarshalErr, "Failed to parse upload metadata")
+	}
+	return metadata, nil
+}
@@ -0,0 +1,288 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	// Register the decoders for the image types the pipeline accepts
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"strings"
+
+	awsLamdaEvents "github.com/aws/aws-lambda-go/events"
+	sparta "github.com/mweagle/Sparta"
+	gocf "github.com/mweagle/go-cloudformation"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// ImageRejection is the error returned for uploads that can't be
+// analyzed. The reason is published in the failure report, so it's
+// written for the person who uploaded the image.
+type ImageRejection struct {
+	Reason string
+}
+
+func (rejection *ImageRejection) Error() string {
+	return rejection.Reason
+}
+
+func rejectImage(format string, args ...interface{}) error {
+	return &ImageRejection{
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// imageFormat is an image type Rekognition accepts
+type imageFormat struct {
+	name        string
+	contentType string
+	magic       []byte
+}
+
+var imageFormats = []*imageFormat{
+	&imageFormat{
+		name:        "jpeg",
+		contentType: "image/jpeg",
+		magic:       []byte{0xFF, 0xD8, 0xFF},
+	},
+	&imageFormat{
+		name:        "png",
+		contentType: "image/png",
+		magic:       []byte("\x89PNG\r\n\x1a\n"),
+	},
+}
+
+// isImageContentType returns true if the type is one of the imageFormats
+func isImageContentType(contentType string) bool {
+	for _, eachFormat := range imageFormats {
+		if strings.EqualFold(contentType, eachFormat.contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// imageValidation is the artifact written for uploads that pass
+// validation. It's deterministic, so that revalidating the same upload
+// doesn't retrigger the later stages.
+type imageValidation struct {
+	UploadID    string `json:"upload_id"`
+	Key         string `json:"key"`
+	ContentType string `json:"content_type"`
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	Size        int64  `json:"size"`
+}
+
+// validateImage checks the magic bytes, the declared content type and
+// the decoded image header against the limits
+func validateImage(data []byte,
+	declaredContentType string,
+	settings *ValidationSettings) (*imageValidation, error) {
+	var format *imageFormat
+	for _, eachFormat := range imageFormats {
+		if bytes.HasPrefix(data, eachFormat.magic) {
+			format = eachFormat
+			break
+		}
+	}
+	if format == nil {
+		detectedType := strings.Split(http.DetectContentType(data), ";")[0]
+		return nil, rejectImage("The upload appears to be %s, which isn't a JPEG or PNG image",
+			detectedType)
+	}
+	if declaredContentType != "" && !strings.EqualFold(declaredContentType, format.contentType) {
+		return nil, rejectImage("The upload was declared as %s but is a %s image",
+			declaredContentType,
+			strings.ToUpper(format.name))
+	}
+	config, decodedFormat, configErr := image.DecodeConfig(bytes.NewReader(data))
+	if configErr != nil || decodedFormat != format.name {
+		return nil, rejectImage("The %s image is corrupt and couldn't be read",
+			strings.ToUpper(format.name))
+	}
+	if config.Width < settings.MinDimensionPixels || config.Height < settings.MinDimensionPixels {
+		return nil, rejectImage("The image is %dx%d pixels. Images must be at least %d pixels on each side.",
+			config.Width,
+			config.Height,
+			settings.MinDimensionPixels)
+	}
+	if config.Width > settings.MaxDimensionPixels || config.Height > settings.MaxDimensionPixels {
+		return nil, rejectImage("The image is %dx%d pixels. Images must be at most %d pixels on each side.",
+			config.Width,
+			config.Height,
+			settings.MaxDimensionPixels)
+	}
+	return &imageValidation{
+		ContentType: format.contentType,
+		Width:       config.Width,
+		Height:      config.Height,
+		Size:        int64(len(data)),
+	}, nil
+}
+
+func (gws *ServicefulService) quarantineKey(uploadID string) string {
+	return fmt.Sprintf("%s/%s", gws.connections.S3KeyspaceQuarantine, uploadID)
+}
+
+// quarantineUpload moves the rejected upload out of the uploads keyspace
+func (gws *ServicefulService) quarantineUpload(ctx context.Context,
+	bucket string,
+	key string,
+	uploadID string) error {
+	blobs := gws.clients(ctx).Blobs
+	copyErr := blobs.Copy(ctx, bucket, key, gws.quarantineKey(uploadID))
+	if copyErr != nil {
+		return errors.Wrapf(copyErr, "Failed to quarantine upload: %s", key)
+	}
+	return blobs.Delete(ctx, bucket, key)
+}
+
+/*
+================================================================================
+╦  ╔═╗╔╦╗╔╗ ╔╦╗╔═╗
+║  ╠═╣║║║╠╩╗ ║║╠═╣
+╩═╝╩ ╩╩ ╩╚═╝═╩╝╩ ╩
+================================================================================
+Listen for uploads and check that they're images Rekognition can analyze.
+Rejected uploads are moved to the quarantine keyspace.
+*/
+func (gws *ServicefulService) onS3PutValidateImage(ctx context.Context,
+	s3Event awsLamdaEvents.S3Event) error {
+	logger, _ := ctx.Value(sparta.ContextKeyLogger).(*logrus.Logger)
+
+	handler := func(ctx context.Context,
+		event awsLamdaEvents.S3EventRecord) (interface{}, error) {
+		bucketName := event.S3.Bucket.Name
+		uploadID := gws.baseKeyname(event.S3.Object.Key)
+		keyPath := fmt.Sprintf("%s/%s",
+			gws.connections.S3KeyspaceValidations,
+			uploadID)
+		if gws.isFresh(ctx, event, keyPath) {
+			return &stageSkipped{Key: keyPath}, nil
+		}
+		blobs := gws.clients(ctx).Blobs
+		uploadInfo, uploadInfoErr := blobs.Head(ctx, bucketName, event.S3.Object.Key)
+		if IsBlobNotFound(uploadInfoErr) {
+			// A redelivered event for an upload that was already rejected
+			_, quarantinedErr := blobs.Head(ctx, bucketName, gws.quarantineKey(uploadID))
+			if quarantinedErr == nil {
+				return &stageSkipped{Key: gws.quarantineKey(uploadID)}, nil
+			}
+			return nil, uploadInfoErr
+		} else if uploadInfoErr != nil {
+			return nil, uploadInfoErr
+		}
+		gws.updateJobStatus(ctx, bucketName, uploadID, JobStateUploaded)
+
+		uploadMetadata, uploadMetadataErr := gws.getUploadMetadata(ctx, bucketName, uploadID)
+		if uploadMetadataErr != nil {
+			return nil, uploadMetadataErr
+		}
+		declaredContentType := ""
+		if uploadMetadata != nil {
+			declaredContentType = uploadMetadata.ContentType
+		}
+		settings := &gws.config.Validation
+		var validation *imageValidation
+		var validationErr error
+		switch {
+		case uploadInfo.Size == 0:
+			validationErr = rejectImage("The upload is empty")
+		case uploadInfo.Size > settings.MaxSizeBytes:
+			// Don't read oversized uploads
+			validationErr = rejectImage("The upload is %d bytes. Images must be at most %d bytes.",
+				uploadInfo.Size,
+				settings.MaxSizeBytes)
+		default:
+			uploadData, uploadDataErr := blobs.Get(ctx, bucketName, event.S3.Object.Key)
+			if uploadDataErr != nil {
+				return nil, uploadDataErr
+			}
+			validation, validationErr = validateImage(uploadData, declaredContentType, settings)
+		}
+		if _, isRejection := validationErr.(*ImageRejection); isRejection {
+			logger.WithFields(logrus.Fields{
+				"UploadID": uploadID,
+				"Reason":   validationErr.Error(),
+			}).Warn("Upload rejected")
+			quarantineErr := gws.quarantineUpload(ctx, bucketName, event.S3.Object.Key, uploadID)
+			if quarantineErr != nil {
+				return nil, quarantineErr
+			}
+			return nil, validationErr
+		} else if validationErr != nil {
+			return nil, validationErr
+		}
+		validation.UploadID = uploadID
+		validation.Key = event.S3.Object.Key
+		putErr := gws.putJSONObject(ctx,
+			bucketName,
+			keyPath,
+			validation,
+			&PutOptions{Metadata: sourceMetadata(event)})
+		if putErr != nil {
+			return nil, putErr
+		}
+		logger.WithField("Key", keyPath).Info("Put Item")
+		return nil, nil
+	}
+	handleResult, handleErr := gws.handleS3Records(ctx,
+		s3Event,
+		gws.withJobStatus("ValidateImage", JobStateValidated, handler))
+	logger.WithField("Results", handleResult).Info("S3 event results")
+	return handleErr
+}
+
+// getImageValidation returns the validation artifact written for the
+// upload
+func (gws *ServicefulService) getImageValidation(ctx context.Context,
+	bucket string,
+	keyPath string) (*imageValidation, error) {
+	validationData, validationDataErr := gws.getObject(ctx, bucket, keyPath)
+	if validationDataErr != nil {
+		return nil, validationDataErr
+	}
+	validation := &imageValidation{}
+	unmarshalErr := json.Unmarshal(validationData, validation)
+	if unmarshalErr != nil {
+		return nil, errors.Wrapf(unmarshalErr, "Failed to parse image validation")
+	}
+	return validation, nil
+}
+
+////////////////////////////////////////////////////////////////////////////////
+// Create
+func (gws *ServicefulService) newOnS3PutValidateImage(api *sparta.API) *sparta.LambdaAWSInfo {
+	lambdaFn := sparta.HandleAWSLambda("ValidateImage",
+		gws.onS3PutValidateImage,
+		sparta.IAMRoleDefinition{})
+	lambdaFn.Options = &sparta.LambdaFunctionOptions{
+		Description: "Check that uploads are images Rekognition can analyze",
+		MemorySize:  256,
+		Timeout:     10,
+		TracingConfig: &gocf.LambdaFunctionTracingConfig{
+			Mode: gocf.String("Active"),
+		},
+	}
+	// IAM Role privileges
+	lambdaFn.RoleDefinition.Privileges = append(gws.bucketGetPutPrivileges(),
+		gws.bucketDeletePrivilege())
+
+	// Dependency
+	lambdaFn.DependsOn = []string{gws.connections.S3UploadBucketResourceName}
+
+	// Event Triggers
+	gws.subscribeS3Prefix(lambdaFn,
+		"ValidateImage",
+		gws.connections.S3KeyspaceUploads,
+		gws.onS3PutValidateImage,
+		gws.connections.S3KeyspaceValidations,
+		gws.connections.S3KeyspaceQuarantine)
+
+	return lambdaFn
+}